@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+
+	nbdbackend "nbd/backend"
+)
+
+// resizeOverlay 恢复元数据中记录的虚拟大小，size 不为 0 时再扩容到 size 并记录下来
+// 虚拟大小只能扩大，超出基础设备的部分读出全零，写入保存在扇区目录中
+func resizeOverlay(cow *nbdbackend.CowBackend, sectorDir string, size int64) error {
+	meta, err := nbdbackend.LoadMetadata(sectorDir)
+	if err != nil {
+		return err
+	}
+	if meta == nil {
+		return fmt.Errorf("no metadata in %s", sectorDir)
+	}
+	if err := restoreSize(cow, meta); err != nil {
+		return err
+	}
+	if size == 0 || size == meta.Size {
+		return nil
+	}
+
+	if size%512 != 0 {
+		return fmt.Errorf("size %d is not a multiple of 512", size)
+	}
+	current, err := cow.Size()
+	if err != nil {
+		return err
+	}
+	if size < current {
+		return fmt.Errorf("cannot shrink from %d to %d bytes", current, size)
+	}
+
+	// 先记录新大小再扩大导出，元数据写入失败时客户端看不到新的范围，重启后也不会丢失写入的数据
+	oldSize := meta.Size
+	meta.Size = size
+	if err := nbdbackend.SaveMetadata(sectorDir, meta); err != nil {
+		return fmt.Errorf("failed to write metadata: %v", err)
+	}
+	if err := cow.SetSize(size); err != nil {
+		meta.Size = oldSize
+		if rerr := nbdbackend.SaveMetadata(sectorDir, meta); rerr != nil {
+			log.Printf("Failed to restore metadata of %s: %v", sectorDir, rerr)
+		}
+		return err
+	}
+	return nil
+}
+
+// restoreSize 恢复元数据中记录的虚拟大小，记录的大小不超过当前大小时什么也不做
+func restoreSize(cow *nbdbackend.CowBackend, meta *nbdbackend.Metadata) error {
+	if meta == nil || meta.Size == 0 {
+		return nil
+	}
+	current, err := cow.Size()
+	if err != nil {
+		return err
+	}
+	if meta.Size <= current {
+		return nil
+	}
+	return cow.SetSize(meta.Size)
+}
+
+// adminServer 是服务器的 HTTP 管理接口
+//
+//	GET  /size               返回当前的虚拟大小
+//	POST /resize?size=20G    在线扩容，只能扩大
+type adminServer struct {
+	mu         sync.Mutex // 串行化扩容，保证元数据与内存中的大小一致
+	cow        *nbdbackend.CowBackend
+	sectorDir  string
+	sectorSize int64
+}
+
+// adminStatus 是管理接口返回的导出状态
+type adminStatus struct {
+	Size       int64 `json:"size"`
+	SectorSize int64 `json:"sector_size"`
+}
+
+// startAdmin 在 addr 上启动管理接口
+func startAdmin(addr string, a *adminServer) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on admin address: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/size", a.handleSize)
+	mux.HandleFunc("/resize", a.handleResize)
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			log.Printf("Admin interface stopped: %v", err)
+		}
+	}()
+	fmt.Printf("Admin interface listening on %s\n", addr)
+	return nil
+}
+
+// writeStatus 以 JSON 返回当前状态
+func (a *adminServer) writeStatus(w http.ResponseWriter) {
+	size, err := a.cow.Size()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(adminStatus{Size: size, SectorSize: a.sectorSize})
+}
+
+func (a *adminServer) handleSize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	a.writeStatus(w)
+}
+
+// handleResize 在线扩容。NBD 协议无法在传输阶段通知客户端，已连接的客户端重新协商后才能看到新大小，
+// 在此之前它们对原有范围的访问不受影响
+func (a *adminServer) handleResize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	size, err := parseSize(r.FormValue("size"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	old, err := a.cow.Size()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if size < old {
+		http.Error(w, fmt.Sprintf("cannot shrink from %d to %d bytes", old, size), http.StatusConflict)
+		return
+	}
+	if err := resizeOverlay(a.cow, a.sectorDir, size); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if size != old {
+		log.Printf("Resized export from %s to %s", formatBytes(old), formatBytes(size))
+	}
+	a.writeStatus(w)
+}
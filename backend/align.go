@@ -0,0 +1,16 @@
+package backend
+
+import "unsafe"
+
+// DirectIOAlignment 是 O_DIRECT 读写时缓冲区地址、偏移和长度需要满足的对齐值
+const DirectIOAlignment = 4096
+
+// AlignedBuffer 分配一个起始地址按 align 对齐的缓冲区，可以直接用于 O_DIRECT 读写
+func AlignedBuffer(size, align int) []byte {
+	buf := make([]byte, size+align)
+	off := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) & uintptr(align-1)); rem != 0 {
+		off = align - rem
+	}
+	return buf[off : off+size : off+size]
+}
@@ -0,0 +1,111 @@
+package backend
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// 扇区文件末尾的校验尾部：4 字节魔数加 4 字节 CRC32C（小端）
+// 没有尾部的旧扇区文件仍然可以读取，只是无法校验
+const (
+	ChecksumTrailerSize = 8
+	checksumMagic       = "SNC1"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	// ErrChecksumMismatch 表示扇区数据与校验尾部记录的 CRC32C 不一致
+	ErrChecksumMismatch = errors.New("sector checksum mismatch")
+	// ErrShortSector 表示扇区文件比扇区小
+	ErrShortSector = errors.New("sector file is truncated")
+)
+
+// VerifyPolicy 决定读取时发现扇区校验失败后的处理方式
+type VerifyPolicy int
+
+const (
+	// VerifyError 让读取返回错误，客户端收到 I/O 错误
+	VerifyError VerifyPolicy = iota
+	// VerifyFallback 记录日志并改为返回基础设备上的数据
+	VerifyFallback
+	// VerifyLog 只记录日志，照常返回扇区文件中的数据
+	VerifyLog
+)
+
+// ParseVerifyPolicy 解析命令行中的校验策略名称
+func ParseVerifyPolicy(name string) (VerifyPolicy, error) {
+	switch name {
+	case "eio", "error":
+		return VerifyError, nil
+	case "fallback":
+		return VerifyFallback, nil
+	case "log":
+		return VerifyLog, nil
+	default:
+		return 0, fmt.Errorf("unknown verify policy %s, use eio, fallback or log", name)
+	}
+}
+
+// AppendChecksum 在扇区数据后追加校验尾部
+func AppendChecksum(data []byte) []byte {
+	out := make([]byte, len(data)+ChecksumTrailerSize)
+	copy(out, data)
+	copy(out[len(data):], checksumMagic)
+	binary.LittleEndian.PutUint32(out[len(data)+4:], crc32.Checksum(data, castagnoli))
+	return out
+}
+
+// VerifySectorData 校验扇区文件的完整内容，返回扇区数据以及文件是否带有校验尾部
+// 文件长度等于扇区大小时视为没有尾部的旧格式，其他长度或校验失败都返回错误
+func VerifySectorData(content []byte, sectorSize int64) ([]byte, bool, error) {
+	switch int64(len(content)) {
+	case sectorSize:
+		return content, false, nil
+	case sectorSize + ChecksumTrailerSize:
+		data := content[:sectorSize]
+		trailer := content[sectorSize:]
+		if string(trailer[:4]) != checksumMagic {
+			return data, false, fmt.Errorf("%w: invalid trailer", ErrChecksumMismatch)
+		}
+		if crc32.Checksum(data, castagnoli) != binary.LittleEndian.Uint32(trailer[4:]) {
+			return data, true, ErrChecksumMismatch
+		}
+		return data, true, nil
+	default:
+		if int64(len(content)) < sectorSize {
+			return content, false, fmt.Errorf("%w: %d of %d bytes", ErrShortSector, len(content), sectorSize)
+		}
+		return content[:sectorSize], false, fmt.Errorf("%w: unexpected file size %d", ErrChecksumMismatch, len(content))
+	}
+}
+
+// readSectorContent 读取扇区文件的内容，最多读取到比带尾部的扇区多一个字节，用于发现过大的文件
+func readSectorContent(path string, sectorSize int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	content := make([]byte, sectorSize+ChecksumTrailerSize+1)
+	n, err := io.ReadFull(f, content)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	return content[:n], nil
+}
+
+// ReadSectorFile 读取并校验一个扇区文件，校验失败时同时返回读到的数据和错误
+func ReadSectorFile(path string, sectorSize int64) ([]byte, error) {
+	content, err := readSectorContent(path, sectorSize)
+	if err != nil {
+		return nil, err
+	}
+	data, _, err := VerifySectorData(content, sectorSize)
+	return data, err
+}
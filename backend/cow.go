@@ -4,20 +4,50 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
 
 	bloom "github.com/bits-and-blooms/bloom/v3"
 	lru "github.com/hashicorp/golang-lru"
 	"github.com/pojntfx/go-nbd/pkg/backend"
 )
 
+// sectorLockStripes is the number of locks sectors are hashed onto
+const sectorLockStripes = 256
+
+// cowFence records why the overlay stopped serving after the base was modified underneath it
+type cowFence struct {
+	err      error
+	readOnly bool
+}
+
+// CowBackend is safe for concurrent use, so one instance can serve several NBD connections
 type CowBackend struct {
 	base       backend.Backend
 	dir        string
 	sectorSize int64
 	filter     *bloom.BloomFilter
-	cache      *lru.Cache // LRU cache
+	filterMu   sync.RWMutex // The bloom filter is not safe for concurrent use
+	cache      *lru.Cache   // LRU cache
+	verify     VerifyPolicy
+	durability DurabilityMode
+	size       atomic.Int64 // Virtual size set by SetSize, 0 to follow the base
+	fence      atomic.Pointer[cowFence]
+
+	// Overlay files and directories written since the last flush, synced by Sync in batched mode.
+	// Each entry holds the sequence number of its latest write, so a sync only clears what it covered.
+	dirtyMu    sync.Mutex
+	dirtySeq   uint64
+	dirtyFiles map[string]uint64
+	dirtyDirs  map[string]uint64
+
+	// Serialize the read-modify-write of a sector against other writers and readers of its file
+	sectorLocks [sectorLockStripes]sync.RWMutex
 }
 
 func NewCowBackend(base backend.Backend, dir string, sectorSize int64, filterSize uint, filterFalsePositiveRate float64, cacheSize int) (*CowBackend, error) {
@@ -42,6 +72,8 @@ func NewCowBackend(base backend.Backend, dir string, sectorSize int64, filterSiz
 		sectorSize: sectorSize,
 		filter:     filter,
 		cache:      cache,
+		dirtyFiles: make(map[string]uint64),
+		dirtyDirs:  make(map[string]uint64),
 	}
 
 	// Scan existing sector files and add them to the bloom filter
@@ -59,6 +91,25 @@ func (b *CowBackend) sectorToBytes(sector int64) []byte {
 	return key
 }
 
+// sectorLock returns the lock guarding the sector file
+func (b *CowBackend) sectorLock(sector int64) *sync.RWMutex {
+	return &b.sectorLocks[uint64(sector)%sectorLockStripes]
+}
+
+// filterTest reports whether the sector may be stored in the overlay
+func (b *CowBackend) filterTest(sector int64) bool {
+	b.filterMu.RLock()
+	defer b.filterMu.RUnlock()
+	return b.filter.Test(b.sectorToBytes(sector))
+}
+
+// filterAdd records the sector in the bloom filter
+func (b *CowBackend) filterAdd(sector int64) {
+	b.filterMu.Lock()
+	defer b.filterMu.Unlock()
+	b.filter.Add(b.sectorToBytes(sector))
+}
+
 // sectorToCacheKey converts a sector number to a cache key
 func (b *CowBackend) sectorToCacheKey(sector int64) uint64 {
 	return uint64(sector)
@@ -143,7 +194,7 @@ func (b *CowBackend) walkAllSectorFiles(dir string, count *int, dirCounts map[st
 			_, err := fmt.Sscanf(filename, "%016x_%08x.sector", &sector, &sectorSize)
 			if err == nil {
 				// Add sector to bloom filter
-				b.filter.Add(b.sectorToBytes(sector))
+				b.filterAdd(sector)
 				*count++
 				// Update directory statistics
 				dirCounts[filepath.Dir(path)]++
@@ -154,72 +205,104 @@ func (b *CowBackend) walkAllSectorFiles(dir string, count *int, dirCounts map[st
 	return nil
 }
 
-func (b *CowBackend) sectorPath(sector int64) string {
+// SectorPath returns the path of a sector file inside dir, using the four-level directory layout
+func SectorPath(dir string, sector int64, sectorSize int64) string {
 	levels := 4
 	dirs := []string{}
 	for i := 0; i < levels; i++ {
 		shift := uint(i * 8)
 		dirs = append(dirs, fmt.Sprintf("%02x", (sector>>shift)&0xff))
 	}
-	filename := fmt.Sprintf("%016x_%08x.sector", sector, b.sectorSize)
-	return filepath.Join(append([]string{b.dir}, append(dirs, filename)...)...)
+	filename := fmt.Sprintf("%016x_%08x.sector", sector, sectorSize)
+	return filepath.Join(append([]string{dir}, append(dirs, filename)...)...)
 }
 
-// readBlackSectorToBuffer reads black sector data directly into the target buffer
-func (b *CowBackend) readBlackSectorToBuffer(sector int64, targetBuf []byte, sectorOffset int64) bool {
-	// Try to get data from cache
+func (b *CowBackend) sectorPath(sector int64) string {
+	return SectorPath(b.dir, sector, b.sectorSize)
+}
+
+// SetVerifyPolicy sets how reads handle sector files that fail checksum verification
+func (b *CowBackend) SetVerifyPolicy(policy VerifyPolicy) {
+	b.verify = policy
+}
+
+// loadSector returns the full data of a black sector from the cache or its sector file.
+// ok is false when the sector has no usable file and the base device data should be used.
+// The returned slice may be shared with the cache and must not be modified.
+// The caller must hold the sector lock.
+func (b *CowBackend) loadSector(sector int64) (data []byte, ok bool, err error) {
 	cacheKey := b.sectorToCacheKey(sector)
 	if cachedData, ok := b.cache.Get(cacheKey); ok {
-		// Copy data from cache directly to target buffer
-		sectorData := cachedData.([]byte)
-		copy(targetBuf, sectorData[sectorOffset:sectorOffset+int64(len(targetBuf))])
-		return true
+		return cachedData.([]byte), true, nil
 	}
 
-	// Cache miss, try to read from file
 	sectorFile := b.sectorPath(sector)
-	f, err := os.OpenFile(sectorFile, os.O_RDONLY, 0666)
-	if err != nil {
-		return false // File open failed
+	data, err = ReadSectorFile(sectorFile, b.sectorSize)
+	if err == nil {
+		b.cache.Add(cacheKey, data)
+		return data, true, nil
 	}
-
-	// Read directly into target buffer
-	_, err = f.ReadAt(targetBuf, sectorOffset)
-	if err != nil && err != io.EOF {
-		f.Close()
-		return false // File read failed
+	if os.IsNotExist(err) {
+		return nil, false, nil // Bloom filter false positive
 	}
 
-	// After successful read, add the entire sector to cache
-	if b.cache != nil {
-		sectorData := make([]byte, b.sectorSize)
-		f.Seek(0, io.SeekStart)
-		_, err = f.ReadAt(sectorData, 0)
-		if err == nil || err == io.EOF {
-			b.cache.Add(cacheKey, sectorData)
-		}
+	// Damaged or unreadable sector file, handle according to the verify policy
+	switch b.verify {
+	case VerifyFallback:
+		log.Printf("Sector %d: %v, falling back to base device data", sector, err)
+		return nil, false, nil
+	case VerifyLog:
+		log.Printf("Sector %d: %v, returning data as stored", sector, err)
+		full := make([]byte, b.sectorSize)
+		copy(full, data)
+		return full, true, nil
+	default:
+		log.Printf("Sector %d: %v", sector, err)
+		return nil, false, fmt.Errorf("sector %d (%s): %w", sector, sectorFile, err)
 	}
+}
 
-	f.Close()
-	return true
+// readBlackSectorToBuffer reads black sector data directly into the target buffer
+func (b *CowBackend) readBlackSectorToBuffer(sector int64, targetBuf []byte, sectorOffset int64) (bool, error) {
+	lock := b.sectorLock(sector)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	sectorData, ok, err := b.loadSector(sector)
+	if !ok {
+		return false, err
+	}
+	copy(targetBuf, sectorData[sectorOffset:sectorOffset+int64(len(targetBuf))])
+	return true, nil
 }
 
+// ReadAt reads the base overlaid with the sectors stored in the overlay. Reads stop at the
+// virtual size: a read crossing the end returns the bytes before it and io.EOF.
 func (b *CowBackend) ReadAt(p []byte, off int64) (n int, err error) {
 	if len(p) == 0 {
 		return 0, nil
 	}
-
-	// 1. First read all requested data from the base device
-	n, err = b.base.ReadAt(p, off)
-	if err != nil && err != io.EOF {
-		return n, err
+	if err := b.fenced(false); err != nil {
+		return 0, err
 	}
 
-	// If the read data length is insufficient, return EOF
-	if int64(n) < int64(len(p)) {
+	// Reads stop at the virtual size
+	size, err := b.Size()
+	if err != nil {
+		return 0, err
+	}
+	if off >= size {
+		return 0, io.EOF
+	}
+	if off+int64(len(p)) > size {
+		p = p[:size-off]
 		err = io.EOF
-	} else {
-		err = nil
+	}
+	n = len(p)
+
+	// 1. First read all requested data from the base device
+	if err := b.readBase(p, off); err != nil {
+		return 0, err
 	}
 
 	// 2. Calculate the sector range to process
@@ -229,7 +312,7 @@ func (b *CowBackend) ReadAt(p []byte, off int64) (n int, err error) {
 	// 3. Check each sector and overlay black sector data
 	for sector := startSector; sector <= endSector; sector++ {
 		// Use bloom filter to quickly check if this sector has been modified
-		if b.filter.Test(b.sectorToBytes(sector)) {
+		if b.filterTest(sector) {
 			// Calculate the start position and length of this sector in the request range
 			sectorStartOffset := sector * b.sectorSize
 			sectorEndOffset := sectorStartOffset + b.sectorSize - 1
@@ -245,7 +328,9 @@ func (b *CowBackend) ReadAt(p []byte, off int64) (n int, err error) {
 				length := readEnd - readStart + 1
 
 				// Read black sector data and overlay to the corresponding position in the buffer
-				b.readBlackSectorToBuffer(sector, p[bufOffset:bufOffset+length], sectorOffset)
+				if _, err := b.readBlackSectorToBuffer(sector, p[bufOffset:bufOffset+length], sectorOffset); err != nil {
+					return int(bufOffset), err
+				}
 			}
 		}
 	}
@@ -253,10 +338,22 @@ func (b *CowBackend) ReadAt(p []byte, off int64) (n int, err error) {
 	return n, err
 }
 
+// WriteAt stores the data in the overlay. Writes past the virtual size are rejected as a whole;
+// the part of the last sector beyond the end of the device is stored as zeros.
 func (b *CowBackend) WriteAt(p []byte, off int64) (n int, err error) {
 	if len(p) == 0 {
 		return 0, nil
 	}
+	if err := b.fenced(true); err != nil {
+		return 0, err
+	}
+	size, err := b.Size()
+	if err != nil {
+		return 0, err
+	}
+	if off < 0 || off+int64(len(p)) > size {
+		return 0, ErrBeyondEnd
+	}
 
 	// Calculate start sector and end sector
 	startSector := off / b.sectorSize
@@ -287,6 +384,10 @@ func (b *CowBackend) WriteAt(p []byte, off int64) (n int, err error) {
 }
 
 func (b *CowBackend) writeSector(p []byte, off int64, sector int64) (n int, err error) {
+	lock := b.sectorLock(sector)
+	lock.Lock()
+	defer lock.Unlock()
+
 	sectorFile := b.sectorPath(sector)
 	cacheKey := b.sectorToCacheKey(sector)
 
@@ -297,45 +398,19 @@ func (b *CowBackend) writeSector(p []byte, off int64, sector int64) (n int, err
 	}
 
 	// Add sector to bloom filter
-	b.filter.Add(b.sectorToBytes(sector))
+	b.filterAdd(sector)
 
-	// Prepare sector data
-	var sectorData []byte
+	// Prepare sector data: existing black sector data, otherwise the base device data
 	inSectorOffset := off % b.sectorSize
-
-	// Check if sector file exists
-	_, err = os.Stat(sectorFile)
+	sectorData := make([]byte, b.sectorSize)
+	existing, ok, err := b.loadSector(sector)
 	if err != nil {
-		if !os.IsNotExist(err) {
-			return 0, err
-		}
-
-		// Sector file does not exist, prepare data in memory
-		sectorData = make([]byte, b.sectorSize)
-
-		// Try to get data from cache
-		if cachedData, ok := b.cache.Get(cacheKey); ok {
-			// Copy data from cache
-			copy(sectorData, cachedData.([]byte))
-		} else {
-			// Read from original file
-			_, err = b.base.ReadAt(sectorData, sector*b.sectorSize)
-			if err != nil && err != io.EOF {
-				return 0, err
-			}
-		}
-	} else {
-		// Sector file exists, read existing data
-		sectorData = make([]byte, b.sectorSize)
-		f, err := os.OpenFile(sectorFile, os.O_RDONLY, 0666)
-		if err != nil {
-			return 0, err
-		}
-		_, err = f.ReadAt(sectorData, 0)
-		f.Close()
-		if err != nil && err != io.EOF {
-			return 0, err
-		}
+		return 0, err
+	}
+	if ok {
+		copy(sectorData, existing)
+	} else if err := b.readBase(sectorData, sector*b.sectorSize); err != nil {
+		return 0, err
 	}
 
 	// Write new data into memory
@@ -344,19 +419,282 @@ func (b *CowBackend) writeSector(p []byte, off int64, sector int64) (n int, err
 	// Update cache
 	b.cache.Add(cacheKey, sectorData)
 
-	// Write once into file
-	err = os.WriteFile(sectorFile, sectorData, 0666)
+	// Write once into file, followed by the checksum trailer
+	err = os.WriteFile(sectorFile, AppendChecksum(sectorData), 0666)
 	if err != nil {
 		return 0, err
 	}
 
+	// A new file also changes the directories leading to it
+	if err := b.persist(sectorFile, !ok); err != nil {
+		return 0, err
+	}
+
 	return len(p), nil
 }
 
+// SetDurability sets when writes to the overlay reach stable storage
+func (b *CowBackend) SetDurability(mode DurabilityMode) {
+	b.durability = mode
+}
+
+// sectorDirs returns the directories from the parent of the sector file up to the sector directory
+func (b *CowBackend) sectorDirs(sectorFile string) []string {
+	var dirs []string
+	root := filepath.Clean(b.dir)
+	for dir := filepath.Dir(sectorFile); ; dir = filepath.Dir(dir) {
+		dirs = append(dirs, dir)
+		if dir == root || dir == filepath.Dir(dir) {
+			return dirs
+		}
+	}
+}
+
+// persist makes a freshly written sector file durable according to the durability mode:
+// synced right away in strict mode, remembered for the next flush in batched mode
+func (b *CowBackend) persist(sectorFile string, created bool) error {
+	switch b.durability {
+	case DurabilityStrict:
+		if err := syncPath(sectorFile); err != nil {
+			return err
+		}
+		if created {
+			for _, dir := range b.sectorDirs(sectorFile) {
+				if err := syncPath(dir); err != nil {
+					return err
+				}
+			}
+		}
+	case DurabilityBatched:
+		b.dirtyMu.Lock()
+		defer b.dirtyMu.Unlock()
+		b.dirtySeq++
+		b.dirtyFiles[sectorFile] = b.dirtySeq
+		if created {
+			for _, dir := range b.sectorDirs(sectorFile) {
+				b.dirtyDirs[dir] = b.dirtySeq
+			}
+		}
+	}
+	return nil
+}
+
+// syncDirty syncs the given dirty paths and forgets them once the sync succeeded. A path stays
+// dirty while it is being synced, so a concurrent flush syncs it again instead of acknowledging
+// early, and a write that lands during the sync keeps it dirty for the next flush.
+// Files are synced before directories, so a directory entry never becomes durable ahead of its file.
+func (b *CowBackend) syncDirty(files, dirs []string) error {
+	syncPaths := func(paths []string, dirty map[string]uint64) error {
+		for _, path := range paths {
+			b.dirtyMu.Lock()
+			seq, ok := dirty[path]
+			b.dirtyMu.Unlock()
+			if !ok {
+				continue
+			}
+			if err := syncPath(path); err != nil {
+				return err
+			}
+			b.dirtyMu.Lock()
+			if dirty[path] == seq {
+				delete(dirty, path)
+			}
+			b.dirtyMu.Unlock()
+		}
+		return nil
+	}
+	if err := syncPaths(files, b.dirtyFiles); err != nil {
+		return err
+	}
+	return syncPaths(dirs, b.dirtyDirs)
+}
+
+// WriteAtFUA writes like WriteAt and returns once the written sectors are on stable storage
+func (b *CowBackend) WriteAtFUA(p []byte, off int64) (int, error) {
+	n, err := b.WriteAt(p, off)
+	if err != nil || b.durability != DurabilityBatched || len(p) == 0 {
+		return n, err
+	}
+
+	var files, dirs []string
+	seen := make(map[string]bool)
+	for sector := off / b.sectorSize; sector <= (off+int64(len(p))-1)/b.sectorSize; sector++ {
+		sectorFile := b.sectorPath(sector)
+		files = append(files, sectorFile)
+		for _, dir := range b.sectorDirs(sectorFile) {
+			if !seen[dir] {
+				seen[dir] = true
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+	return n, b.syncDirty(files, dirs)
+}
+
+// Fence stops using the base after it was modified by someone else: with readOnly the overlay
+// keeps serving reads and rejects writes with EROFS, otherwise reads and writes fail with err
+func (b *CowBackend) Fence(err error, readOnly bool) {
+	b.fence.Store(&cowFence{err: err, readOnly: readOnly})
+}
+
+// fenced returns the error for a read or write rejected by Fence, nil if it may proceed
+func (b *CowBackend) fenced(write bool) error {
+	f := b.fence.Load()
+	switch {
+	case f == nil, f.readOnly && !write:
+		return nil
+	case f.readOnly:
+		return fmt.Errorf("%w: base device changed, export is read-only: %v", syscall.EROFS, f.err)
+	default:
+		return fmt.Errorf("base device changed: %v", f.err)
+	}
+}
+
+// readBase reads from the base, the part beyond the end of the base reads as zeros
+func (b *CowBackend) readBase(p []byte, off int64) error {
+	baseSize, err := b.base.Size()
+	if err != nil {
+		return err
+	}
+	n := 0
+	if off < baseSize {
+		n, err = b.base.ReadAt(p[:min(int64(len(p)), baseSize-off)], off)
+		if err != nil && err != io.EOF {
+			return err
+		}
+	}
+	clear(p[n:])
+	return nil
+}
+
+// Size returns the virtual size, which is never smaller than the base
 func (b *CowBackend) Size() (int64, error) {
-	return b.base.Size()
+	baseSize, err := b.base.Size()
+	if err != nil {
+		return 0, err
+	}
+	return max(baseSize, b.size.Load()), nil
+}
+
+// SetSize grows the virtual size. The area beyond the base reads as zeros and writes to it
+// land in the overlay. Shrinking is not supported.
+func (b *CowBackend) SetSize(size int64) error {
+	for {
+		current, err := b.Size()
+		if err != nil {
+			return err
+		}
+		if size < current {
+			return fmt.Errorf("cannot shrink from %d to %d bytes", current, size)
+		}
+		if old := b.size.Load(); old <= size && b.size.CompareAndSwap(old, size) {
+			return nil
+		}
+	}
 }
 
+// Sync flushes the overlay files and directories written since the last call, then syncs the base
 func (b *CowBackend) Sync() error {
+	b.dirtyMu.Lock()
+	files := make([]string, 0, len(b.dirtyFiles))
+	for path := range b.dirtyFiles {
+		files = append(files, path)
+	}
+	dirs := make([]string, 0, len(b.dirtyDirs))
+	for path := range b.dirtyDirs {
+		dirs = append(dirs, path)
+	}
+	b.dirtyMu.Unlock()
+
+	// Deeper directories first, so each new directory is durable before the entry pointing at it
+	sort.Slice(dirs, func(i, j int) bool { return len(dirs[i]) > len(dirs[j]) })
+	if err := b.syncDirty(files, dirs); err != nil {
+		return err
+	}
 	return b.base.Sync()
 }
+
+// hasSector reports whether the sector is stored in this overlay
+func (b *CowBackend) hasSector(sector int64) bool {
+	if !b.filterTest(sector) {
+		return false
+	}
+	if b.cache.Contains(b.sectorToCacheKey(sector)) {
+		return true
+	}
+	_, err := os.Stat(b.sectorPath(sector))
+	return err == nil
+}
+
+// Extents implements ExtentBackend: sectors stored in the overlay are reported as
+// ExtentOverlay, everything else is delegated to the lower backend
+func (b *CowBackend) Extents(off, length int64) ([]Extent, error) {
+	return b.extents(off, length, b.hasSector, QueryExtents)
+}
+
+// ZeroExtents implements ZeroExtentBackend using only the bloom filter: sectors that may be
+// stored in the overlay have to be read, everything else is delegated to the lower backend
+func (b *CowBackend) ZeroExtents(off, length int64) ([]Extent, error) {
+	return b.extents(off, length, b.filterTest, QueryZeroExtents)
+}
+
+// extents reports sectors for which inOverlay returns true as ExtentOverlay and
+// queries the lower backend with query for the rest
+func (b *CowBackend) extents(off, length int64, inOverlay func(sector int64) bool, query func(backend.Backend, int64, int64) ([]Extent, error)) ([]Extent, error) {
+	if err := b.fenced(false); err != nil {
+		return nil, err
+	}
+	var extents []Extent
+	end := off + length
+	baseStart := off
+
+	for pos := off; pos < end; {
+		sector := pos / b.sectorSize
+		next := min((sector+1)*b.sectorSize, end)
+		if inOverlay(sector) {
+			var err error
+			if extents, err = b.appendBaseExtents(extents, baseStart, pos-baseStart, query); err != nil {
+				return nil, err
+			}
+			extents = AppendExtent(extents, Extent{Offset: pos, Length: next - pos, Source: ExtentOverlay})
+			baseStart = next
+		}
+		pos = next
+	}
+	return b.appendBaseExtents(extents, baseStart, end-baseStart, query)
+}
+
+// appendBaseExtents appends the extents of the lower backend covering [off, off+length),
+// the part beyond the end of the base is reported as zeros
+func (b *CowBackend) appendBaseExtents(extents []Extent, off, length int64, query func(backend.Backend, int64, int64) ([]Extent, error)) ([]Extent, error) {
+	if length <= 0 {
+		return extents, nil
+	}
+	baseSize, err := b.base.Size()
+	if err != nil {
+		return nil, err
+	}
+	if off+length > baseSize {
+		beyond := off + length - max(off, baseSize)
+		extents, err = b.appendBaseExtents(extents, off, length-beyond, query)
+		if err != nil {
+			return nil, err
+		}
+		return AppendExtent(extents, Extent{Offset: off + length - beyond, Length: beyond, Source: ExtentZero}), nil
+	}
+	for length > 0 {
+		lower, err := query(b.base, off, length)
+		if err != nil {
+			return nil, err
+		}
+		if len(lower) == 0 {
+			return nil, fmt.Errorf("no extents returned for offset %d", off)
+		}
+		for _, e := range lower {
+			extents = AppendExtent(extents, e)
+			off += e.Length
+			length -= e.Length
+		}
+	}
+	return extents, nil
+}
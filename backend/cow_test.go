@@ -0,0 +1,105 @@
+package backend
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// newOddCow 在奇数大小的设备上创建 CowBackend，返回它、扇区目录和设备内容
+func newOddCow(t *testing.T) (*CowBackend, string, []byte) {
+	t.Helper()
+	path, data := newOddFile(t, oddSize)
+	dir := t.TempDir()
+	cow, err := NewCowBackend(openDevice(t, path, false), dir, 4096, 1000, 0.01, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cow, dir, data
+}
+
+func TestCowBackendReadAcrossEnd(t *testing.T) {
+	cow, _, data := newOddCow(t)
+	if size, _ := cow.Size(); size != oddSize {
+		t.Fatalf("Size() = %d, want %d", size, oddSize)
+	}
+
+	p := make([]byte, 8192)
+	n, err := cow.ReadAt(p, 4096)
+	if n != 4096+1000 || err != io.EOF {
+		t.Fatalf("ReadAt across the end = %d, %v, want %d, EOF", n, err, 4096+1000)
+	}
+	if !bytes.Equal(p[:n], data[4096:]) {
+		t.Fatal("ReadAt across the end returned wrong data")
+	}
+	if n, err := cow.ReadAt(p, oddSize); n != 0 || err != io.EOF {
+		t.Fatalf("ReadAt at the end = %d, %v, want 0, EOF", n, err)
+	}
+}
+
+func TestCowBackendWriteAcrossEnd(t *testing.T) {
+	cow, _, _ := newOddCow(t)
+	if n, err := cow.WriteAt(make([]byte, 4096), 2*4096); n != 0 || !errors.Is(err, ErrBeyondEnd) {
+		t.Fatalf("WriteAt across the end = %d, %v, want 0, ErrBeyondEnd", n, err)
+	}
+	if cow.hasSector(2) {
+		t.Fatal("rejected write created a sector file")
+	}
+}
+
+func TestCowBackendWriteTail(t *testing.T) {
+	cow, dir, data := newOddCow(t)
+
+	tail := bytes.Repeat([]byte{0xcd}, 1000)
+	if n, err := cow.WriteAt(tail, 2*4096); n != len(tail) || err != nil {
+		t.Fatalf("WriteAt into the tail = %d, %v", n, err)
+	}
+	copy(data[2*4096:], tail)
+
+	p := make([]byte, oddSize)
+	if n, err := cow.ReadAt(p, 0); n != oddSize || err != nil {
+		t.Fatalf("ReadAt = %d, %v", n, err)
+	}
+	if !bytes.Equal(p, data) {
+		t.Fatal("ReadAt after writing the tail returned wrong data")
+	}
+
+	// 扇区文件中超出设备末尾的部分保存为零
+	sector, err := ReadSectorFile(SectorPath(dir, 2, 4096), 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sector[:1000], tail) || !bytes.Equal(sector[1000:], make([]byte, 4096-1000)) {
+		t.Fatal("last sector file does not hold the tail followed by zeros")
+	}
+}
+
+func TestCowBackendZeroExtents(t *testing.T) {
+	cow, err := NewCowBackend(NewZeroBackend(4*4096), t.TempDir(), 4096, 1000, 0.01, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cow.WriteAt(bytes.Repeat([]byte{0xab}, 4096), 4096); err != nil {
+		t.Fatal(err)
+	}
+
+	// 写过的扇区需要读取，其余部分在全零的基础设备中为已知全零
+	extents, err := QueryZeroExtents(cow, 0, 4*4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Extent{
+		{Offset: 0, Length: 4096, Source: ExtentZero},
+		{Offset: 4096, Length: 4096, Source: ExtentOverlay},
+		{Offset: 2 * 4096, Length: 2 * 4096, Source: ExtentZero},
+	}
+	if len(extents) != len(want) {
+		t.Fatalf("ZeroExtents = %+v, want %+v", extents, want)
+	}
+	for i := range want {
+		if extents[i] != want[i] {
+			t.Fatalf("ZeroExtents = %+v, want %+v", extents, want)
+		}
+	}
+}
@@ -1,8 +1,13 @@
 package backend
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"syscall"
 	"unsafe"
 )
@@ -10,37 +15,135 @@ import (
 const (
 	// BLKGETSIZE64 是获取块设备大小的 ioctl 命令
 	BLKGETSIZE64 = 0x80081272
+	// BLKSSZGET 是获取块设备逻辑块大小的 ioctl 命令
+	BLKSSZGET = 0x1268
 )
 
-// DeviceBackend 实现了 backend.Backend 接口，用于处理块设备
+// ErrBeyondEnd 表示写入超出了设备末尾，此时不会写入任何数据
+var ErrBeyondEnd = errors.New("write beyond end of device")
+
+// fileIO 是设备的读写方式，默认直接 pread/pwrite，启用 io_uring 后由 Uring 完成
+type fileIO interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// DeviceBackend 实现了 backend.Backend 接口，用于处理块设备，也可以打开普通文件
+// 以 O_DIRECT 打开时，偏移、长度或缓冲区地址没有对齐的请求经过对齐的中转缓冲区完成
 type DeviceBackend struct {
-	file *os.File
-	size int64
+	file      *os.File
+	io        fileIO
+	ring      *Uring
+	size      int64
+	blockSize int64 // 逻辑块大小，O_DIRECT 读写的偏移和长度按它对齐
+	direct    bool
+
+	// 未对齐的写入需要读改写首尾的块，持有写锁，避免与同一块上的其他写入交错
+	rmw sync.RWMutex
 }
 
-// NewDeviceBackend 创建一个新的块设备后端
-func NewDeviceBackend(device string) (*DeviceBackend, error) {
+// NewDeviceBackend 创建一个新的块设备后端，direct 为 true 时以 O_DIRECT 打开，绕过页缓存
+// exclusive 为 true 时以 O_EXCL 打开块设备：设备已被挂载或被其他程序独占时打开失败，
+// 打开之后也无法再挂载。普通文件不受 exclusive 影响，需要用 LockBase 加锁
+func NewDeviceBackend(device string, direct, exclusive bool) (*DeviceBackend, error) {
 	// 打开设备
-	f, err := os.OpenFile(device, os.O_RDWR|syscall.O_DIRECT, 0666)
+	flags := os.O_RDWR
+	if direct {
+		flags |= syscall.O_DIRECT
+	}
+	if exclusive {
+		if fi, err := os.Stat(device); err == nil && fi.Mode()&os.ModeDevice != 0 {
+			flags |= syscall.O_EXCL
+		}
+	}
+	f, err := os.OpenFile(device, flags, 0666)
 	if err != nil {
+		if flags&syscall.O_EXCL != 0 && errors.Is(err, syscall.EBUSY) {
+			return nil, fmt.Errorf("%s is mounted or opened exclusively by another program: %w", device, err)
+		}
 		return nil, err
 	}
 
-	// 获取设备大小
-	var size int64
-	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), uintptr(BLKGETSIZE64), uintptr(unsafe.Pointer(&size)))
-	if errno != 0 {
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// 获取设备大小和逻辑块大小，普通文件没有逻辑块大小，按 DirectIOAlignment 对齐
+	size := fi.Size()
+	blockSize := int64(DirectIOAlignment)
+	if fi.Mode()&os.ModeDevice != 0 {
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), uintptr(BLKGETSIZE64), uintptr(unsafe.Pointer(&size)))
+		if errno != 0 {
+			f.Close()
+			return nil, errno
+		}
+		var logical int32
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), uintptr(BLKSSZGET), uintptr(unsafe.Pointer(&logical)))
+		if errno != 0 {
+			f.Close()
+			return nil, errno
+		}
+		blockSize = int64(logical)
+	}
+	if blockSize <= 0 || blockSize&(blockSize-1) != 0 {
 		f.Close()
-		return nil, errno
+		return nil, fmt.Errorf("unsupported logical block size %d", blockSize)
+	}
+	if direct && size%blockSize != 0 {
+		f.Close()
+		return nil, fmt.Errorf("size %d is not a multiple of the block size %d, O_DIRECT cannot access the tail", size, blockSize)
 	}
 
 	return &DeviceBackend{
-		file: f,
-		size: size,
+		file:      f,
+		io:        f,
+		size:      size,
+		blockSize: blockSize,
+		direct:    direct,
 	}, nil
 }
 
-// ReadAt 实现 backend.Backend 接口
+// EnableIOUring 改用 entries 个提交槽的 io_uring 读写设备，并发的请求合并成批提交
+// 必须在开始读写之前调用，失败时继续使用 pread/pwrite
+func (b *DeviceBackend) EnableIOUring(entries int) error {
+	ring, err := NewUring(int(b.file.Fd()), entries)
+	if err != nil {
+		return err
+	}
+	b.ring = ring
+	b.io = ring
+	return nil
+}
+
+// IOUring 返回正在使用的 io_uring，没有启用时返回 nil
+func (b *DeviceBackend) IOUring() *Uring {
+	return b.ring
+}
+
+// BlockSize 返回设备的逻辑块大小
+func (b *DeviceBackend) BlockSize() int64 {
+	return b.blockSize
+}
+
+// aligned 判断一次读写能否直接以 O_DIRECT 完成
+func (b *DeviceBackend) aligned(p []byte, off int64) bool {
+	if !b.direct || len(p) == 0 {
+		return true
+	}
+	return off%b.blockSize == 0 && int64(len(p))%b.blockSize == 0 &&
+		uintptr(unsafe.Pointer(&p[0]))%uintptr(b.blockSize) == 0
+}
+
+// bounceRange 返回覆盖 [off, off+length) 的按块对齐的范围
+func (b *DeviceBackend) bounceRange(off, length int64) (start, end int64) {
+	start = off &^ (b.blockSize - 1)
+	end = (off + length + b.blockSize - 1) &^ (b.blockSize - 1)
+	return start, end
+}
+
+// ReadAt 实现 backend.Backend 接口，读取跨过设备末尾时返回末尾之前的数据和 io.EOF
 func (b *DeviceBackend) ReadAt(p []byte, off int64) (n int, err error) {
 	if off < 0 || off >= b.size {
 		return 0, io.EOF
@@ -48,24 +151,69 @@ func (b *DeviceBackend) ReadAt(p []byte, off int64) (n int, err error) {
 
 	// 确保读取不会超出设备大小
 	if off+int64(len(p)) > b.size {
-		p = p[:b.size-off]
+		n, err = b.readAt(p[:b.size-off], off)
+		if err == nil {
+			err = io.EOF
+		}
+		return n, err
+	}
+
+	return b.readAt(p, off)
+}
+
+// readAt 读取设备范围内的数据，未对齐时读入对齐的中转缓冲区再复制
+func (b *DeviceBackend) readAt(p []byte, off int64) (int, error) {
+	if b.aligned(p, off) {
+		return b.io.ReadAt(p, off)
 	}
 
-	return b.file.ReadAt(p, off)
+	start, end := b.bounceRange(off, int64(len(p)))
+	buf := AlignedBuffer(int(end-start), int(b.blockSize))
+	n, err := b.io.ReadAt(buf, start)
+	if n < int(off-start)+len(p) {
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return max(0, n-int(off-start)), err
+	}
+	return copy(p, buf[off-start:]), nil
 }
 
 // WriteAt 实现 backend.Backend 接口
 func (b *DeviceBackend) WriteAt(p []byte, off int64) (n int, err error) {
-	if off < 0 || off >= b.size {
-		return 0, io.EOF
+	// 跨过设备末尾的写入整体拒绝，不做部分写入
+	if off < 0 || off+int64(len(p)) > b.size {
+		return 0, ErrBeyondEnd
 	}
 
-	// 确保写入不会超出设备大小
-	if off+int64(len(p)) > b.size {
-		p = p[:b.size-off]
+	if b.aligned(p, off) {
+		b.rmw.RLock()
+		defer b.rmw.RUnlock()
+		return b.io.WriteAt(p, off)
 	}
 
-	return b.file.WriteAt(p, off)
+	// 先读出首尾不完整的块，合并新数据后整体写回
+	b.rmw.Lock()
+	defer b.rmw.Unlock()
+	start, end := b.bounceRange(off, int64(len(p)))
+	buf := AlignedBuffer(int(end-start), int(b.blockSize))
+	headPartial := off != start
+	tailPartial := (off+int64(len(p)))%b.blockSize != 0
+	if headPartial || tailPartial && end-start == b.blockSize {
+		if _, err := b.io.ReadAt(buf[:b.blockSize], start); err != nil {
+			return 0, err
+		}
+	}
+	if tailPartial && end-start > b.blockSize {
+		if _, err := b.io.ReadAt(buf[end-start-b.blockSize:], end-b.blockSize); err != nil {
+			return 0, err
+		}
+	}
+	copy(buf[off-start:], p)
+	if _, err := b.io.WriteAt(buf, start); err != nil {
+		return 0, err
+	}
+	return len(p), nil
 }
 
 // Size 实现 backend.Backend 接口
@@ -80,5 +228,35 @@ func (b *DeviceBackend) Sync() error {
 
 // Close 关闭设备
 func (b *DeviceBackend) Close() error {
+	if b.ring != nil {
+		b.ring.Close()
+	}
 	return b.file.Close()
 }
+
+// DeviceSerial 从 sysfs 读取块设备的 WWID 或序列号，分区使用所在磁盘的标识
+// 不是块设备或无法获取时返回空字符串
+func DeviceSerial(device string) string {
+	realPath, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return ""
+	}
+	sysDir, err := filepath.EvalSymlinks(filepath.Join("/sys/class/block", filepath.Base(realPath)))
+	if err != nil {
+		return ""
+	}
+	if _, err := os.Stat(filepath.Join(sysDir, "partition")); err == nil {
+		sysDir = filepath.Dir(sysDir)
+	}
+
+	for _, name := range []string{"wwid", "device/wwid", "serial", "device/serial"} {
+		data, err := os.ReadFile(filepath.Join(sysDir, name))
+		if err != nil {
+			continue
+		}
+		if serial := strings.TrimSpace(string(data)); serial != "" {
+			return serial
+		}
+	}
+	return ""
+}
@@ -0,0 +1,199 @@
+package backend
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+// oddSize 是测试用的设备大小，最后一个 4096 字节的块只有 1000 字节
+const oddSize = 2*4096 + 1000
+
+// newOddFile 创建一个 size 字节、内容随机的临时文件，返回路径和内容
+func newOddFile(tb testing.TB, size int64) (string, []byte) {
+	tb.Helper()
+	data := make([]byte, size)
+	rand.New(rand.NewSource(size)).Read(data)
+	path := filepath.Join(tb.TempDir(), "disk.img")
+	if err := os.WriteFile(path, data, 0666); err != nil {
+		tb.Fatal(err)
+	}
+	return path, data
+}
+
+// openDevice 以 NewDeviceBackend 打开 path，测试结束时关闭
+func openDevice(t *testing.T, path string, direct bool) *DeviceBackend {
+	t.Helper()
+	dev, err := NewDeviceBackend(path, direct, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dev.Close() })
+	return dev
+}
+
+// checkFile 核对文件内容
+func checkFile(t *testing.T, path string, want []byte) {
+	t.Helper()
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("file content differs (%d bytes, want %d)", len(got), len(want))
+	}
+}
+
+func TestDeviceBackendOddSize(t *testing.T) {
+	path, _ := newOddFile(t, oddSize)
+	dev := openDevice(t, path, false)
+	if size, _ := dev.Size(); size != oddSize {
+		t.Fatalf("Size() = %d, want %d", size, oddSize)
+	}
+}
+
+func TestDeviceBackendReadAcrossEnd(t *testing.T) {
+	path, data := newOddFile(t, oddSize)
+	dev := openDevice(t, path, false)
+
+	p := make([]byte, 4096)
+	n, err := dev.ReadAt(p, 2*4096)
+	if n != 1000 || err != io.EOF {
+		t.Fatalf("ReadAt across the end = %d, %v, want 1000, EOF", n, err)
+	}
+	if !bytes.Equal(p[:n], data[2*4096:]) {
+		t.Fatal("ReadAt across the end returned wrong data")
+	}
+
+	for _, off := range []int64{oddSize, oddSize + 4096} {
+		if n, err := dev.ReadAt(p, off); n != 0 || err != io.EOF {
+			t.Fatalf("ReadAt at %d = %d, %v, want 0, EOF", off, n, err)
+		}
+	}
+}
+
+func TestDeviceBackendWriteAcrossEnd(t *testing.T) {
+	path, data := newOddFile(t, oddSize)
+	dev := openDevice(t, path, false)
+
+	for _, off := range []int64{2 * 4096, oddSize - 1, oddSize} {
+		if n, err := dev.WriteAt(make([]byte, 4096), off); n != 0 || !errors.Is(err, ErrBeyondEnd) {
+			t.Fatalf("WriteAt at %d = %d, %v, want 0, ErrBeyondEnd", off, n, err)
+		}
+	}
+	// 被拒绝的写入不改变文件，也不扩大文件
+	checkFile(t, path, data)
+}
+
+func TestDeviceBackendWriteTail(t *testing.T) {
+	path, data := newOddFile(t, oddSize)
+	dev := openDevice(t, path, false)
+
+	tail := bytes.Repeat([]byte{0xab}, 1000)
+	if n, err := dev.WriteAt(tail, 2*4096); n != len(tail) || err != nil {
+		t.Fatalf("WriteAt into the tail = %d, %v", n, err)
+	}
+	copy(data[2*4096:], tail)
+	checkFile(t, path, data)
+}
+
+// openDirect 以 O_DIRECT 打开 path，文件系统不支持 O_DIRECT 时跳过测试
+func openDirect(t *testing.T, path string) *DeviceBackend {
+	t.Helper()
+	dev, err := NewDeviceBackend(path, true, false)
+	if errors.Is(err, syscall.EINVAL) {
+		t.Skipf("O_DIRECT is not supported on %s", filepath.Dir(path))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dev.Close() })
+	return dev
+}
+
+func TestDeviceBackendDirectUnaligned(t *testing.T) {
+	path, data := newOddFile(t, 16*4096)
+	dev := openDirect(t, path)
+	// 对齐要求取决于文件系统和设备，只能确定是不小于 512 的 2 的幂
+	if bs := dev.BlockSize(); bs < 512 || bs&(bs-1) != 0 {
+		t.Fatalf("BlockSize() = %d, want a power of two of at least 512", bs)
+	}
+
+	aligned := AlignedBuffer(3*4096+1, DirectIOAlignment)
+	tests := []struct {
+		name string
+		buf  []byte
+		off  int64
+	}{
+		{"aligned", aligned[:2*4096], 4096},
+		{"unaligned offset", aligned[:4096], 4096 + 100},
+		{"unaligned length", aligned[:4096+333], 2 * 4096},
+		{"unaligned buffer", aligned[1 : 1+2*4096], 3 * 4096},
+		{"all unaligned", aligned[1 : 1+3*4096-7], 5*4096 + 4000},
+		{"inside one block", aligned[1:11], 9*4096 + 10},
+		{"last block", aligned[1 : 1+4095], 15*4096 + 1},
+	}
+	rng := rand.New(rand.NewSource(2))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := dev.ReadAt(tt.buf, tt.off)
+			if n != len(tt.buf) || err != nil {
+				t.Fatalf("ReadAt = %d, %v", n, err)
+			}
+			if !bytes.Equal(tt.buf, data[tt.off:tt.off+int64(len(tt.buf))]) {
+				t.Fatal("ReadAt returned wrong data")
+			}
+
+			rng.Read(tt.buf)
+			if n, err := dev.WriteAt(tt.buf, tt.off); n != len(tt.buf) || err != nil {
+				t.Fatalf("WriteAt = %d, %v", n, err)
+			}
+			copy(data[tt.off:], tt.buf)
+			checkFile(t, path, data)
+		})
+	}
+}
+
+func TestDeviceBackendDirectConcurrentRMW(t *testing.T) {
+	const writers, rounds, chunk = 8, 200, 7
+	path, data := newOddFile(t, 4*4096)
+	dev := openDirect(t, path)
+
+	// 每个协程写入互不重叠的小段，但每一段都和其他协程的写入落在同一个块里，
+	// 读改写没有正确加锁时会覆盖其他协程刚写入的数据
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			p := bytes.Repeat([]byte{byte(w + 1)}, chunk)
+			for i := 0; i < rounds; i++ {
+				off := int64(i*writers+w)*chunk + 1
+				if off+chunk > int64(len(data)) {
+					return
+				}
+				if _, err := dev.WriteAt(p, off); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for i := 0; i < rounds; i++ {
+		for w := 0; w < writers; w++ {
+			off := int64(i*writers+w)*chunk + 1
+			if off+chunk <= int64(len(data)) {
+				copy(data[off:off+chunk], bytes.Repeat([]byte{byte(w + 1)}, chunk))
+			}
+		}
+	}
+	checkFile(t, path, data)
+}
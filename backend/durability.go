@@ -0,0 +1,78 @@
+package backend
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pojntfx/go-nbd/pkg/backend"
+)
+
+// DurabilityMode 决定覆盖层的写入何时落盘
+type DurabilityMode int
+
+const (
+	// DurabilityBatched 在客户端 flush 或 FUA 写入时同步此前写入的扇区文件和目录
+	DurabilityBatched DurabilityMode = iota
+	// DurabilityStrict 每次写入都在返回前同步扇区文件和目录，flush 无需再做什么
+	DurabilityStrict
+	// DurabilityUnsafe 从不同步覆盖层，flush 直接返回成功，断电可能丢失已确认的写入
+	DurabilityUnsafe
+)
+
+func (m DurabilityMode) String() string {
+	switch m {
+	case DurabilityBatched:
+		return "batched"
+	case DurabilityStrict:
+		return "strict"
+	case DurabilityUnsafe:
+		return "unsafe"
+	default:
+		return fmt.Sprintf("DurabilityMode(%d)", int(m))
+	}
+}
+
+// ParseDurabilityMode 解析命令行中的持久化模式名称
+func ParseDurabilityMode(name string) (DurabilityMode, error) {
+	switch name {
+	case "batched":
+		return DurabilityBatched, nil
+	case "strict":
+		return DurabilityStrict, nil
+	case "unsafe":
+		return DurabilityUnsafe, nil
+	default:
+		return 0, fmt.Errorf("unknown durability mode %s, use strict, batched or unsafe", name)
+	}
+}
+
+// FUABackend 是支持 FUA（强制落盘）写入的后端，WriteAtFUA 返回时本次写入的数据已经落盘
+// 与 Sync 不同，它只需要同步本次写入涉及的数据
+type FUABackend interface {
+	WriteAtFUA(p []byte, off int64) (int, error)
+}
+
+// WriteAtFUA 以 FUA 方式写入，不支持 FUABackend 的后端写入后整体同步一次
+func WriteAtFUA(b backend.Backend, p []byte, off int64) (int, error) {
+	if fb, ok := b.(FUABackend); ok {
+		return fb.WriteAtFUA(p, off)
+	}
+	n, err := b.WriteAt(p, off)
+	if err != nil {
+		return n, err
+	}
+	return n, b.Sync()
+}
+
+// syncPath 打开文件或目录并调用 fsync
+func syncPath(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync %s: %v", path, err)
+	}
+	return nil
+}
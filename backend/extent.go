@@ -0,0 +1,83 @@
+package backend
+
+import (
+	"fmt"
+
+	"github.com/pojntfx/go-nbd/pkg/backend"
+)
+
+// ExtentSource 表示一段数据来自哪里
+type ExtentSource int
+
+const (
+	// ExtentBase 表示数据来自基础设备
+	ExtentBase ExtentSource = iota
+	// ExtentOverlay 表示数据保存在扇区目录中，与基础设备不同
+	ExtentOverlay
+	// ExtentZero 表示已知全为零，例如稀疏镜像中未分配的区域
+	ExtentZero
+)
+
+func (s ExtentSource) String() string {
+	switch s {
+	case ExtentBase:
+		return "base"
+	case ExtentOverlay:
+		return "overlay"
+	case ExtentZero:
+		return "zero"
+	default:
+		return fmt.Sprintf("ExtentSource(%d)", int(s))
+	}
+}
+
+// Extent 是一段来源相同的连续区域
+type Extent struct {
+	Offset int64
+	Length int64
+	Source ExtentSource
+}
+
+// ExtentBackend 是能够报告数据来源的后端，服务器据此回答 NBD_CMD_BLOCK_STATUS
+// Extents 返回从 off 开始、按顺序首尾相接的区段，可以只覆盖 length 的一部分，但至少要有一个区段
+type ExtentBackend interface {
+	Extents(off, length int64) ([]Extent, error)
+}
+
+// QueryExtents 查询后端的区段，不支持 ExtentBackend 的后端整体视为基础设备的数据
+func QueryExtents(b backend.Backend, off, length int64) ([]Extent, error) {
+	if eb, ok := b.(ExtentBackend); ok {
+		return eb.Extents(off, length)
+	}
+	return []Extent{{Offset: off, Length: length, Source: ExtentBase}}, nil
+}
+
+// ZeroExtentBackend 是不访问磁盘就能找出已知全零区域的后端，服务器据此以空洞块回复读取
+// ZeroExtents 的返回值与 Extents 的格式相同，但只依据内存中的信息（布隆过滤器、已缓存的分配表等）：
+// 来源为 ExtentZero 的区段一定全为零，其他区段需要实际读取
+type ZeroExtentBackend interface {
+	ZeroExtents(off, length int64) ([]Extent, error)
+}
+
+// QueryZeroExtents 查询后端中已知全零的区段，不支持 ZeroExtentBackend 的后端整个范围都需要读取
+func QueryZeroExtents(b backend.Backend, off, length int64) ([]Extent, error) {
+	if zb, ok := b.(ZeroExtentBackend); ok {
+		return zb.ZeroExtents(off, length)
+	}
+	return []Extent{{Offset: off, Length: length, Source: ExtentBase}}, nil
+}
+
+// AppendExtent 在列表末尾追加区段，与最后一个区段相邻且来源相同时合并
+func AppendExtent(extents []Extent, e Extent) []Extent {
+	if e.Length <= 0 {
+		return extents
+	}
+	if n := len(extents); n > 0 {
+		last := &extents[n-1]
+		if last.Source == e.Source && last.Offset+last.Length == e.Offset {
+			last.Length += e.Length
+			return extents
+		}
+	}
+	return append(extents, e)
+}
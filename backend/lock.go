@@ -0,0 +1,73 @@
+package backend
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// LockFile 是扇区目录中用于 flock 的锁文件名
+const LockFile = "snap-nbd.lock"
+
+// DirLock 是扇区目录或基础设备上的 flock 锁
+type DirLock struct {
+	f *os.File
+}
+
+// LockDir 锁定扇区目录，目录不存在时创建
+// 服务器对可写的扇区目录加排他锁，对只读的下层目录加共享锁；merge、fsck -repair 等离线修改目录的命令需要排他锁
+func LockDir(dir string, exclusive bool) (*DirLock, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, LockFile), os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if err := flock(f, exclusive); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("sector directory %s is in use by another process", dir)
+		}
+		return nil, fmt.Errorf("failed to lock %s: %v", dir, err)
+	}
+	return &DirLock{f: f}, nil
+}
+
+// LockBase 锁定基础设备或镜像文件本身
+// 服务器对基础设备加共享锁，多个服务器可以共用同一个基础设备；patch 写入目标前加排他锁，
+// 因此不会写到正被服务器使用的设备上。flock 是建议锁，只对同样加锁的程序有效
+func LockBase(path string, exclusive bool) (*DirLock, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := flock(f, exclusive); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		return nil, fmt.Errorf("failed to lock %s: %v", path, err)
+	}
+	return &DirLock{f: f}, nil
+}
+
+// flock 以非阻塞方式对 f 加共享锁或排他锁
+func flock(f *os.File, exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	return syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+}
+
+// Unlock 释放锁
+func (l *DirLock) Unlock() error {
+	return l.f.Close()
+}
+
+// IsControlFile 判断扇区目录中的相对路径是否是元数据或锁文件
+func IsControlFile(rel string) bool {
+	return rel == MetadataFile || rel == LockFile
+}
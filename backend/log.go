@@ -3,6 +3,7 @@ package backend
 import (
 	"fmt"
 	"io"
+	"sync"
 	"time"
 
 	"github.com/pojntfx/go-nbd/pkg/backend"
@@ -12,6 +13,7 @@ import (
 type LogBackend struct {
 	backend backend.Backend
 	logger  io.Writer
+	mu      sync.Mutex // 多个连接同时记录日志时保证每行完整
 }
 
 // NewLogBackend 创建一个新的日志后端
@@ -27,7 +29,7 @@ func (b *LogBackend) ReadAt(p []byte, off int64) (n int, err error) {
 	start := time.Now()
 	n, err = b.backend.ReadAt(p, off)
 	duration := time.Since(start)
-	fmt.Fprintf(b.logger, "[%s] ReadAt(offset=%d(0x%X), size=%d(0x%X)) = %d, %v (took %v)\n",
+	b.logf("[%s] ReadAt(offset=%d(0x%X), size=%d(0x%X)) = %d, %v (took %v)\n",
 		time.Now().Format("2006-01-02 15:04:05.000"),
 		off, off, len(p), len(p), n, err, duration)
 	return n, err
@@ -38,7 +40,18 @@ func (b *LogBackend) WriteAt(p []byte, off int64) (n int, err error) {
 	start := time.Now()
 	n, err = b.backend.WriteAt(p, off)
 	duration := time.Since(start)
-	fmt.Fprintf(b.logger, "[%s] WriteAt(offset=%d(0x%X), size=%d(0x%X)) = %d, %v (took %v)\n",
+	b.logf("[%s] WriteAt(offset=%d(0x%X), size=%d(0x%X)) = %d, %v (took %v)\n",
+		time.Now().Format("2006-01-02 15:04:05.000"),
+		off, off, len(p), len(p), n, err, duration)
+	return n, err
+}
+
+// WriteAtFUA 实现 FUABackend 接口
+func (b *LogBackend) WriteAtFUA(p []byte, off int64) (n int, err error) {
+	start := time.Now()
+	n, err = WriteAtFUA(b.backend, p, off)
+	duration := time.Since(start)
+	b.logf("[%s] WriteAtFUA(offset=%d(0x%X), size=%d(0x%X)) = %d, %v (took %v)\n",
 		time.Now().Format("2006-01-02 15:04:05.000"),
 		off, off, len(p), len(p), n, err, duration)
 	return n, err
@@ -49,7 +62,7 @@ func (b *LogBackend) Size() (int64, error) {
 	start := time.Now()
 	size, err := b.backend.Size()
 	duration := time.Since(start)
-	fmt.Fprintf(b.logger, "[%s] Size() = %d(0x%X), %v (took %v)\n",
+	b.logf("[%s] Size() = %d(0x%X), %v (took %v)\n",
 		time.Now().Format("2006-01-02 15:04:05.000"),
 		size, size, err, duration)
 	return size, err
@@ -60,8 +73,37 @@ func (b *LogBackend) Sync() error {
 	start := time.Now()
 	err := b.backend.Sync()
 	duration := time.Since(start)
-	fmt.Fprintf(b.logger, "[%s] Sync() = %v (took %v)\n",
+	b.logf("[%s] Sync() = %v (took %v)\n",
 		time.Now().Format("2006-01-02 15:04:05.000"),
 		err, duration)
 	return err
 }
+
+// Extents 实现 ExtentBackend 接口
+func (b *LogBackend) Extents(off, length int64) ([]Extent, error) {
+	start := time.Now()
+	extents, err := QueryExtents(b.backend, off, length)
+	duration := time.Since(start)
+	b.logf("[%s] Extents(offset=%d(0x%X), length=%d(0x%X)) = %d extents, %v (took %v)\n",
+		time.Now().Format("2006-01-02 15:04:05.000"),
+		off, off, length, length, len(extents), err, duration)
+	return extents, err
+}
+
+// ZeroExtents 实现 ZeroExtentBackend 接口，读取中的全零区域不再调用 ReadAt，在这里记录
+func (b *LogBackend) ZeroExtents(off, length int64) ([]Extent, error) {
+	start := time.Now()
+	extents, err := QueryZeroExtents(b.backend, off, length)
+	duration := time.Since(start)
+	b.logf("[%s] ZeroExtents(offset=%d(0x%X), length=%d(0x%X)) = %d extents, %v (took %v)\n",
+		time.Now().Format("2006-01-02 15:04:05.000"),
+		off, off, length, length, len(extents), err, duration)
+	return extents, err
+}
+
+// logf 写入一行日志
+func (b *LogBackend) logf(format string, args ...any) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	fmt.Fprintf(b.logger, format, args...)
+}
@@ -0,0 +1,105 @@
+package backend
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// MetadataFile 是扇区目录中记录元数据的文件名
+	MetadataFile = "snap-nbd.json"
+
+	// FingerprintHeaderSize 是计算基础设备头部哈希时读取的字节数
+	FingerprintHeaderSize = 1 << 20
+)
+
+// Fingerprint 描述创建扇区目录时的基础设备，用于防止把补丁写到错误的设备上
+type Fingerprint struct {
+	Path       string `json:"path"`
+	Size       int64  `json:"size"`
+	HeaderHash string `json:"header_hash,omitempty"` // 前 1MiB 的 SHA-256
+	Serial     string `json:"serial,omitempty"`      // 块设备的 WWID 或序列号
+	Format     string `json:"format,omitempty"`      // 基础镜像格式，空表示 raw
+}
+
+// Metadata 是扇区目录的元数据
+type Metadata struct {
+	SectorSize int64        `json:"sector_size"`
+	Base       *Fingerprint `json:"base,omitempty"`
+	Lower      []string     `json:"lower,omitempty"`        // 只读的下层目录，从下往上排列
+	Size       int64        `json:"virtual_size,omitempty"` // 虚拟磁盘大小，0 表示与基础设备相同，只能扩大
+}
+
+// IsBlank 判断扇区目录是否是没有基础设备的空白磁盘：记录了虚拟大小，但没有基础设备指纹
+// 空白磁盘的数据不能叠加到任何基础设备上
+func (m *Metadata) IsBlank() bool {
+	return m != nil && m.Base == nil && m.Size > 0
+}
+
+// ComputeFingerprint 计算基础设备的指纹，r 为设备内容，size 为设备大小
+func ComputeFingerprint(path string, r io.ReaderAt, size int64) (*Fingerprint, error) {
+	header := make([]byte, min(size, FingerprintHeaderSize))
+	n, err := r.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read device header: %v", err)
+	}
+	sum := sha256.Sum256(header[:n])
+
+	return &Fingerprint{
+		Path:       path,
+		Size:       size,
+		HeaderHash: hex.EncodeToString(sum[:]),
+		Serial:     DeviceSerial(path),
+	}, nil
+}
+
+// Match 检查目标设备是否与记录的指纹一致，HeaderHash 或 Serial 为空时跳过对应检查
+func (f *Fingerprint) Match(target *Fingerprint) error {
+	if f.Size != target.Size {
+		return fmt.Errorf("size mismatch: expected %d bytes, got %d bytes", f.Size, target.Size)
+	}
+	if f.Serial != "" && target.Serial != "" && f.Serial != target.Serial {
+		return fmt.Errorf("device identifier mismatch: expected %s, got %s", f.Serial, target.Serial)
+	}
+	if f.HeaderHash != "" && target.HeaderHash != "" && f.HeaderHash != target.HeaderHash {
+		return fmt.Errorf("header hash mismatch: expected %s, got %s", f.HeaderHash, target.HeaderHash)
+	}
+	return nil
+}
+
+// LoadMetadata 读取扇区目录的元数据，文件不存在时返回 nil
+func LoadMetadata(dir string) (*Metadata, error) {
+	data, err := os.ReadFile(filepath.Join(dir, MetadataFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var meta Metadata
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("invalid metadata file in %s: %v", dir, err)
+	}
+	return &meta, nil
+}
+
+// SaveMetadata 把元数据写入扇区目录，先写临时文件再重命名
+func SaveMetadata(dir string, meta *Metadata) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, MetadataFile)
+	if err := os.WriteFile(path+".tmp", append(data, '\n'), 0666); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
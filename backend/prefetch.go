@@ -7,7 +7,7 @@ import (
 	"github.com/pojntfx/go-nbd/pkg/backend"
 )
 
-// PrefetchBackend 实现预读取缓存策略的Backend
+// PrefetchBackend 实现预读取缓存策略的Backend，可以被多个连接同时使用
 type PrefetchBackend struct {
 	base                backend.Backend
 	sectorSize          int64
@@ -25,6 +25,10 @@ type PrefetchBackend struct {
 	prefetchStartOffset int64  // 预读取缓冲区的起始偏移量
 	prefetchEndOffset   int64  // 预读取缓冲区的结束偏移量
 	prefetchValid       bool   // 预读取缓冲区是否有效
+
+	// 写入开始和完成时都增加代数，预读取据此判断读取期间是否有写入
+	writeGeneration uint64
+	writesInFlight  int
 }
 
 // NewPrefetchBackend 创建一个新的预读取缓存Backend
@@ -76,15 +80,20 @@ func (b *PrefetchBackend) ReadAt(p []byte, off int64) (int, error) {
 	b.lastReadLength = len(p)
 	b.mutex.Unlock()
 
-	// 首先检查是否完全命中缓存
+	// 在同一次加锁中判断是否命中缓存并复制命中的部分，避免复制前缓冲区被写入清除或被重新填充
+	var hitOffset, hitLength int64
+	end := off + int64(len(p))
 	b.mutex.RLock()
-	if b.prefetchValid && off >= b.prefetchStartOffset && off+int64(len(p)) <= b.prefetchEndOffset {
-		// 完全命中缓存，直接从缓存中读取数据
-		bufferOffset := off - b.prefetchStartOffset
-		copy(p, b.prefetchBuffer[bufferOffset:bufferOffset+int64(len(p))])
-		b.mutex.RUnlock()
+	if b.prefetchValid && off < b.prefetchEndOffset && end > b.prefetchStartOffset {
+		hitStart := max(off, b.prefetchStartOffset)
+		hitEnd := min(end, b.prefetchEndOffset)
+		hitOffset, hitLength = hitStart-off, hitEnd-hitStart
+		copy(p[hitOffset:hitOffset+hitLength], b.prefetchBuffer[hitStart-b.prefetchStartOffset:])
+	}
+	b.mutex.RUnlock()
 
-		// 即使命中缓存也更新连击点（仅在连续读取时）
+	if hitLength == int64(len(p)) {
+		// 完全命中缓存，即使命中缓存也更新连击点（仅在连续读取时）
 		if isSequential {
 			b.mutex.Lock()
 			if b.consecutiveReads < b.maxConsecutiveReads {
@@ -95,46 +104,8 @@ func (b *PrefetchBackend) ReadAt(p []byte, off int64) (int, error) {
 		return len(p), nil
 	}
 
-	// 检查是否部分命中缓存
-	partialHit := false
-	var partialStart, partialEnd int64
-
-	if b.prefetchValid {
-		// 检查读取区域是否与缓存有重叠
-		// 情况1: 读取区域的前半部分在缓存中
-		if off >= b.prefetchStartOffset && off < b.prefetchEndOffset &&
-			off+int64(len(p)) > b.prefetchEndOffset {
-			partialHit = true
-			partialStart = off
-			partialEnd = b.prefetchEndOffset
-		}
-		// 情况2: 读取区域的后半部分在缓存中
-		if off < b.prefetchStartOffset &&
-			off+int64(len(p)) > b.prefetchStartOffset &&
-			off+int64(len(p)) <= b.prefetchEndOffset {
-			partialHit = true
-			partialStart = b.prefetchStartOffset
-			partialEnd = off + int64(len(p))
-		}
-	}
-	b.mutex.RUnlock()
-
-	// 处理部分命中
-	if partialHit {
-		// 计算部分命中的长度
-		hitLength := partialEnd - partialStart
-		hitOffset := partialStart - off
-		if hitOffset < 0 {
-			hitOffset = 0
-		}
-
-		// 首先从缓存复制部分命中的数据
-		b.mutex.RLock()
-		bufferOffset := partialStart - b.prefetchStartOffset
-		copy(p[hitOffset:hitOffset+hitLength], b.prefetchBuffer[bufferOffset:bufferOffset+hitLength])
-		b.mutex.RUnlock()
-
-		// 读取未命中部分
+	// 处理部分命中：缓冲区只覆盖读取范围的开头或结尾，读取未命中的部分
+	if hitLength > 0 && (hitOffset == 0 || hitOffset+hitLength == int64(len(p))) {
 		if hitOffset > 0 {
 			// 如果前半部分未命中，读取前半部分
 			_, err := b.base.ReadAt(p[:hitOffset], off)
@@ -154,25 +125,24 @@ func (b *PrefetchBackend) ReadAt(p []byte, off int64) (int, error) {
 		return len(p), nil
 	}
 
-	// 到这里表示完全未命中缓存
-	// 只有当shouldPrefetch为true（连击点达到maxConsecutiveReads）且未命中缓存时，才触发预读取
+	// 到这里表示没有可用的缓存
+	// 只有当shouldPrefetch为true（连击点达到maxConsecutiveReads）时，才触发预读取
 	if shouldPrefetch {
 		// 计算预读取大小
-		prefetchSize := b.sectorSize * int64(b.prefetchMultiplier)
+		prefetchSize := max(b.sectorSize*int64(b.prefetchMultiplier), int64(len(p)))
 
 		// 预读取起始位置就是当前读取的位置
 		readStartOffset := off
 
+		// 记录读取前的写入代数，读取期间有写入开始或完成时，读到的数据可能是旧的，不放入缓冲区
 		b.mutex.Lock()
-		// 分配或重用缓冲区
-		if b.prefetchBuffer == nil || int64(len(b.prefetchBuffer)) < prefetchSize {
-			b.prefetchBuffer = make([]byte, prefetchSize)
-		}
+		generation, writing := b.writeGeneration, b.writesInFlight
+		b.mutex.Unlock()
 
-		// 从底层一次性读取当前需要的数据和预读取数据
-		n, err := b.base.ReadAt(b.prefetchBuffer[:prefetchSize], readStartOffset)
+		// 不持有锁，从底层一次性读取当前需要的数据和预读取数据
+		buf := make([]byte, prefetchSize)
+		n, err := b.base.ReadAt(buf, readStartOffset)
 		if err != nil && err != io.EOF {
-			b.mutex.Unlock()
 			return 0, err
 		}
 
@@ -180,45 +150,66 @@ func (b *PrefetchBackend) ReadAt(p []byte, off int64) (int, error) {
 		validLength := int64(n)
 
 		// 更新缓冲区信息
-		b.prefetchStartOffset = readStartOffset
-		b.prefetchEndOffset = readStartOffset + validLength
-		b.prefetchValid = true
+		b.mutex.Lock()
+		if writing == 0 && generation == b.writeGeneration {
+			b.prefetchBuffer = buf[:validLength]
+			b.prefetchStartOffset = readStartOffset
+			b.prefetchEndOffset = readStartOffset + validLength
+			b.prefetchValid = true
+		}
+		b.mutex.Unlock()
 
 		// 从预读取缓冲区复制出当前需要的数据
 		if int64(len(p)) <= validLength {
-			copy(p, b.prefetchBuffer[:len(p)])
-			b.mutex.Unlock()
+			copy(p, buf[:len(p)])
 			return len(p), nil
-		} else {
-			// 如果实际读取长度小于请求长度，只返回能读到的部分
-			copy(p, b.prefetchBuffer[:validLength])
-			b.mutex.Unlock()
-			return int(validLength), io.EOF
 		}
+		// 如果实际读取长度小于请求长度，只返回能读到的部分
+		copy(p, buf[:validLength])
+		return int(validLength), io.EOF
 	}
 
-	// 常规读取，直接从底层读取（完全未命中缓存且不需要预读取）
+	// 常规读取，直接从底层读取（未命中缓存且不需要预读取）
 	return b.base.ReadAt(p, off)
 }
 
 // WriteAt 将写入操作委托给底层Backend
 func (b *PrefetchBackend) WriteAt(p []byte, off int64) (int, error) {
+	b.beginWrite(p, off)
+	defer b.endWrite()
+	return b.base.WriteAt(p, off)
+}
+
+// WriteAtFUA 实现 FUABackend 接口，以 FUA 方式写入底层Backend
+func (b *PrefetchBackend) WriteAtFUA(p []byte, off int64) (int, error) {
+	b.beginWrite(p, off)
+	defer b.endWrite()
+	return WriteAtFUA(b.base, p, off)
+}
+
+// beginWrite 清除与写入范围重叠的预读取缓冲区，并记录一次进行中的写入
+// 写入本身不持有锁，多个连接的写入和读取可以并发进行
+func (b *PrefetchBackend) beginWrite(p []byte, off int64) {
 	b.mutex.Lock()
+	defer b.mutex.Unlock()
 	// 检查写入是否影响预读取缓冲区，如果是则立即清除缓冲区
-	if b.prefetchValid &&
-		((off >= b.prefetchStartOffset && off < b.prefetchEndOffset) ||
-			(off+int64(len(p)) > b.prefetchStartOffset && off+int64(len(p)) <= b.prefetchEndOffset) ||
-			(off <= b.prefetchStartOffset && off+int64(len(p)) >= b.prefetchEndOffset)) {
-		// 写入命中缓冲区，清除缓冲区
+	if b.prefetchValid && off < b.prefetchEndOffset && off+int64(len(p)) > b.prefetchStartOffset {
 		b.prefetchBuffer = nil
 		b.prefetchValid = false
 	}
 
 	// 写入会打断顺序读取模式
 	b.consecutiveReads = 0
-	b.mutex.Unlock()
+	b.writesInFlight++
+	b.writeGeneration++
+}
 
-	return b.base.WriteAt(p, off)
+// endWrite 记录写入完成，与之并发的预读取不会放入缓冲区
+func (b *PrefetchBackend) endWrite() {
+	b.mutex.Lock()
+	b.writesInFlight--
+	b.writeGeneration++
+	b.mutex.Unlock()
 }
 
 // Size 返回底层设备的大小
@@ -230,3 +221,13 @@ func (b *PrefetchBackend) Size() (int64, error) {
 func (b *PrefetchBackend) Sync() error {
 	return b.base.Sync()
 }
+
+// Extents 实现 ExtentBackend 接口，直接查询底层Backend
+func (b *PrefetchBackend) Extents(off, length int64) ([]Extent, error) {
+	return QueryExtents(b.base, off, length)
+}
+
+// ZeroExtents 实现 ZeroExtentBackend 接口，直接查询底层Backend
+func (b *PrefetchBackend) ZeroExtents(off, length int64) ([]Extent, error) {
+	return QueryZeroExtents(b.base, off, length)
+}
@@ -0,0 +1,99 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"time"
+)
+
+// ScrubResult summarizes one pass of the scrubber
+type ScrubResult struct {
+	Checked   int
+	Unchecked int // Legacy sector files without a checksum trailer
+	Corrupt   []string
+	Duration  time.Duration
+}
+
+// Scrub reads and verifies every sector file in the overlay.
+// rateLimit caps the read rate in bytes per second, 0 means unlimited.
+func (b *CowBackend) Scrub(rateLimit int64) (*ScrubResult, error) {
+	result := &ScrubResult{}
+	start := time.Now()
+	var bytesRead int64
+
+	err := filepath.WalkDir(b.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil // Removed while scrubbing
+			}
+			return err
+		}
+		if d.IsDir() || filepath.Ext(path) != ".sector" {
+			return nil
+		}
+
+		var sector, sectorSize int64
+		if _, err := fmt.Sscanf(d.Name(), "%016x_%08x.sector", &sector, &sectorSize); err != nil || sectorSize != b.sectorSize {
+			return nil
+		}
+
+		lock := b.sectorLock(sector)
+		lock.RLock()
+		content, err := readSectorContent(path, b.sectorSize)
+		lock.RUnlock()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		result.Checked++
+		bytesRead += int64(len(content))
+		if err == nil {
+			var checked bool
+			_, checked, err = VerifySectorData(content, b.sectorSize)
+			if err == nil && !checked {
+				result.Unchecked++
+			}
+		}
+		if err != nil {
+			log.Printf("Scrub: sector %d (%s): %v", sector, path, err)
+			result.Corrupt = append(result.Corrupt, path)
+		}
+
+		// Sleep long enough to keep the average read rate under the limit
+		if rateLimit > 0 {
+			expected := time.Duration(float64(bytesRead) / float64(rateLimit) * float64(time.Second))
+			if elapsed := time.Since(start); elapsed < expected {
+				time.Sleep(expected - elapsed)
+			}
+		}
+		return nil
+	})
+
+	result.Duration = time.Since(start)
+	return result, err
+}
+
+// StartScrubber verifies the whole overlay every interval in the background until stop is closed
+func (b *CowBackend) StartScrubber(interval time.Duration, rateLimit int64, stop <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+
+			result, err := b.Scrub(rateLimit)
+			if err != nil {
+				log.Printf("Scrub failed: %v", err)
+				continue
+			}
+			log.Printf("Scrub completed in %v: %d sector files checked, %d without checksum, %d corrupt",
+				result.Duration.Round(time.Millisecond), result.Checked, result.Unchecked, len(result.Corrupt))
+		}
+	}()
+}
@@ -0,0 +1,344 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// io_uring 系统调用和内核接口常量，参见 include/uapi/linux/io_uring.h
+const (
+	sysIOUringSetup = 425
+	sysIOUringEnter = 426
+
+	ioringOffSQRing = 0
+	ioringOffCQRing = 0x8000000
+	ioringOffSQEs   = 0x10000000
+
+	ioringEnterGetEvents = 1 << 0
+	ioringFeatRWCurPos   = 1 << 3 // 内核支持 IORING_OP_READ/WRITE（5.6 起）
+
+	ioringOpRead  = 22
+	ioringOpWrite = 23
+
+	sqeSize = 64
+	cqeSize = 16
+)
+
+// ErrUringClosed 表示 io_uring 已经关闭
+var ErrUringClosed = errors.New("io_uring is closed")
+
+// uringParams 对应 struct io_uring_params
+type uringParams struct {
+	sqEntries    uint32
+	cqEntries    uint32
+	flags        uint32
+	sqThreadCPU  uint32
+	sqThreadIdle uint32
+	features     uint32
+	wqFD         uint32
+	resv         [3]uint32
+	sqOff        struct {
+		head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+		userAddr                                                        uint64
+	}
+	cqOff struct {
+		head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+		userAddr                                                        uint64
+	}
+}
+
+// uringSQE 对应 struct io_uring_sqe
+type uringSQE struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	rwFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFDIn  int32
+	addr3       uint64
+	pad         uint64
+}
+
+// uringCQE 对应 struct io_uring_cqe
+type uringCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// uringRequest 是一个等待提交或完成的读写请求
+type uringRequest struct {
+	op   uint8
+	buf  []byte
+	off  int64
+	res  int32
+	done chan struct{}
+}
+
+// Uring 用一个 io_uring 实例完成对同一个文件的读写：并发请求由一个协程收集后批量提交，
+// 一次 io_uring_enter 提交多个请求并收取已完成的结果，减少系统调用次数
+type Uring struct {
+	fd      int // 被读写的文件
+	ringFD  int
+	entries int
+
+	sqRing, cqRing, sqeMem []byte
+	sqTail, sqMask         *uint32
+	sqArray                []uint32
+	sqes                   []uringSQE
+	cqHead, cqTail, cqMask *uint32
+	cqes                   []uringCQE
+
+	mu       sync.RWMutex // 保护 closed，关闭时等待正在发送的请求
+	closed   bool
+	requests chan *uringRequest
+	stopped  chan struct{}
+
+	enters    atomic.Int64 // io_uring_enter 调用次数
+	submitted atomic.Int64 // 提交的请求数
+}
+
+// NewUring 为文件描述符 fd 创建一个有 entries 个提交槽的 io_uring
+// 内核不支持或被禁用（例如容器的 seccomp 策略）时返回错误，调用者应改用 pread/pwrite
+func NewUring(fd int, entries int) (*Uring, error) {
+	var params uringParams
+	ringFD, _, errno := syscall.Syscall(sysIOUringSetup, uintptr(entries), uintptr(unsafe.Pointer(&params)), 0)
+	if errno != 0 {
+		return nil, fmt.Errorf("io_uring_setup: %v", errno)
+	}
+	r := &Uring{fd: fd, ringFD: int(ringFD), entries: int(params.sqEntries)}
+	if params.features&ioringFeatRWCurPos == 0 {
+		r.unmap()
+		return nil, fmt.Errorf("kernel io_uring does not support IORING_OP_READ/WRITE")
+	}
+
+	// 映射提交队列、完成队列和 SQE 数组
+	var err error
+	if r.sqRing, err = syscall.Mmap(r.ringFD, ioringOffSQRing, int(params.sqOff.array+params.sqEntries*4),
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE); err != nil {
+		r.unmap()
+		return nil, fmt.Errorf("mmap io_uring submission queue: %v", err)
+	}
+	if r.cqRing, err = syscall.Mmap(r.ringFD, ioringOffCQRing, int(params.cqOff.cqes+params.cqEntries*cqeSize),
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE); err != nil {
+		r.unmap()
+		return nil, fmt.Errorf("mmap io_uring completion queue: %v", err)
+	}
+	if r.sqeMem, err = syscall.Mmap(r.ringFD, ioringOffSQEs, int(params.sqEntries*sqeSize),
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE); err != nil {
+		r.unmap()
+		return nil, fmt.Errorf("mmap io_uring SQEs: %v", err)
+	}
+
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.sqRing[params.sqOff.tail]))
+	r.sqMask = (*uint32)(unsafe.Pointer(&r.sqRing[params.sqOff.ringMask]))
+	r.sqArray = unsafe.Slice((*uint32)(unsafe.Pointer(&r.sqRing[params.sqOff.array])), params.sqEntries)
+	r.sqes = unsafe.Slice((*uringSQE)(unsafe.Pointer(&r.sqeMem[0])), params.sqEntries)
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.cqRing[params.cqOff.head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.cqRing[params.cqOff.tail]))
+	r.cqMask = (*uint32)(unsafe.Pointer(&r.cqRing[params.cqOff.ringMask]))
+	r.cqes = unsafe.Slice((*uringCQE)(unsafe.Pointer(&r.cqRing[params.cqOff.cqes])), params.cqEntries)
+
+	r.requests = make(chan *uringRequest, r.entries)
+	r.stopped = make(chan struct{})
+	go r.loop()
+	return r, nil
+}
+
+// unmap 释放映射的内存并关闭 io_uring
+func (r *Uring) unmap() {
+	for _, mem := range [][]byte{r.sqeMem, r.cqRing, r.sqRing} {
+		if mem != nil {
+			syscall.Munmap(mem)
+		}
+	}
+	syscall.Close(r.ringFD)
+}
+
+// loop 收集请求、批量提交并分发完成结果，直到 Close 后所有请求都已完成
+func (r *Uring) loop() {
+	defer close(r.stopped)
+
+	var pending []*uringRequest
+	slots := make([]*uringRequest, r.entries) // user_data 是槽位下标
+	free := make([]uint64, 0, r.entries)
+	for i := r.entries - 1; i >= 0; i-- {
+		free = append(free, uint64(i))
+	}
+	inflight, unsubmitted := 0, 0
+	closing := false
+
+	for {
+		// 没有进行中的请求时阻塞等待新请求，否则只取走已经到达的请求
+		if inflight == 0 && len(pending) == 0 {
+			if closing {
+				r.unmap()
+				return
+			}
+			req, ok := <-r.requests
+			if !ok {
+				closing = true
+				continue
+			}
+			pending = append(pending, req)
+		}
+	drain:
+		for !closing && len(pending)+inflight < r.entries {
+			select {
+			case req, ok := <-r.requests:
+				if !ok {
+					closing = true
+					break drain
+				}
+				pending = append(pending, req)
+			default:
+				break drain
+			}
+		}
+
+		// 填写 SQE
+		tail := *r.sqTail
+		for len(pending) > 0 && len(free) > 0 {
+			req := pending[0]
+			pending = pending[1:]
+			slot := free[len(free)-1]
+			free = free[:len(free)-1]
+			slots[slot] = req
+
+			idx := tail & *r.sqMask
+			r.sqes[idx] = uringSQE{
+				opcode:   req.op,
+				fd:       int32(r.fd),
+				off:      uint64(req.off),
+				addr:     uint64(uintptr(unsafe.Pointer(&req.buf[0]))),
+				len:      uint32(len(req.buf)),
+				userData: slot,
+			}
+			r.sqArray[idx] = idx
+			tail++
+			inflight++
+			unsubmitted++
+		}
+		atomic.StoreUint32(r.sqTail, tail)
+
+		// 提交并等待至少一个完成
+		n, _, errno := syscall.Syscall6(sysIOUringEnter, uintptr(r.ringFD), uintptr(unsubmitted), 1, ioringEnterGetEvents, 0, 0)
+		r.enters.Add(1)
+		if errno == 0 {
+			r.submitted.Add(int64(n))
+			unsubmitted -= int(n)
+		} else if errno != syscall.EINTR && errno != syscall.EAGAIN && errno != syscall.EBUSY {
+			// io_uring 本身出错，无法继续使用，之后的请求全部失败
+			r.fail(slots, pending, errno)
+			return
+		}
+
+		// 收取完成结果
+		head := *r.cqHead
+		for cqTail := atomic.LoadUint32(r.cqTail); head != cqTail; head++ {
+			cqe := r.cqes[head&*r.cqMask]
+			req := slots[cqe.userData]
+			slots[cqe.userData] = nil
+			free = append(free, cqe.userData)
+			inflight--
+			req.res = cqe.res
+			close(req.done)
+		}
+		atomic.StoreUint32(r.cqHead, head)
+	}
+}
+
+// fail 让进行中和等待中的请求以 errno 失败，之后到达的请求同样失败，直到 Close
+func (r *Uring) fail(slots, pending []*uringRequest, errno syscall.Errno) {
+	for _, req := range append(slots, pending...) {
+		if req != nil {
+			req.res = -int32(errno)
+			close(req.done)
+		}
+	}
+	for req := range r.requests {
+		req.res = -int32(errno)
+		close(req.done)
+	}
+	r.unmap()
+}
+
+// do 提交一个请求并等待完成，返回传输的字节数
+func (r *Uring) do(op uint8, buf []byte, off int64) (int, error) {
+	req := &uringRequest{op: op, buf: buf, off: off, done: make(chan struct{})}
+	r.mu.RLock()
+	if r.closed {
+		r.mu.RUnlock()
+		return 0, ErrUringClosed
+	}
+	r.requests <- req
+	r.mu.RUnlock()
+
+	<-req.done
+	runtime.KeepAlive(buf)
+	if req.res < 0 {
+		return 0, syscall.Errno(-req.res)
+	}
+	return int(req.res), nil
+}
+
+// ReadAt 实现 io.ReaderAt，短读时继续读取剩余部分
+func (r *Uring) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		m, err := r.do(ioringOpRead, p[n:], off+int64(n))
+		if err != nil {
+			return n, err
+		}
+		if m == 0 {
+			return n, io.EOF
+		}
+		n += m
+	}
+	return n, nil
+}
+
+// WriteAt 实现 io.WriterAt，短写时继续写入剩余部分
+func (r *Uring) WriteAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		m, err := r.do(ioringOpWrite, p[n:], off+int64(n))
+		if err != nil {
+			return n, err
+		}
+		if m == 0 {
+			return n, io.ErrShortWrite
+		}
+		n += m
+	}
+	return n, nil
+}
+
+// Stats 返回 io_uring_enter 的调用次数和提交的请求数，两者之比是平均批量大小
+func (r *Uring) Stats() (enters, submitted int64) {
+	return r.enters.Load(), r.submitted.Load()
+}
+
+// Close 等待进行中的请求完成后关闭 io_uring，不关闭被读写的文件
+func (r *Uring) Close() error {
+	r.mu.Lock()
+	if !r.closed {
+		r.closed = true
+		close(r.requests)
+	}
+	r.mu.Unlock()
+	<-r.stopped
+	return nil
+}
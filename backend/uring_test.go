@@ -0,0 +1,191 @@
+package backend
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+)
+
+// newTestUring 为 f 创建 io_uring，内核不支持或被禁用时跳过
+func newTestUring(tb testing.TB, f *os.File, entries int) *Uring {
+	tb.Helper()
+	ring, err := NewUring(int(f.Fd()), entries)
+	if err != nil {
+		tb.Skipf("io_uring unavailable: %v", err)
+	}
+	tb.Cleanup(func() { ring.Close() })
+	return ring
+}
+
+// openTestFile 创建一个 size 字节、内容随机的临时文件并以读写方式打开
+func openTestFile(tb testing.TB, size int64) (*os.File, []byte) {
+	tb.Helper()
+	path, data := newOddFile(tb, size)
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { f.Close() })
+	return f, data
+}
+
+func TestUringReadWrite(t *testing.T) {
+	f, data := openTestFile(t, oddSize)
+	ring := newTestUring(t, f, 8)
+
+	p := make([]byte, 5000)
+	if n, err := ring.ReadAt(p, 100); n != len(p) || err != nil {
+		t.Fatalf("ReadAt = %d, %v", n, err)
+	}
+	if !bytes.Equal(p, data[100:5100]) {
+		t.Fatal("ReadAt returned wrong data")
+	}
+
+	rand.New(rand.NewSource(3)).Read(p)
+	if n, err := ring.WriteAt(p, 3000); n != len(p) || err != nil {
+		t.Fatalf("WriteAt = %d, %v", n, err)
+	}
+	copy(data[3000:], p)
+	got := make([]byte, oddSize)
+	if _, err := f.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("file content differs after WriteAt")
+	}
+
+	if n, err := ring.ReadAt(nil, 0); n != 0 || err != nil {
+		t.Fatalf("empty ReadAt = %d, %v", n, err)
+	}
+}
+
+func TestUringReadAcrossEOF(t *testing.T) {
+	f, data := openTestFile(t, oddSize)
+	ring := newTestUring(t, f, 8)
+
+	// 跨过文件末尾的读取先得到短读，继续读取时读到 0 字节，返回已读的部分和 io.EOF
+	p := make([]byte, 4096)
+	n, err := ring.ReadAt(p, 2*4096)
+	if n != 1000 || err != io.EOF {
+		t.Fatalf("ReadAt across EOF = %d, %v, want 1000, EOF", n, err)
+	}
+	if !bytes.Equal(p[:n], data[2*4096:]) {
+		t.Fatal("ReadAt across EOF returned wrong data")
+	}
+	if n, err := ring.ReadAt(p, oddSize); n != 0 || err != io.EOF {
+		t.Fatalf("ReadAt at EOF = %d, %v, want 0, EOF", n, err)
+	}
+}
+
+func TestUringConcurrent(t *testing.T) {
+	const workers, blocks = 32, 64
+	f, _ := openTestFile(t, blocks*4096)
+	ring := newTestUring(t, f, 8) // 槽位少于并发请求数，请求需要排队等待
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(int64(w)))
+			p := make([]byte, 4096)
+			got := make([]byte, 4096)
+			for i := 0; i < 50; i++ {
+				// 每个协程只使用自己的块，写入后立即读回核对
+				off := int64(rng.Intn(blocks/workers)*workers+w) * 4096
+				rng.Read(p)
+				if _, err := ring.WriteAt(p, off); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := ring.ReadAt(got, off); err != nil {
+					t.Error(err)
+					return
+				}
+				if !bytes.Equal(got, p) {
+					t.Errorf("block at %d differs after write", off)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if enters, submitted := ring.Stats(); submitted != workers*50*2 || enters == 0 {
+		t.Fatalf("Stats() = %d enters, %d submitted, want %d submitted", enters, submitted, workers*50*2)
+	}
+}
+
+func TestUringClosed(t *testing.T) {
+	f, _ := openTestFile(t, 4096)
+	ring := newTestUring(t, f, 4)
+	ring.Close()
+	if _, err := ring.ReadAt(make([]byte, 10), 0); !errors.Is(err, ErrUringClosed) {
+		t.Fatalf("ReadAt after Close = %v, want ErrUringClosed", err)
+	}
+	ring.Close() // 重复关闭不会出错
+}
+
+// benchmarkRandomRead 用 RunParallel 对 16MiB 的文件做 4KiB 随机读
+func benchmarkRandomRead(b *testing.B, engine string) {
+	const size, block = 16 << 20, 4096
+	f, _ := openTestFile(b, size)
+	var r io.ReaderAt = f
+	if engine == "uring" {
+		r = newTestUring(b, f, 128)
+	}
+
+	b.SetBytes(block)
+	b.SetParallelism(4)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		rng := rand.New(rand.NewSource(rand.Int63()))
+		p := make([]byte, block)
+		for pb.Next() {
+			if _, err := r.ReadAt(p, rng.Int63n(size/block)*block); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkRandomReadPread(b *testing.B) { benchmarkRandomRead(b, "pread") }
+func BenchmarkRandomReadUring(b *testing.B) { benchmarkRandomRead(b, "uring") }
+
+// benchmarkDeviceRead 通过 DeviceBackend 以 O_DIRECT 做 4KiB 随机读，比较两种引擎在绕过页缓存时的表现
+func benchmarkDeviceRead(b *testing.B, uring bool) {
+	const size, block = 16 << 20, 4096
+	f, _ := openTestFile(b, size)
+	dev, err := NewDeviceBackend(f.Name(), true, false)
+	if err != nil {
+		b.Skipf("O_DIRECT unavailable: %v", err)
+	}
+	defer dev.Close()
+	if uring {
+		if err := dev.EnableIOUring(128); err != nil {
+			b.Skipf("io_uring unavailable: %v", err)
+		}
+	}
+
+	b.SetBytes(block)
+	b.SetParallelism(4)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		rng := rand.New(rand.NewSource(rand.Int63()))
+		p := AlignedBuffer(block, DirectIOAlignment)
+		for pb.Next() {
+			if _, err := dev.ReadAt(p, rng.Int63n(size/block)*block); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkDirectReadPread(b *testing.B) { benchmarkDeviceRead(b, false) }
+func BenchmarkDirectReadUring(b *testing.B) { benchmarkDeviceRead(b, true) }
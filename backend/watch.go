@@ -0,0 +1,116 @@
+package backend
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// BaseState 是基础设备在某一时刻的状态，服务器运行期间任何一项变化都说明设备被其他程序修改过
+type BaseState struct {
+	Size       int64
+	Generation string // 普通文件为设备号、inode 和修改时间，块设备为 sysfs 中累计写入和丢弃的扇区数
+	HeaderHash [sha256.Size]byte
+}
+
+// ReadBaseState 读取 path 当前的状态，头部哈希按 FingerprintHeaderSize 计算
+func ReadBaseState(path string) (*BaseState, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get size of %s: %v", path, err)
+	}
+	header := make([]byte, min(size, FingerprintHeaderSize))
+	n, err := f.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read header of %s: %v", path, err)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	var generation string
+	if fi.Mode()&os.ModeDevice != 0 {
+		generation = blockWriteCounters(path)
+	} else if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		generation = fmt.Sprintf("%d:%d:%d", st.Dev, st.Ino, fi.ModTime().UnixNano())
+	}
+
+	return &BaseState{Size: size, Generation: generation, HeaderHash: sha256.Sum256(header[:n])}, nil
+}
+
+// blockWriteCounters 从 /sys/class/block/<name>/stat 读取累计写入和丢弃的扇区数，无法获取时返回空字符串
+// 只统计扇区数而不是请求数，不带数据的 flush 请求不会被当成修改
+func blockWriteCounters(path string) string {
+	realPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return ""
+	}
+	data, err := os.ReadFile(filepath.Join("/sys/class/block", filepath.Base(realPath), "stat"))
+	if err != nil {
+		return ""
+	}
+	// 第 7 项是写入的扇区数，第 14 项是丢弃的扇区数（Linux 4.18 起）
+	fields := strings.Fields(string(data))
+	if len(fields) < 7 {
+		return ""
+	}
+	counters := fields[6]
+	if len(fields) >= 14 {
+		counters += ":" + fields[13]
+	}
+	return counters
+}
+
+// Diff 描述 s 与之后读取的状态 now 之间的差异，没有变化时返回 nil
+// 任一方没有 Generation 时跳过这一项
+func (s *BaseState) Diff(now *BaseState) error {
+	if s.Size != now.Size {
+		return fmt.Errorf("size changed from %d to %d bytes", s.Size, now.Size)
+	}
+	if s.Generation != "" && now.Generation != "" && s.Generation != now.Generation {
+		return fmt.Errorf("modified by another program (generation %s, now %s)", s.Generation, now.Generation)
+	}
+	if s.HeaderHash != now.HeaderHash {
+		return fmt.Errorf("header hash changed")
+	}
+	return nil
+}
+
+// WatchBase 每隔 interval 检查一次 path，与 initial 不同时调用一次 onChange 后停止，直到 stop 被关闭
+// 读取状态失败（例如设备被移除）同样视为变化
+func WatchBase(path string, initial *BaseState, interval time.Duration, onChange func(err error), stop <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+
+			now, err := ReadBaseState(path)
+			if err == nil {
+				err = initial.Diff(now)
+			}
+			if err != nil {
+				log.Printf("Base device %s changed: %v", path, err)
+				onChange(err)
+				return
+			}
+		}
+	}()
+}
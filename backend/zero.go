@@ -0,0 +1,58 @@
+package backend
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrZeroBackendWrite 表示全零后端不能写入，写入应该由上层的 CowBackend 保存
+var ErrZeroBackendWrite = errors.New("blank base backend is read-only")
+
+// ZeroBackend 是一个全零的虚拟设备，用作没有基础设备时的基础后端，
+// 扇区目录因此成为一块独立的精简置备磁盘
+type ZeroBackend struct {
+	size int64
+}
+
+// NewZeroBackend 创建一个大小为 size 的全零后端
+func NewZeroBackend(size int64) *ZeroBackend {
+	return &ZeroBackend{size: size}
+}
+
+// ReadAt 实现 backend.Backend 接口，范围内总是读出零
+func (b *ZeroBackend) ReadAt(p []byte, off int64) (int, error) {
+	if off >= b.size {
+		return 0, io.EOF
+	}
+	n := int(min(int64(len(p)), b.size-off))
+	clear(p[:n])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt 实现 backend.Backend 接口，总是返回错误
+func (b *ZeroBackend) WriteAt(p []byte, off int64) (int, error) {
+	return 0, ErrZeroBackendWrite
+}
+
+// Size 实现 backend.Backend 接口
+func (b *ZeroBackend) Size() (int64, error) {
+	return b.size, nil
+}
+
+// Sync 实现 backend.Backend 接口
+func (b *ZeroBackend) Sync() error {
+	return nil
+}
+
+// Extents 实现 ExtentBackend 接口，整个范围都是已知全零
+func (b *ZeroBackend) Extents(off, length int64) ([]Extent, error) {
+	return []Extent{{Offset: off, Length: length, Source: ExtentZero}}, nil
+}
+
+// ZeroExtents 实现 ZeroExtentBackend 接口
+func (b *ZeroBackend) ZeroExtents(off, length int64) ([]Extent, error) {
+	return b.Extents(off, length)
+}
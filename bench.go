@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	nbdbackend "nbd/backend"
+)
+
+// 基础设备的 I/O 引擎
+const (
+	ioEnginePread = "pread"
+	ioEngineUring = "uring"
+
+	// uringEntries 是 io_uring 提交队列的槽数，也是一次 io_uring_enter 最多提交的请求数
+	uringEntries = 128
+)
+
+// checkIOEngine 检查 I/O 引擎名称
+func checkIOEngine(engine string) error {
+	if engine != ioEnginePread && engine != ioEngineUring {
+		return fmt.Errorf("unknown I/O engine %s, use pread or uring", engine)
+	}
+	return nil
+}
+
+// BenchOptions 是 bench 命令的参数
+type BenchOptions struct {
+	Device      string
+	Engines     []string
+	BlockSize   int
+	Concurrency int
+	Duration    time.Duration
+	Direct      bool
+	Write       bool // 读出一块后原样写回，设备内容不变；块设备以 O_EXCL 打开，已挂载时拒绝测试
+}
+
+// benchResult 是一个引擎的测试结果
+type benchResult struct {
+	ops       int64
+	bytes     int64
+	elapsed   time.Duration
+	enters    int64 // io_uring_enter 调用次数，只对 io_uring 有意义
+	submitted int64
+}
+
+// runBench 依次用各个引擎对设备做随机读（或读后写回）测试并打印结果
+func runBench(opts BenchOptions) error {
+	if opts.BlockSize <= 0 || opts.Concurrency <= 0 || opts.Duration <= 0 {
+		return fmt.Errorf("block size, concurrency and duration must be positive")
+	}
+	for _, engine := range opts.Engines {
+		if err := checkIOEngine(engine); err != nil {
+			return err
+		}
+	}
+
+	mode := "random read"
+	if opts.Write {
+		mode = "random read+write-back"
+	}
+	fmt.Printf("Benchmarking %s: %s, block size %d, concurrency %d, %v per engine\n",
+		opts.Device, mode, opts.BlockSize, opts.Concurrency, opts.Duration)
+
+	for _, engine := range opts.Engines {
+		result, err := benchEngine(opts, engine)
+		if err != nil {
+			return fmt.Errorf("%s: %v", engine, err)
+		}
+		seconds := result.elapsed.Seconds()
+		fmt.Printf("  %-6s %10.0f IOPS %10.1f MiB/s", engine,
+			float64(result.ops)/seconds, float64(result.bytes)/seconds/(1<<20))
+		if result.enters > 0 {
+			fmt.Printf("   %.1f requests per io_uring_enter", float64(result.submitted)/float64(result.enters))
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+// benchEngine 用一个引擎运行一轮测试
+func benchEngine(opts BenchOptions, engine string) (*benchResult, error) {
+	dev, err := nbdbackend.NewDeviceBackend(opts.Device, opts.Direct, opts.Write)
+	if err != nil {
+		return nil, err
+	}
+	defer dev.Close()
+	if engine == ioEngineUring {
+		if err := dev.EnableIOUring(uringEntries); err != nil {
+			return nil, err
+		}
+	}
+
+	size, _ := dev.Size()
+	blocks := size / int64(opts.BlockSize)
+	if blocks == 0 {
+		return nil, fmt.Errorf("device is smaller than one block (%d bytes)", opts.BlockSize)
+	}
+
+	var (
+		ops      atomic.Int64
+		firstErr error
+		errOnce  sync.Once
+		wg       sync.WaitGroup
+	)
+	deadline := time.Now().Add(opts.Duration)
+	start := time.Now()
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+			buf := nbdbackend.AlignedBuffer(opts.BlockSize, nbdbackend.DirectIOAlignment)
+			for time.Now().Before(deadline) {
+				off := rng.Int63n(blocks) * int64(opts.BlockSize)
+				_, err := dev.ReadAt(buf, off)
+				if err == nil && opts.Write {
+					_, err = dev.WriteAt(buf, off)
+				}
+				if err != nil {
+					errOnce.Do(func() { firstErr = err })
+					return
+				}
+				ops.Add(1)
+			}
+		}(time.Now().UnixNano() + int64(i))
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	result := &benchResult{ops: ops.Load(), elapsed: time.Since(start)}
+	result.bytes = result.ops * int64(opts.BlockSize)
+	if ring := dev.IOUring(); ring != nil {
+		result.enters, result.submitted = ring.Stats()
+	}
+	return result, nil
+}
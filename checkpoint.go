@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// PatchCheckpoint 记录补丁进度，用于中断后继续
+// 扇区按写入位置排序，Applied 表示排序后已经写入并同步到设备的前缀长度
+type PatchCheckpoint struct {
+	SetHash      string    `json:"set_hash"`
+	Device       string    `json:"device"`
+	DeviceOffset int64     `json:"device_offset"`
+	Total        int       `json:"total"`
+	Applied      int       `json:"applied"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// sortSectors 按写入位置排序，保证每次补丁的写入顺序一致
+func sortSectors(sectors []SectorInfo) {
+	sort.SliceStable(sectors, func(i, j int) bool {
+		oi, oj := sectors[i].Offset*sectors[i].Size, sectors[j].Offset*sectors[j].Size
+		if oi != oj {
+			return oi < oj
+		}
+		return sectors[i].Path < sectors[j].Path
+	})
+}
+
+// sectorSetHash 计算扇区集合的指纹，扇区文件增删或内容变化（大小、修改时间）都会改变指纹
+func sectorSetHash(sectorDir string, sectors []SectorInfo) (string, error) {
+	h := sha256.New()
+	for _, s := range sectors {
+		info, err := os.Stat(s.Path)
+		if err != nil {
+			return "", err
+		}
+		rel, err := filepath.Rel(sectorDir, s.Path)
+		if err != nil {
+			rel = s.Path
+		}
+		fmt.Fprintf(h, "%s %d %d %d %d\n", rel, s.Offset, s.Size, info.Size(), info.ModTime().UnixNano())
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// loadCheckpoint 读取检查点文件，文件不存在时返回 nil
+func loadCheckpoint(path string) (*PatchCheckpoint, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cp PatchCheckpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint file %s: %v", path, err)
+	}
+	return &cp, nil
+}
+
+// saveCheckpoint 原子地写入检查点文件
+func saveCheckpoint(path string, cp *PatchCheckpoint) error {
+	cp.UpdatedAt = time.Now()
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileSync(path, append(data, '\n'))
+}
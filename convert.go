@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	nbdbackend "nbd/backend"
+	"nbd/image"
+
+	"github.com/pojntfx/go-nbd/pkg/backend"
+)
+
+// ConvertOptions 控制 convert 命令的行为
+type ConvertOptions struct {
+	Device       string   // 基础设备或镜像，为空时使用元数据中记录的基础设备
+	DeviceFormat string   // 基础镜像格式，为空时使用元数据中记录的格式，auto 表示自动识别
+	LowerDirs    []string // 下层目录，为空时使用扇区目录元数据中记录的下层目录
+	SectorDir    string   // 扇区目录，为空时只转换基础镜像
+	Output       string
+	Format       string // 输出格式：raw 或 qcow2
+	ClusterSize  int64  // 读取块大小，同时也是 qcow2 的簇大小
+	Compress     bool   // 以压缩簇写入 qcow2
+	ChecksumFile string // 以 sha256sum 格式写入虚拟磁盘内容的校验和
+	Verify       bool   // 写完后重新读取输出镜像并核对校验和
+}
+
+// overlay 是基础镜像加上扇区目录组成的只读视图
+type overlay struct {
+	backend.Backend
+	base image.Image
+}
+
+func (o *overlay) Close() error {
+	return o.base.Close()
+}
+
+// baseImageFormat 返回打开基础设备时使用的格式：优先使用 -device-format，其次是元数据中记录的格式，默认为 raw
+// 不自动识别格式：raw 基础设备的内容由客户机控制，可能带有伪造的镜像头部
+func baseImageFormat(format string, meta *nbdbackend.Metadata) string {
+	switch {
+	case format != "":
+		return format
+	case meta != nil && meta.Base != nil && meta.Base.Format != "":
+		return meta.Base.Format
+	default:
+		return image.FormatRaw
+	}
+}
+
+// openOverlay 打开基础镜像，并在其上依次叠加下层目录和扇区目录中的扇区
+// device 为空时使用扇区目录元数据中记录的基础设备（空白磁盘使用全零镜像），lowerDirs 为空时使用元数据中记录的下层目录，
+// sectorDir 为空时只读取基础镜像
+func openOverlay(device, deviceFormat string, lowerDirs []string, sectorDir string) (*overlay, error) {
+	var meta *nbdbackend.Metadata
+	if sectorDir != "" {
+		var err error
+		if meta, err = nbdbackend.LoadMetadata(sectorDir); err != nil {
+			return nil, err
+		}
+		if len(lowerDirs) == 0 && meta != nil {
+			lowerDirs = meta.Lower
+		}
+	}
+
+	var base image.Image
+	switch {
+	case device != "" && meta.IsBlank():
+		return nil, fmt.Errorf("%s is a blank disk created without a base device, omit -device", sectorDir)
+	case device != "":
+	case meta != nil && meta.Base != nil:
+		device = meta.Base.Path
+	case meta.IsBlank():
+		// 没有基础设备的空白磁盘
+		base = image.NewZero(meta.Size)
+	default:
+		return nil, fmt.Errorf("no base device recorded in %s, use -device", sectorDir)
+	}
+	if base == nil {
+		var err error
+		if base, err = image.Open(device, baseImageFormat(deviceFormat, meta)); err != nil {
+			return nil, fmt.Errorf("failed to open base image: %v", err)
+		}
+	}
+	o := &overlay{Backend: base, base: base}
+	if sectorDir == "" {
+		return o, nil
+	}
+
+	for _, dir := range append(append([]string{}, lowerDirs...), sectorDir) {
+		if err := o.addLayer(device, dir); err != nil {
+			base.Close()
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+// addLayer 在当前视图上叠加一个扇区目录
+func (o *overlay) addLayer(device, dir string) error {
+	sectors, invalid, err := walkSectorFiles(dir)
+	if err != nil {
+		return fmt.Errorf("failed to scan sector files: %v", err)
+	}
+	if len(invalid) > 0 {
+		log.Printf("Warning: ignoring %d invalid sector file names in %s, first: %s", len(invalid), dir, invalid[0])
+	}
+	meta, err := nbdbackend.LoadMetadata(dir)
+	if err != nil {
+		return err
+	}
+
+	sectorSize, err := checkSectorSizes(sectors, meta)
+	if err != nil {
+		return fmt.Errorf("%s: inconsistent sector sizes: %v", dir, err)
+	}
+	if sectorSize == 0 {
+		// 空的扇区目录，不影响读取结果
+		return nil
+	}
+
+	if meta != nil && meta.Base != nil {
+		size, _ := o.base.Size()
+		if fp, err := nbdbackend.ComputeFingerprint(device, o.base, size); err == nil {
+			if err := meta.Base.Match(fp); err != nil {
+				log.Printf("Warning: base device does not match the fingerprint recorded in %s: %v", dir, err)
+			}
+		}
+	}
+
+	// 按实际扇区数量设置布隆过滤器容量，避免误判率过高
+	filterSize := uint(max(len(sectors)*2, 100000))
+	cow, err := nbdbackend.NewCowBackend(o.Backend, dir, sectorSize, filterSize, 0.01, 1024)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", dir, err)
+	}
+	if err := restoreSize(cow, meta); err != nil {
+		return fmt.Errorf("%s: %v", dir, err)
+	}
+	o.Backend = cow
+	return nil
+}
+
+// convertImage 把基础镜像和扇区目录合并为一个独立的 raw 或 qcow2 镜像
+// 全零的块不写入：raw 输出保留为稀疏空洞，qcow2 输出保持未分配
+func convertImage(opts ConvertOptions) error {
+	if opts.Format != "qcow2" && opts.Format != "raw" {
+		return fmt.Errorf("unsupported format %s, use qcow2 or raw", opts.Format)
+	}
+	if opts.Compress && opts.Format != "qcow2" {
+		return fmt.Errorf("-compress requires -format qcow2")
+	}
+	if opts.ClusterSize < 512 || opts.ClusterSize > 2<<20 || opts.ClusterSize&(opts.ClusterSize-1) != 0 {
+		return fmt.Errorf("cluster size must be a power of 2 between 512 and 2MiB")
+	}
+
+	src, err := openOverlay(opts.Device, opts.DeviceFormat, opts.LowerDirs, opts.SectorDir)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	size, err := src.Size()
+	if err != nil {
+		return fmt.Errorf("failed to get virtual size: %v", err)
+	}
+
+	out, err := os.OpenFile(opts.Output, os.O_CREATE|os.O_RDWR|os.O_EXCL, 0666)
+	if err != nil {
+		return fmt.Errorf("failed to create output: %v", err)
+	}
+	defer out.Close()
+
+	var qw *image.Qcow2Writer
+	if opts.Format == "qcow2" {
+		if qw, err = image.NewQcow2Writer(out, size, opts.ClusterSize, "", ""); err != nil {
+			return err
+		}
+	} else if err := out.Truncate(size); err != nil {
+		return fmt.Errorf("failed to set output size: %v", err)
+	}
+	fmt.Printf("Converting %s (%d bytes) to %s %s\n", src.base.Format(), size, opts.Format, opts.Output)
+
+	sum := sha256.New()
+	buf := make([]byte, opts.ClusterSize)
+	zero := make([]byte, opts.ClusterSize)
+	var written int64
+	start := time.Now()
+	lastReport := start
+
+	for off := int64(0); off < size; off += opts.ClusterSize {
+		n := min(opts.ClusterSize, size-off)
+		data := buf[:n]
+		if _, err := src.ReadAt(data, off); err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read at offset %d: %v", off, err)
+		}
+		sum.Write(data)
+
+		if !bytes.Equal(data, zero[:n]) {
+			if qw != nil {
+				// 末尾不足一个簇的部分补零
+				clear(buf[n:])
+				index := off / opts.ClusterSize
+				if opts.Compress {
+					err = qw.WriteCompressedCluster(index, buf)
+				} else {
+					err = qw.WriteCluster(index, buf)
+				}
+			} else {
+				_, err = out.WriteAt(data, off)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to write at offset %d: %v", off, err)
+			}
+			written += n
+		}
+
+		if now := time.Now(); now.Sub(lastReport) >= 2*time.Second {
+			lastReport = now
+			done := off + n
+			fmt.Printf("Progress: %.1f%% (%d/%d bytes, %.1f MiB/s)\n",
+				float64(done)*100/float64(size), done, size, float64(done)/(1<<20)/now.Sub(start).Seconds())
+		}
+	}
+
+	if qw != nil {
+		if err := qw.Close(); err != nil {
+			return fmt.Errorf("failed to finish qcow2 image: %v", err)
+		}
+	} else if err := out.Sync(); err != nil {
+		return err
+	}
+
+	checksum := hex.EncodeToString(sum.Sum(nil))
+	fmt.Printf("Converted %d bytes (%d bytes of data, %d bytes skipped as zero) in %v\n",
+		size, written, size-written, time.Since(start).Round(time.Millisecond))
+	fmt.Printf("SHA256 of virtual disk: %s\n", checksum)
+
+	if opts.ChecksumFile != "" {
+		line := fmt.Sprintf("%s  %s\n", checksum, opts.Output)
+		if err := os.WriteFile(opts.ChecksumFile, []byte(line), 0666); err != nil {
+			return fmt.Errorf("failed to write checksum file: %v", err)
+		}
+	}
+
+	if opts.Verify {
+		fmt.Println("Verifying output image...")
+		verify, err := image.Open(opts.Output, opts.Format)
+		if err != nil {
+			return fmt.Errorf("failed to open output for verification: %v", err)
+		}
+		defer verify.Close()
+		got, err := imageChecksum(verify, sha256.New(), opts.ClusterSize)
+		if err != nil {
+			return fmt.Errorf("failed to verify output: %v", err)
+		}
+		if got != checksum {
+			return fmt.Errorf("verification failed: output checksum %s does not match %s", got, checksum)
+		}
+		fmt.Println("Verification passed")
+	}
+	return nil
+}
+
+// imageChecksum 计算镜像虚拟内容的哈希
+func imageChecksum(img backend.Backend, h hash.Hash, chunk int64) (string, error) {
+	size, err := img.Size()
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, chunk)
+	for off := int64(0); off < size; off += chunk {
+		data := buf[:min(chunk, size-off)]
+		if _, err := img.ReadAt(data, off); err != nil && err != io.EOF {
+			return "", err
+		}
+		h.Write(data)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
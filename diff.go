@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	nbdbackend "nbd/backend"
+	"nbd/image"
+)
+
+// diff 中一个扇区的变化类型
+const (
+	diffAdded    = "added"    // 只在新快照中修改过
+	diffModified = "modified" // 两边都修改过且内容不同
+	diffReverted = "reverted" // 只在旧快照中修改过，新快照中恢复为基础设备的数据
+)
+
+// DiffOptions 控制 diff 命令的行为
+type DiffOptions struct {
+	Old, New     string // 旧的和新的扇区目录，各自的下层目录从元数据中读取
+	Device       string // 基础设备，用于比较只有一边修改过的扇区，以及生成恢复为基础数据的扇区
+	DeviceFormat string
+	OutputDir    string // 不为空时把差异写成一个新的覆盖层
+	JSON         bool
+}
+
+// diffSector 是一个发生变化的扇区，Path 为新快照中的扇区文件，为空表示新快照中是基础设备的数据
+type diffSector struct {
+	Sector int64
+	Kind   string
+	Path   string
+}
+
+// DiffResult 是 diff 的统计结果
+type DiffResult struct {
+	Old          string       `json:"old"`
+	New          string       `json:"new"`
+	SectorSize   int64        `json:"sector_size"`
+	Added        int          `json:"added"`
+	Modified     int          `json:"modified"`
+	Reverted     int          `json:"reverted"`
+	ChangedBytes int64        `json:"changed_bytes"`
+	Extents      []InfoExtent `json:"extents"`
+
+	sectors []diffSector
+	base    image.Image
+	meta    *nbdbackend.Metadata // 新快照的元数据
+}
+
+// snapshotView 是一个扇区目录连同其下层目录组成的快照，记录每个扇区最上层的扇区文件
+type snapshotView struct {
+	sectorSize int64
+	files      map[int64]string
+	meta       *nbdbackend.Metadata
+}
+
+// loadSnapshotView 读取扇区目录及其元数据中记录的下层目录
+func loadSnapshotView(dir string) (*snapshotView, error) {
+	meta, err := nbdbackend.LoadMetadata(dir)
+	if err != nil {
+		return nil, err
+	}
+	view := &snapshotView{files: make(map[int64]string), meta: meta}
+	layers := []string{dir}
+	if meta != nil {
+		layers = append(append([]string{}, meta.Lower...), dir)
+	}
+
+	for _, layer := range layers {
+		sectors, invalid, err := walkSectorFiles(layer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan %s: %v", layer, err)
+		}
+		if len(invalid) > 0 {
+			return nil, fmt.Errorf("found %d invalid sector file names in %s, run fsck first", len(invalid), layer)
+		}
+		layerMeta, err := nbdbackend.LoadMetadata(layer)
+		if err != nil {
+			return nil, err
+		}
+		size, err := checkSectorSizes(sectors, layerMeta)
+		if err != nil {
+			return nil, fmt.Errorf("%s: inconsistent sector sizes: %v", layer, err)
+		}
+		if view.sectorSize == 0 {
+			view.sectorSize = size
+		} else if size != 0 && size != view.sectorSize {
+			return nil, fmt.Errorf("%s uses sector size %d, expected %d", layer, size, view.sectorSize)
+		}
+		// 上层覆盖下层
+		for _, s := range sectors {
+			view.files[s.Offset] = s.Path
+		}
+	}
+	return view, nil
+}
+
+// readDiffSector 读取一个扇区在快照中的数据，path 为空时读取基础设备
+func readDiffSector(path string, base image.Image, sector, sectorSize int64) ([]byte, error) {
+	if path != "" {
+		return nbdbackend.ReadSectorFile(path, sectorSize)
+	}
+	if base == nil {
+		return nil, fmt.Errorf("sector %d is not stored in the overlay, base device required (-device)", sector)
+	}
+	data := make([]byte, sectorSize)
+	if _, err := base.ReadAt(data, sector*sectorSize); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return data, nil
+}
+
+// computeDiff 比较两个快照，找出内容不同的扇区
+func computeDiff(opts DiffOptions) (*DiffResult, error) {
+	oldView, err := loadSnapshotView(opts.Old)
+	if err != nil {
+		return nil, err
+	}
+	newView, err := loadSnapshotView(opts.New)
+	if err != nil {
+		return nil, err
+	}
+	sectorSize := max(oldView.sectorSize, newView.sectorSize)
+	if oldView.sectorSize != 0 && newView.sectorSize != 0 && oldView.sectorSize != newView.sectorSize {
+		return nil, fmt.Errorf("sector sizes differ: %d and %d", oldView.sectorSize, newView.sectorSize)
+	}
+
+	result := &DiffResult{Old: opts.Old, New: opts.New, SectorSize: sectorSize, Extents: []InfoExtent{}, meta: newView.meta}
+	if result.meta == nil {
+		result.meta = oldView.meta
+	}
+
+	// 基础设备默认使用元数据中记录的设备，找不到时只在需要时报错
+	device := opts.Device
+	if device != "" && result.meta.IsBlank() {
+		return nil, fmt.Errorf("%s is a blank disk created without a base device, omit -device", opts.New)
+	}
+	if device == "" && result.meta != nil && result.meta.Base != nil {
+		if _, err := os.Stat(result.meta.Base.Path); err == nil {
+			device = result.meta.Base.Path
+		}
+	}
+	if device != "" {
+		if result.base, err = image.Open(device, baseImageFormat(opts.DeviceFormat, result.meta)); err != nil {
+			return nil, fmt.Errorf("failed to open base device: %v", err)
+		}
+	} else if result.meta.IsBlank() {
+		// 没有基础设备的空白磁盘
+		result.base = image.NewZero(result.meta.Size)
+	}
+
+	candidates := make([]int64, 0, len(oldView.files)+len(newView.files))
+	for sector := range newView.files {
+		candidates = append(candidates, sector)
+	}
+	for sector := range oldView.files {
+		if _, ok := newView.files[sector]; !ok {
+			candidates = append(candidates, sector)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i] < candidates[j] })
+
+	for _, sector := range candidates {
+		oldPath, newPath := oldView.files[sector], newView.files[sector]
+		if oldPath == newPath {
+			continue // 共享的下层目录
+		}
+
+		kind := diffModified
+		switch {
+		case oldPath == "":
+			kind = diffAdded
+		case newPath == "":
+			kind = diffReverted
+		}
+
+		// 只有一边存储了扇区且没有基础设备时无法比较内容，按已变化处理
+		if kind == diffModified || result.base != nil {
+			oldData, err := readDiffSector(oldPath, result.base, sector, sectorSize)
+			if err != nil {
+				result.Close()
+				return nil, err
+			}
+			newData, err := readDiffSector(newPath, result.base, sector, sectorSize)
+			if err != nil {
+				result.Close()
+				return nil, err
+			}
+			if bytes.Equal(oldData, newData) {
+				continue
+			}
+		}
+
+		result.sectors = append(result.sectors, diffSector{Sector: sector, Kind: kind, Path: newPath})
+		switch kind {
+		case diffAdded:
+			result.Added++
+		case diffModified:
+			result.Modified++
+		case diffReverted:
+			result.Reverted++
+		}
+		result.ChangedBytes += sectorSize
+
+		offset := sector * sectorSize
+		if n := len(result.Extents); n > 0 && result.Extents[n-1].Offset+result.Extents[n-1].Length == offset {
+			result.Extents[n-1].Length += sectorSize
+			result.Extents[n-1].Sectors++
+		} else {
+			result.Extents = append(result.Extents, InfoExtent{Offset: offset, Length: sectorSize, Sectors: 1})
+		}
+	}
+	return result, nil
+}
+
+// Close 关闭比较时打开的基础设备
+func (r *DiffResult) Close() error {
+	if r.base != nil {
+		return r.base.Close()
+	}
+	return nil
+}
+
+// writeDiffOverlay 把差异写成一个新的覆盖层，可以用 patch 应用到保存着旧快照内容的设备上
+func writeDiffOverlay(result *DiffResult, dir string) error {
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+		return fmt.Errorf("output directory %s is not empty", dir)
+	}
+	for _, s := range result.sectors {
+		data, err := readDiffSector(s.Path, result.base, s.Sector, result.SectorSize)
+		if err != nil {
+			return err
+		}
+		if err := writeSectorFile(nbdbackend.SectorPath(dir, s.Sector, result.SectorSize), data); err != nil {
+			return err
+		}
+	}
+
+	// 差异要应用到保存着旧快照内容的设备上，它的头部通常已经不同于基础设备，不记录头部哈希
+	meta := &nbdbackend.Metadata{SectorSize: result.SectorSize}
+	if result.meta != nil {
+		if result.meta.Base != nil {
+			base := *result.meta.Base
+			base.HeaderHash = ""
+			meta.Base = &base
+		}
+		meta.Size = result.meta.Size
+	}
+	return nbdbackend.SaveMetadata(dir, meta)
+}
+
+// runDiff 实现 diff 命令
+func runDiff(opts DiffOptions) error {
+	result, err := computeDiff(opts)
+	if err != nil {
+		return err
+	}
+	defer result.Close()
+
+	if opts.OutputDir != "" {
+		if err := writeDiffOverlay(result, opts.OutputDir); err != nil {
+			return fmt.Errorf("failed to write delta overlay: %v", err)
+		}
+	}
+
+	if opts.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(result)
+	}
+
+	fmt.Printf("%s -> %s (sector size %d)\n", opts.Old, opts.New, result.SectorSize)
+	fmt.Printf("Changed sectors: %d (%d added, %d modified, %d reverted), %s\n",
+		len(result.sectors), result.Added, result.Modified, result.Reverted, formatBytes(result.ChangedBytes))
+	for _, e := range result.Extents {
+		fmt.Printf("  0x%012x - 0x%012x  %10s  %d sectors\n", e.Offset, e.Offset+e.Length, formatBytes(e.Length), e.Sectors)
+	}
+	if opts.OutputDir != "" {
+		fmt.Printf("Delta overlay written to %s\n", opts.OutputDir)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	nbdbackend "nbd/backend"
+)
+
+const testSectors = 8
+
+// newRandomFile 在 dir 中创建名为 name、size 字节、内容随机的文件，返回路径和内容
+func newRandomFile(t *testing.T, dir, name string, size int64) (string, []byte) {
+	t.Helper()
+	data := make([]byte, size)
+	rand.New(rand.NewSource(size)).Read(data)
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	return path, data
+}
+
+// newBaseDevice 创建一个 testSectors 个扇区、内容随机的基础设备文件
+func newBaseDevice(t *testing.T, dir string) (string, []byte) {
+	t.Helper()
+	return newRandomFile(t, dir, "base.img", testSectors*4096)
+}
+
+// newSnapshot 在基础设备 base 上创建扇区目录，changes 中的每个扇区填充对应的字节，返回目录路径
+func newSnapshot(t *testing.T, dir, name, base string, lower []string, changes map[int64]byte) string {
+	t.Helper()
+	f, err := os.Open(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fp, err := nbdbackend.ComputeFingerprint(base, f, testSectors*4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, name)
+	if err := nbdbackend.SaveMetadata(path, &nbdbackend.Metadata{SectorSize: 4096, Base: fp, Lower: lower}); err != nil {
+		t.Fatal(err)
+	}
+	for sector, fill := range changes {
+		if err := writeSectorFile(nbdbackend.SectorPath(path, sector, 4096), bytes.Repeat([]byte{fill}, 4096)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+// applyChanges 返回在 data 上应用 changes 之后的设备内容
+func applyChanges(data []byte, changes map[int64]byte) []byte {
+	result := append([]byte{}, data...)
+	for sector, fill := range changes {
+		copy(result[sector*4096:(sector+1)*4096], bytes.Repeat([]byte{fill}, 4096))
+	}
+	return result
+}
+
+// patchTarget 不经交互把扇区目录 dir 写入目标文件 target
+func patchTarget(t *testing.T, dir, target string) {
+	t.Helper()
+	opts := PatchOptions{SectorDir: dir, Device: target, Workers: 2, MaxWrite: 1 << 20, Yes: true, ConfirmDev: target}
+	if err := patchSectors(opts); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiffPatchRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	base, data := newBaseDevice(t, dir)
+
+	// day1 修改了包括第 0 个扇区在内的头部，day2 是一个独立的快照：再次修改第 0 个扇区、新增第 5 个扇区，
+	// 第 2 个扇区只在 day1 中存在，在 day2 中恢复为基础设备的数据
+	day1Changes := map[int64]byte{0: 0x11, 2: 0x22}
+	day2Changes := map[int64]byte{0: 0x33, 5: 0x55}
+	day1 := newSnapshot(t, dir, "day1", base, nil, day1Changes)
+	day2 := newSnapshot(t, dir, "day2", base, nil, day2Changes)
+
+	target := filepath.Join(dir, "target.img")
+	if err := os.WriteFile(target, applyChanges(data, day1Changes), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	delta := filepath.Join(dir, "delta")
+	if err := runDiff(DiffOptions{Old: day1, New: day2, OutputDir: delta}); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := nbdbackend.LoadMetadata(delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Base == nil || meta.Base.HeaderHash != "" {
+		t.Fatalf("delta base fingerprint = %+v, want one without a header hash", meta.Base)
+	}
+
+	// 不需要 -force 就能把差异应用到保存着 day1 内容的目标上
+	patchTarget(t, delta, target)
+	got, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, applyChanges(data, day2Changes)) {
+		t.Fatal("target does not hold the contents of day2 after applying the delta")
+	}
+}
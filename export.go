@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	nbdbackend "nbd/backend"
+	"nbd/image"
+)
+
+// backingInfo 返回后备文件的格式和虚拟大小，对块设备同样有效
+// format 为空时识别格式：这里只读取虚拟大小，导出的镜像由用户自己决定以什么后备文件打开
+func backingInfo(path, format string) (string, int64, error) {
+	if format == "" {
+		var err error
+		if format, err = image.Detect(path); err != nil {
+			return "", 0, err
+		}
+	}
+	img, err := image.Open(path, format)
+	if err != nil {
+		return "", 0, err
+	}
+	defer img.Close()
+	size, err := img.Size()
+	return img.Format(), size, err
+}
+
+// exportOverlay 把扇区目录转换为 qcow2 覆盖层（以基础设备为后备文件）或稀疏 raw 文件
+// qcow2 的簇大小与扇区大小相同，每个扇区正好对应一个簇，不需要读取基础设备
+func exportOverlay(sectorDir, output, format, backing string, size int64) error {
+	if format != "qcow2" && format != "raw" {
+		return fmt.Errorf("unsupported format %s, use qcow2 or raw", format)
+	}
+
+	fmt.Println("Scanning sector files...")
+	sectors, invalid, err := walkSectorFiles(sectorDir)
+	if err != nil {
+		return fmt.Errorf("failed to scan sector files: %v", err)
+	}
+	if len(invalid) > 0 {
+		return fmt.Errorf("found %d invalid sector file names, first: %s", len(invalid), invalid[0])
+	}
+	sortSectors(sectors)
+
+	meta, err := nbdbackend.LoadMetadata(sectorDir)
+	if err != nil {
+		return err
+	}
+	sectorSize, err := checkSectorSizes(sectors, meta)
+	if err != nil {
+		return fmt.Errorf("inconsistent sector sizes: %v", err)
+	}
+	if sectorSize == 0 {
+		return fmt.Errorf("cannot determine sector size: no sector files and no metadata in %s", sectorDir)
+	}
+
+	// 后备文件默认使用元数据中记录的基础设备及其格式
+	var backingFormat string
+	if backing == "" && meta != nil && meta.Base != nil {
+		backing, backingFormat = meta.Base.Path, baseImageFormat("", meta)
+	}
+	if backing != "" {
+		var backingSize int64
+		if backingFormat, backingSize, err = backingInfo(backing, backingFormat); err != nil {
+			return fmt.Errorf("failed to open backing file: %v", err)
+		}
+		if size == 0 {
+			size = backingSize
+		}
+	}
+	if size == 0 {
+		switch {
+		case meta != nil && meta.Base != nil:
+			size = meta.Base.Size
+		default:
+			return fmt.Errorf("cannot determine virtual size, use -backing or -size")
+		}
+	}
+	if format == "qcow2" && backing == "" {
+		return fmt.Errorf("qcow2 export requires a backing file, use -backing")
+	}
+
+	out, err := os.OpenFile(output, os.O_CREATE|os.O_RDWR|os.O_EXCL, 0666)
+	if err != nil {
+		return fmt.Errorf("failed to create output: %v", err)
+	}
+	defer out.Close()
+
+	var qw *image.Qcow2Writer
+	if format == "qcow2" {
+		// qemu 相对于镜像所在目录解析后备文件路径，这里统一写入绝对路径
+		absBacking, err := filepath.Abs(backing)
+		if err != nil {
+			return err
+		}
+		qw, err = image.NewQcow2Writer(out, size, sectorSize, absBacking, backingFormat)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Exporting %d sectors to qcow2 %s (backing: %s, format: %s, virtual size: %d)\n", len(sectors), output, absBacking, backingFormat, size)
+	} else {
+		if err := out.Truncate(size); err != nil {
+			return fmt.Errorf("failed to set output size: %v", err)
+		}
+		fmt.Printf("Exporting %d sectors to sparse raw file %s (size: %d)\n", len(sectors), output, size)
+	}
+
+	data := make([]byte, sectorSize)
+	zero := make([]byte, sectorSize)
+	exported := 0
+	for _, s := range sectors {
+		offset := s.Offset * s.Size
+		if offset >= size {
+			log.Printf("Skipping sector %s beyond the virtual size", s.Path)
+			continue
+		}
+		if err := readSectorInto(s, data); err != nil {
+			return fmt.Errorf("%s: %v", s.Path, err)
+		}
+
+		if qw != nil {
+			if bytes.Equal(data, zero) {
+				err = qw.WriteZeroCluster(s.Offset)
+			} else {
+				err = qw.WriteCluster(s.Offset, data)
+			}
+		} else {
+			_, err = out.WriteAt(data[:min(sectorSize, size-offset)], offset)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write sector %s: %v", s.Path, err)
+		}
+		exported++
+	}
+
+	if qw != nil {
+		if err := qw.Close(); err != nil {
+			return fmt.Errorf("failed to finish qcow2 image: %v", err)
+		}
+	} else if err := out.Sync(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Exported %d sectors to %s\n", exported, output)
+	return nil
+}
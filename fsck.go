@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	nbdbackend "nbd/backend"
+)
+
+// fsck 发现的问题类型
+const (
+	fsckInvalidName  = "invalid_name"     // 无法解析的扇区文件名
+	fsckSizeMismatch = "size_mismatch"    // 文件名中的扇区大小与扇区目录不一致
+	fsckBeyondDevice = "beyond_device"    // 扇区超出基础设备大小
+	fsckTruncated    = "truncated"        // 文件比扇区小，缺失的数据无法恢复
+	fsckOversized    = "oversized"        // 文件比带校验尾部的扇区大，或尾部无法识别
+	fsckCorrupt      = "corrupt"          // 扇区数据与校验尾部不一致
+	fsckMisplaced    = "misplaced"        // 不在四级目录中应在的位置，服务器读取时不会使用
+	fsckDuplicate    = "duplicate"        // 同一个扇区存在多个文件
+	fsckStaleTemp    = "stale_temp"       // 中断写入遗留的临时文件
+	fsckUnknownFile  = "unknown_file"     // 其他无关文件
+	fsckMissingMeta  = "missing_metadata" // 有扇区文件但没有元数据
+)
+
+// FsckIssue 是 fsck 发现的一个问题以及修复时采取的动作
+type FsckIssue struct {
+	Kind   string `json:"kind"`
+	Path   string `json:"path"`
+	Detail string `json:"detail,omitempty"`
+	Action string `json:"action,omitempty"` // 修复模式下采取的动作，未修复时为空
+	Error  string `json:"error,omitempty"`  // 修复失败的原因
+}
+
+// FsckReport 是 fsck 的结果
+type FsckReport struct {
+	SectorDir     string      `json:"sector_dir"`
+	SectorSize    int64       `json:"sector_size"`
+	Checked       int         `json:"checked"`
+	Repair        bool        `json:"repair"`
+	QuarantineDir string      `json:"quarantine_dir,omitempty"`
+	Issues        []FsckIssue `json:"issues"`
+}
+
+// fsckEntry 是一个文件名合法的扇区文件
+type fsckEntry struct {
+	SectorInfo
+	rel   string
+	size  int64 // 文件的实际大小
+	mtime int64
+}
+
+type fsckChecker struct {
+	dir        string
+	repair     bool
+	quarantine string
+	report     *FsckReport
+}
+
+// quarantineFile 把文件移动到隔离目录，保留相对路径，同名文件已存在时追加序号
+func (c *fsckChecker) quarantineFile(rel string) error {
+	target := filepath.Join(c.quarantine, rel)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(target); os.IsNotExist(err) {
+			break
+		}
+		target = fmt.Sprintf("%s.%d", filepath.Join(c.quarantine, rel), i)
+	}
+	return os.Rename(filepath.Join(c.dir, rel), target)
+}
+
+// issue 记录一个问题，修复模式下执行 fix 并记录动作
+func (c *fsckChecker) issue(kind, rel, detail, action string, fix func() error) {
+	is := FsckIssue{Kind: kind, Path: rel, Detail: detail}
+	if c.repair && fix != nil {
+		if err := fix(); err != nil {
+			is.Error = err.Error()
+		} else {
+			is.Action = action
+		}
+	}
+	c.report.Issues = append(c.report.Issues, is)
+}
+
+// quarantineIssue 记录一个修复动作为隔离文件的问题
+func (c *fsckChecker) quarantineIssue(kind, rel, detail string) {
+	c.issue(kind, rel, detail, "quarantined", func() error { return c.quarantineFile(rel) })
+}
+
+// checkContent 读取扇区文件并校验，返回 false 表示文件已被判定为不可用
+// 过大的文件保留前一个扇区的数据并重写校验尾部，校验失败的文件隔离
+func (c *fsckChecker) checkContent(e *fsckEntry) bool {
+	content, err := os.ReadFile(e.Path)
+	if err != nil {
+		c.issue(fsckCorrupt, e.rel, err.Error(), "", nil)
+		return false
+	}
+	_, _, err = nbdbackend.VerifySectorData(content, e.Size)
+	switch {
+	case err == nil:
+		return true
+	case e.size != e.Size+nbdbackend.ChecksumTrailerSize:
+		c.issue(fsckOversized, e.rel, fmt.Sprintf("%d bytes, expected %d", e.size, e.Size), "truncated", func() error {
+			return writeFileSync(e.Path, nbdbackend.AppendChecksum(content[:e.Size]))
+		})
+		return true
+	default:
+		c.quarantineIssue(fsckCorrupt, e.rel, err.Error())
+		return false
+	}
+}
+
+// checkOverlay 检查扇区目录，repair 为 true 时把无法修复的文件移入隔离目录，能修复的就地修复
+func checkOverlay(sectorDir string, repair bool, quarantineDir string) (*FsckReport, error) {
+	if _, err := os.Stat(sectorDir); err != nil {
+		return nil, fmt.Errorf("sector directory: %v", err)
+	}
+	if repair {
+		lock, err := nbdbackend.LockDir(sectorDir, true)
+		if err != nil {
+			return nil, fmt.Errorf("%v, stop the server before repairing", err)
+		}
+		defer lock.Unlock()
+	}
+	meta, err := nbdbackend.LoadMetadata(sectorDir)
+	if err != nil {
+		return nil, err
+	}
+	if quarantineDir == "" {
+		quarantineDir = filepath.Clean(sectorDir) + ".quarantine"
+	}
+	c := &fsckChecker{
+		dir:        sectorDir,
+		repair:     repair,
+		quarantine: quarantineDir,
+		report:     &FsckReport{SectorDir: sectorDir, Repair: repair, Issues: []FsckIssue{}},
+	}
+	if repair {
+		c.report.QuarantineDir = quarantineDir
+	}
+
+	// 第一遍只收集文件，修复动作在遍历结束后执行，避免在遍历过程中移动文件
+	var entries []*fsckEntry
+	var others []string
+	var invalid []string
+	err = filepath.Walk(sectorDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		rel, _ := filepath.Rel(sectorDir, path)
+		if filepath.Ext(path) != ".sector" {
+			if !nbdbackend.IsControlFile(rel) {
+				others = append(others, rel)
+			}
+			return nil
+		}
+		sector, size, err := parseSectorName(filepath.Base(path))
+		if err != nil {
+			invalid = append(invalid, rel)
+			return nil
+		}
+		entries = append(entries, &fsckEntry{
+			SectorInfo: SectorInfo{Path: path, Offset: sector, Size: size},
+			rel:        rel,
+			size:       fi.Size(),
+			mtime:      fi.ModTime().UnixNano(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan sector files: %v", err)
+	}
+	c.report.Checked = len(entries) + len(invalid) + len(others)
+
+	for _, rel := range others {
+		if strings.HasSuffix(rel, ".tmp") {
+			c.quarantineIssue(fsckStaleTemp, rel, "left behind by an interrupted write")
+		} else {
+			c.issue(fsckUnknownFile, rel, "not a sector file", "", nil)
+		}
+	}
+	for _, rel := range invalid {
+		c.quarantineIssue(fsckInvalidName, rel, "cannot parse sector number and size")
+	}
+
+	// 扇区大小以元数据为准，没有元数据时取出现次数最多的大小
+	sectorSize := int64(0)
+	if meta != nil {
+		sectorSize = meta.SectorSize
+	}
+	if sectorSize == 0 {
+		counts := make(map[int64]int)
+		for _, e := range entries {
+			counts[e.Size]++
+			if counts[e.Size] > counts[sectorSize] {
+				sectorSize = e.Size
+			}
+		}
+	}
+	c.report.SectorSize = sectorSize
+	if meta == nil && len(entries) > 0 {
+		c.issue(fsckMissingMeta, nbdbackend.MetadataFile, fmt.Sprintf("recreate with sector size %d (base fingerprint unknown)", sectorSize), "created", func() error {
+			return nbdbackend.SaveMetadata(sectorDir, &nbdbackend.Metadata{SectorSize: sectorSize})
+		})
+	}
+
+	// 虚拟大小可以超过基础设备（在线扩容或空白磁盘），以两者中较大的一个为界
+	var deviceSize int64
+	if meta != nil {
+		deviceSize = meta.Size
+		if meta.Base != nil {
+			deviceSize = max(meta.Base.Size, meta.Size)
+		}
+	}
+
+	// 逐个检查文件本身，不合格的直接隔离
+	bySector := make(map[int64][]*fsckEntry)
+	for _, e := range entries {
+		switch {
+		case e.Size != sectorSize:
+			c.quarantineIssue(fsckSizeMismatch, e.rel, fmt.Sprintf("sector size %d, expected %d", e.Size, sectorSize))
+		case deviceSize > 0 && e.Offset*e.Size >= deviceSize:
+			c.quarantineIssue(fsckBeyondDevice, e.rel, fmt.Sprintf("offset %d beyond device size %d", e.Offset*e.Size, deviceSize))
+		case e.size < e.Size:
+			c.quarantineIssue(fsckTruncated, e.rel, fmt.Sprintf("%d of %d bytes", e.size, e.Size))
+		default:
+			if !c.checkContent(e) {
+				continue
+			}
+			bySector[e.Offset] = append(bySector[e.Offset], e)
+		}
+	}
+
+	// 同一扇区的多个文件：保留规范位置上的文件，没有时保留最新的一个并移动到规范位置
+	sectors := make([]int64, 0, len(bySector))
+	for sector := range bySector {
+		sectors = append(sectors, sector)
+	}
+	sort.Slice(sectors, func(i, j int) bool { return sectors[i] < sectors[j] })
+	for _, sector := range sectors {
+		group := bySector[sector]
+		canonical := nbdbackend.SectorPath(sectorDir, sector, sectorSize)
+		sort.Slice(group, func(i, j int) bool {
+			ci, cj := group[i].Path == canonical, group[j].Path == canonical
+			if ci != cj {
+				return ci
+			}
+			return group[i].mtime > group[j].mtime
+		})
+
+		keep := group[0]
+		for _, dup := range group[1:] {
+			c.quarantineIssue(fsckDuplicate, dup.rel, fmt.Sprintf("sector %d also stored in %s", sector, keep.rel))
+		}
+		if keep.Path != canonical {
+			rel, _ := filepath.Rel(sectorDir, canonical)
+			c.issue(fsckMisplaced, keep.rel, "expected at "+rel, "moved", func() error {
+				if err := os.MkdirAll(filepath.Dir(canonical), 0755); err != nil {
+					return err
+				}
+				return os.Rename(keep.Path, canonical)
+			})
+		}
+	}
+	return c.report, nil
+}
+
+// runFsck 实现 fsck 命令，发现未修复的问题时返回错误
+func runFsck(sectorDir string, repair bool, quarantineDir string, jsonOutput bool) error {
+	report, err := checkOverlay(sectorDir, repair, quarantineDir)
+	if err != nil {
+		return err
+	}
+
+	unresolved := 0
+	for _, is := range report.Issues {
+		if is.Action == "" && is.Kind != fsckUnknownFile {
+			unresolved++
+		}
+	}
+
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("Checked %d files in %s (sector size %d)\n", report.Checked, sectorDir, report.SectorSize)
+		for _, is := range report.Issues {
+			line := fmt.Sprintf("  %-16s %s", is.Kind, is.Path)
+			if is.Detail != "" {
+				line += ": " + is.Detail
+			}
+			switch {
+			case is.Error != "":
+				line += fmt.Sprintf(" [repair failed: %s]", is.Error)
+			case is.Action != "":
+				line += fmt.Sprintf(" [%s]", is.Action)
+			}
+			fmt.Println(line)
+		}
+		if len(report.Issues) == 0 {
+			fmt.Println("No problems found")
+		} else if repair {
+			fmt.Printf("Found %d problems, quarantined files are in %s\n", len(report.Issues), report.QuarantineDir)
+		} else {
+			fmt.Printf("Found %d problems, run with -repair to fix them (stop the server first)\n", len(report.Issues))
+		}
+	}
+
+	if unresolved > 0 {
+		return fmt.Errorf("%d problems not repaired", unresolved)
+	}
+	return nil
+}
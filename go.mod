@@ -4,9 +4,9 @@ go 1.21
 
 require github.com/pojntfx/go-nbd v0.1.0
 
-require github.com/bits-and-blooms/bloom/v3 v3.7.0
-
 require (
-	github.com/bits-and-blooms/bitset v1.10.0 // indirect
-	github.com/hashicorp/golang-lru v1.0.2 // indirect
+	github.com/bits-and-blooms/bloom/v3 v3.7.0
+	github.com/hashicorp/golang-lru v1.0.2
 )
+
+require github.com/bits-and-blooms/bitset v1.10.0 // indirect
@@ -0,0 +1,295 @@
+package image
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	nbdbackend "nbd/backend"
+
+	"github.com/pojntfx/go-nbd/pkg/backend"
+)
+
+// 支持的镜像格式
+const (
+	FormatRaw   = "raw"
+	FormatQcow2 = "qcow2"
+	FormatVHD   = "vhd"
+	FormatVHDX  = "vhdx"
+	FormatVMDK  = "vmdk"
+)
+
+// ErrReadOnly 表示镜像后端只能读取，写入由上层的 CowBackend 负责
+var ErrReadOnly = errors.New("image is opened read-only")
+
+// Image 是以只读方式打开的磁盘镜像，读取虚拟磁盘的内容
+// 读取超出虚拟大小时返回 io.EOF，未分配的区域读出全零（或后备镜像的内容）
+type Image interface {
+	backend.Backend
+
+	// Format 返回镜像格式名称
+	Format() string
+	// Close 关闭镜像及其后备镜像
+	Close() error
+}
+
+// Detect 根据文件内容识别镜像格式，无法识别时视为 raw
+func Detect(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, err := f.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	head = head[:n]
+
+	switch {
+	case bytes.HasPrefix(head, []byte("QFI\xfb")):
+		return FormatQcow2, nil
+	case bytes.HasPrefix(head, []byte("vhdxfile")):
+		return FormatVHDX, nil
+	case bytes.HasPrefix(head, []byte("KDMV")), bytes.HasPrefix(head, []byte("# Disk DescriptorFile")):
+		return FormatVMDK, nil
+	case bytes.HasPrefix(head, []byte(vhdCookie)):
+		// 动态 VHD 在文件开头保存了一份页脚副本
+		return FormatVHD, nil
+	}
+
+	// 固定大小的 VHD 只有文件末尾的页脚
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", err
+	}
+	if size >= vhdFooterSize {
+		footer := make([]byte, len(vhdCookie))
+		if _, err := f.ReadAt(footer, size-vhdFooterSize); err == nil && string(footer) == vhdCookie {
+			return FormatVHD, nil
+		}
+	}
+	return FormatRaw, nil
+}
+
+// maxChainDepth 是后备镜像链（包括最上层镜像）允许的最大层数
+const maxChainDepth = 64
+
+// Open 以只读方式打开镜像，format 为空或 auto 时自动识别格式
+// 自动识别格式的镜像不会打开其中记录的后备镜像、父镜像或区段文件：
+// raw 磁盘的内容由客户机控制，客户机可以写入伪造的镜像头部，让下次打开时读取宿主机上的任意文件
+func Open(path, format string) (Image, error) {
+	return openImage(path, format, imageChain{})
+}
+
+func openImage(path, format string, chain imageChain) (Image, error) {
+	probed := false
+	if format == "" || format == "auto" {
+		detected, err := Detect(path)
+		if err != nil {
+			return nil, err
+		}
+		format, probed = detected, true
+	}
+
+	switch format {
+	case FormatRaw:
+		return OpenRaw(path)
+	case FormatQcow2:
+		return openQcow2File(path, chain, probed)
+	case FormatVHD:
+		return openVHDFile(path, chain, probed)
+	case FormatVHDX:
+		return OpenVHDX(path)
+	case FormatVMDK:
+		return openVMDKFile(path, chain, probed)
+	default:
+		return nil, fmt.Errorf("unsupported image format %s", format)
+	}
+}
+
+// chainError 表示后备镜像链存在循环或层数过多，逐层返回时不再附加每一层的路径
+type chainError struct {
+	msg string
+}
+
+func (e *chainError) Error() string {
+	return e.msg
+}
+
+// imageError 在错误信息前附加镜像路径，后备镜像链的错误原样返回
+func imageError(path string, err error) error {
+	var ce *chainError
+	if errors.As(err, &ce) {
+		return err
+	}
+	return fmt.Errorf("%s: %v", path, err)
+}
+
+// imageChain 记录从最上层镜像到当前镜像已经打开的文件，用于检测循环引用和限制链的层数
+type imageChain struct {
+	files  []os.FileInfo
+	probed bool // 当前镜像的格式是自动识别的，不能打开其中引用的其他文件
+}
+
+// enter 把刚打开的镜像文件 f 加入链中，f 已经在链上或链的层数超过上限时返回错误
+func (c imageChain) enter(f *os.File, probed bool) (imageChain, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return c, err
+	}
+	for _, prev := range c.files {
+		if os.SameFile(prev, fi) {
+			return c, &chainError{fmt.Sprintf("backing chain loop: %s refers back to itself", f.Name())}
+		}
+	}
+	if len(c.files) >= maxChainDepth {
+		return c, &chainError{fmt.Sprintf("backing chain too deep: more than %d images below %s", maxChainDepth, f.Name())}
+	}
+	files := append(c.files[:len(c.files):len(c.files)], fi)
+	return imageChain{files: files, probed: probed}, nil
+}
+
+// checkReference 检查当前镜像能否引用另一个文件 path，kind 描述被引用文件的用途
+func (c imageChain) checkReference(kind, path string) error {
+	if c.probed {
+		return fmt.Errorf("refusing to open %s %s of an image whose format was detected automatically, specify the format explicitly", kind, path)
+	}
+	return nil
+}
+
+// openBacking 打开当前镜像引用的后备镜像或父镜像，format 为空时自动识别
+func (c imageChain) openBacking(kind, path, format string) (Image, error) {
+	if err := c.checkReference(kind, path); err != nil {
+		return nil, err
+	}
+	img, err := openImage(path, format, c)
+	if err != nil {
+		var ce *chainError
+		if errors.As(err, &ce) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to open %s: %v", kind, err)
+	}
+	return img, nil
+}
+
+// readTable 读取位于 off、长度为 size 的元数据表
+// 表的大小来自文件头，必须完全位于文件之内，防止构造的头部导致巨大的内存分配
+func readTable(f *os.File, off, size int64) ([]byte, error) {
+	fileSize, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if off < 0 || size < 0 || off > fileSize || size > fileSize-off {
+		return nil, fmt.Errorf("%d bytes at 0x%x lie beyond the end of the file", size, off)
+	}
+	buf := make([]byte, size)
+	if _, err := f.ReadAt(buf, off); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// readBacking 从后备镜像读取数据，没有后备镜像或超出其大小的部分填充为零
+func readBacking(backing Image, p []byte, off int64) error {
+	n := 0
+	if backing != nil {
+		var err error
+		n, err = backing.ReadAt(p, off)
+		if err != nil && err != io.EOF {
+			return err
+		}
+	}
+	clear(p[n:])
+	return nil
+}
+
+// backingExtents 追加后备镜像在 [off, off+length) 内的区段，没有后备镜像或超出其大小的部分为已知零
+func backingExtents(extents []nbdbackend.Extent, backing Image, off, length int64) ([]nbdbackend.Extent, error) {
+	if backing != nil {
+		size, err := backing.Size()
+		if err != nil {
+			return nil, err
+		}
+		for inside := min(length, size-off); inside > 0; {
+			lower, err := nbdbackend.QueryExtents(backing, off, inside)
+			if err != nil {
+				return nil, err
+			}
+			if len(lower) == 0 {
+				return nil, fmt.Errorf("no extents returned for offset %d", off)
+			}
+			for _, e := range lower {
+				extents = nbdbackend.AppendExtent(extents, e)
+				off += e.Length
+				length -= e.Length
+				inside -= e.Length
+			}
+		}
+	}
+	return nbdbackend.AppendExtent(extents, nbdbackend.Extent{Offset: off, Length: length, Source: nbdbackend.ExtentZero}), nil
+}
+
+// readImage 按 chunk 大小把一次读取拆分成多段，由 readChunk 读取每段数据
+// 超出 size 的读取返回 io.EOF
+func readImage(p []byte, off, size, chunk int64, readChunk func(p []byte, off int64) error) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if off >= size {
+		return 0, io.EOF
+	}
+
+	length := min(int64(len(p)), size-off)
+	for done := int64(0); done < length; {
+		pos := off + done
+		n := min(chunk-pos%chunk, length-done)
+		if err := readChunk(p[done:done+n], pos); err != nil {
+			return int(done), err
+		}
+		done += n
+	}
+
+	if length < int64(len(p)) {
+		return int(length), io.EOF
+	}
+	return int(length), nil
+}
+
+// RawImage 是 raw 格式镜像的只读后端
+type RawImage struct {
+	f    *os.File
+	size int64
+}
+
+// OpenRaw 以只读方式打开 raw 镜像或块设备
+func OpenRaw(path string) (*RawImage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &RawImage{f: f, size: size}, nil
+}
+
+func (r *RawImage) ReadAt(p []byte, off int64) (int, error) {
+	return readImage(p, off, r.size, r.size, func(p []byte, off int64) error {
+		_, err := r.f.ReadAt(p, off)
+		return err
+	})
+}
+
+func (r *RawImage) WriteAt(p []byte, off int64) (int, error) { return 0, ErrReadOnly }
+func (r *RawImage) Size() (int64, error)                     { return r.size, nil }
+func (r *RawImage) Sync() error                              { return nil }
+func (r *RawImage) Format() string                           { return FormatRaw }
+func (r *RawImage) Close() error                             { return r.f.Close() }
@@ -0,0 +1,402 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// writeQcow2 在 path 创建一个 64KiB 的 qcow2 镜像，第一个簇填充 fill，backing 为空表示没有后备文件
+func writeQcow2(t *testing.T, path, backing, backingFormat string, fill byte) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w, err := NewQcow2Writer(f, 64<<10, 4096, backing, backingFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteCluster(0, bytes.Repeat([]byte{fill}, 4096)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// patchFile 在文件的 off 处写入 data
+func patchFile(t *testing.T, path string, off int64, data []byte) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt(data, off); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func be32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+func be64(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+
+// openFails 检查打开镜像失败，并且错误信息包含 want
+func openFails(t *testing.T, path, format, want string) {
+	t.Helper()
+	img, err := Open(path, format)
+	if err == nil {
+		img.Close()
+		t.Fatalf("Open(%s) succeeded, want error containing %q", filepath.Base(path), want)
+	}
+	if !strings.Contains(err.Error(), want) {
+		t.Fatalf("Open(%s) = %v, want error containing %q", filepath.Base(path), err, want)
+	}
+	if len(err.Error()) > 1000 {
+		t.Fatalf("error message is %d bytes long", len(err.Error()))
+	}
+}
+
+func TestQcow2Backing(t *testing.T) {
+	dir := t.TempDir()
+	base, top := filepath.Join(dir, "base.qcow2"), filepath.Join(dir, "top.qcow2")
+	writeQcow2(t, base, "", "", 0x11)
+	writeQcow2(t, top, "base.qcow2", FormatQcow2, 0x22)
+
+	img, err := Open(top, FormatQcow2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	p := make([]byte, 8192)
+	if _, err := img.ReadAt(p, 0); err != nil {
+		t.Fatal(err)
+	}
+	if p[0] != 0x22 || p[4096] != 0 {
+		t.Fatalf("read %#x and %#x, want 0x22 from the top image and zeros", p[0], p[4096])
+	}
+}
+
+func TestQcow2BackingLoop(t *testing.T) {
+	dir := t.TempDir()
+	self := filepath.Join(dir, "self.qcow2")
+	writeQcow2(t, self, "self.qcow2", FormatQcow2, 1)
+	openFails(t, self, FormatQcow2, "backing chain loop")
+
+	a, b := filepath.Join(dir, "a.qcow2"), filepath.Join(dir, "b.qcow2")
+	writeQcow2(t, a, "b.qcow2", FormatQcow2, 1)
+	writeQcow2(t, b, "a.qcow2", FormatQcow2, 2)
+	openFails(t, a, FormatQcow2, "backing chain loop")
+}
+
+func TestQcow2BackingTooDeep(t *testing.T) {
+	dir := t.TempDir()
+	name := func(i int) string { return fmt.Sprintf("layer%d.qcow2", i) }
+	writeQcow2(t, filepath.Join(dir, name(0)), "", "", 0)
+	for i := 1; i <= maxChainDepth; i++ {
+		writeQcow2(t, filepath.Join(dir, name(i)), name(i-1), FormatQcow2, byte(i))
+	}
+
+	// maxChainDepth 层可以打开，再多一层就超过上限
+	img, err := Open(filepath.Join(dir, name(maxChainDepth-1)), FormatQcow2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img.Close()
+	openFails(t, filepath.Join(dir, name(maxChainDepth)), FormatQcow2, "backing chain too deep")
+}
+
+func TestQcow2ProbedBacking(t *testing.T) {
+	dir := t.TempDir()
+	plain, top := filepath.Join(dir, "plain.qcow2"), filepath.Join(dir, "top.qcow2")
+	writeQcow2(t, plain, "", "", 1)
+	writeQcow2(t, top, "/etc/passwd", FormatRaw, 2)
+
+	// 自动识别格式的镜像可以打开，但不能跟随其中的后备文件路径
+	img, err := Open(plain, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img.Close()
+	openFails(t, top, "auto", "detected automatically")
+	openFails(t, top, "", "detected automatically")
+}
+
+func TestQcow2MalformedHeader(t *testing.T) {
+	tests := []struct {
+		name  string
+		off   int64
+		data  []byte
+		want  string
+		extra bool // 文件需要带后备文件
+	}{
+		{"huge L1 table", 36, be32(0xffffffff), "L1 table too large", false},
+		{"L1 table too small", 36, be32(0), "L1 table too small", false},
+		{"L1 table beyond the end", 40, be64(1 << 40), "beyond the end of the file", false},
+		{"huge virtual size", 24, be64(1 << 63), "virtual size", false},
+		{"invalid cluster bits", 20, be32(40), "invalid cluster bits", false},
+		{"huge backing file name", 16, be32(0xffffffff), "invalid backing file name length", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "bad.qcow2")
+			backing := ""
+			if tt.extra {
+				writeQcow2(t, filepath.Join(dir, "base.qcow2"), "", "", 0)
+				backing = "base.qcow2"
+			}
+			writeQcow2(t, path, backing, "", 1)
+			patchFile(t, path, tt.off, tt.data)
+			openFails(t, path, FormatQcow2, tt.want)
+		})
+	}
+}
+
+// vhdImage 描述测试用的动态或差分 VHD 镜像
+type vhdImage struct {
+	diskType   uint32
+	size       uint64
+	blockSize  uint32
+	entries    uint32
+	parentName string // 差分镜像的父镜像文件名
+}
+
+// write 按 VHD 格式写出镜像：页脚副本、动态磁盘头、块分配表，最后是页脚
+func (v vhdImage) write(t *testing.T, path string) {
+	t.Helper()
+	footer := make([]byte, vhdFooterSize)
+	copy(footer, vhdCookie)
+	binary.BigEndian.PutUint64(footer[16:], vhdFooterSize)
+	binary.BigEndian.PutUint64(footer[48:], v.size)
+	binary.BigEndian.PutUint32(footer[60:], v.diskType)
+
+	header := make([]byte, 1024)
+	copy(header, vhdDynamicCookie)
+	binary.BigEndian.PutUint64(header[16:], 3*512)
+	binary.BigEndian.PutUint32(header[28:], v.entries)
+	binary.BigEndian.PutUint32(header[32:], v.blockSize)
+	for i, u := range utf16.Encode([]rune(v.parentName)) {
+		binary.BigEndian.PutUint16(header[64+i*2:], u)
+	}
+
+	bat := bytes.Repeat([]byte{0xff}, int(min(v.entries, 16))*4)
+	data := append(append(append(append([]byte{}, footer...), header...), bat...), footer...)
+	if err := os.WriteFile(path, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVHDMalformedHeader(t *testing.T) {
+	valid := vhdImage{diskType: vhdTypeDynamic, size: 4 << 20, blockSize: 2 << 20, entries: 2}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ok.vhd")
+	valid.write(t, path)
+	img, err := Open(path, FormatVHD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img.Close()
+
+	tests := []struct {
+		name string
+		img  vhdImage
+		want string
+	}{
+		{"huge block allocation table", vhdImage{diskType: vhdTypeDynamic, size: 4 << 20, blockSize: 2 << 20, entries: 0xffffffff}, "beyond the end of the file"},
+		{"block allocation table too small", vhdImage{diskType: vhdTypeDynamic, size: 1 << 40, blockSize: 2 << 20, entries: 2}, "too few"},
+		{"zero block size", vhdImage{diskType: vhdTypeDynamic, size: 4 << 20, blockSize: 0, entries: 2}, "invalid block size"},
+		{"negative size", vhdImage{diskType: vhdTypeDynamic, size: 1 << 63, blockSize: 2 << 20, entries: 2}, "too few"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "bad.vhd")
+			tt.img.write(t, path)
+			openFails(t, path, FormatVHD, tt.want)
+		})
+	}
+}
+
+func TestVHDParentLoop(t *testing.T) {
+	dir := t.TempDir()
+	self := filepath.Join(dir, "self.vhd")
+	vhdImage{diskType: vhdTypeDifferencing, size: 4 << 20, blockSize: 2 << 20, entries: 2, parentName: "self.vhd"}.write(t, self)
+	openFails(t, self, FormatVHD, "backing chain loop")
+}
+
+// vmdkSparseHeader 返回一个 hosted sparse 区段的头部
+func vmdkSparseHeader(capacity, grainSize, gtEntries, gdSector uint64, descSector, descSectors uint64) []byte {
+	h := make([]byte, vmdkHeaderSize)
+	binary.LittleEndian.PutUint32(h, vmdkMagic)
+	binary.LittleEndian.PutUint32(h[4:], 1)
+	binary.LittleEndian.PutUint64(h[12:], capacity)
+	binary.LittleEndian.PutUint64(h[20:], grainSize)
+	binary.LittleEndian.PutUint64(h[28:], descSector)
+	binary.LittleEndian.PutUint64(h[36:], descSectors)
+	binary.LittleEndian.PutUint32(h[44:], uint32(gtEntries))
+	binary.LittleEndian.PutUint64(h[56:], gdSector)
+	return h
+}
+
+func TestVMDKMalformedHeader(t *testing.T) {
+	// 128 个扇区的容量，每个粒度 8 个扇区，一个粒度表，粒度目录在第 1 个扇区
+	valid := vmdkSparseHeader(128, 8, 512, 1, 0, 0)
+	tests := []struct {
+		name   string
+		header []byte
+		want   string
+	}{
+		{"valid", valid, ""},
+		{"huge grain table", vmdkSparseHeader(128, 8, 0xffffffff, 1, 0, 0), "invalid grain size or grain table size"},
+		{"huge grain", vmdkSparseHeader(128, 1<<40, 512, 1, 0, 0), "invalid grain size or grain table size"},
+		{"grain directory beyond the end", vmdkSparseHeader(1<<40, 8, 512, 1, 0, 0), "beyond the end of the file"},
+		{"huge descriptor", vmdkSparseHeader(128, 8, 512, 1, 2, 1<<40), "embedded descriptor too large"},
+		{"descriptor beyond the end", vmdkSparseHeader(128, 8, 512, 1, 1<<20, 1), "beyond the end of the file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "disk.vmdk")
+			data := append(append([]byte{}, tt.header...), make([]byte, 2*vmdkSectorSize)...)
+			if err := os.WriteFile(path, data, 0666); err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == "" {
+				img, err := Open(path, FormatVMDK)
+				if err != nil {
+					t.Fatal(err)
+				}
+				img.Close()
+				return
+			}
+			openFails(t, path, FormatVMDK, tt.want)
+		})
+	}
+}
+
+// writeDescriptor 写出一个 VMDK 描述符文件
+func writeDescriptor(t *testing.T, path, body string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte("# Disk DescriptorFile\nversion=1\n"+body), 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVMDKParentLoop(t *testing.T) {
+	dir := t.TempDir()
+	self := filepath.Join(dir, "self.vmdk")
+	writeDescriptor(t, self, "parentCID=12345678\nparentFileNameHint=\"self.vmdk\"\nRW 128 ZERO\n")
+	openFails(t, self, FormatVMDK, "backing chain loop")
+}
+
+func TestVMDKProbedExtent(t *testing.T) {
+	dir := t.TempDir()
+	flat := filepath.Join(dir, "flat.img")
+	if err := os.WriteFile(flat, bytes.Repeat([]byte{7}, 64<<10), 0666); err != nil {
+		t.Fatal(err)
+	}
+	desc := filepath.Join(dir, "disk.vmdk")
+	writeDescriptor(t, desc, "RW 128 FLAT \"flat.img\" 0\n")
+
+	img, err := Open(desc, FormatVMDK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img.Close()
+	openFails(t, desc, "auto", "detected automatically")
+}
+
+// vhdxImage 描述测试用的 VHDX 镜像的元数据
+type vhdxImage struct {
+	blockSize, logicalSector uint32
+	size                     uint64
+}
+
+// write 按 VHDX 格式写出头部、区域表、元数据和块分配表
+func (v vhdxImage) write(t *testing.T, path string) {
+	t.Helper()
+	const metaOffset, batOffset = 1 << 20, 2 << 20
+	data := make([]byte, 3<<20)
+	copy(data, "vhdxfile")
+	checksum := func(b []byte) {
+		binary.LittleEndian.PutUint32(b[4:], crc32.Checksum(b, crc32c))
+	}
+
+	header := data[vhdxHeader1Offset : vhdxHeader1Offset+vhdxHeaderSize]
+	binary.LittleEndian.PutUint32(header, vhdxHeaderSignature)
+	binary.LittleEndian.PutUint64(header[8:], 1)
+	checksum(header)
+
+	regions := data[vhdxRegion1Offset : vhdxRegion1Offset+vhdxRegionSize]
+	binary.LittleEndian.PutUint32(regions, vhdxRegionSignature)
+	binary.LittleEndian.PutUint32(regions[8:], 2)
+	for i, r := range []struct {
+		guid   [16]byte
+		offset uint64
+	}{{vhdxBATRegion, batOffset}, {vhdxMetadataRegion, metaOffset}} {
+		entry := regions[16+i*32:]
+		copy(entry, r.guid[:])
+		binary.LittleEndian.PutUint64(entry[16:], r.offset)
+		binary.LittleEndian.PutUint32(entry[24:], 1<<20)
+	}
+	checksum(regions)
+
+	meta := data[metaOffset:]
+	copy(meta, vhdxMetadataSignature)
+	binary.LittleEndian.PutUint16(meta[10:], 3)
+	items := []struct {
+		guid  [16]byte
+		value []byte
+	}{
+		{vhdxFileParameters, binary.LittleEndian.AppendUint64(nil, uint64(v.blockSize))},
+		{vhdxVirtualDiskSize, binary.LittleEndian.AppendUint64(nil, v.size)},
+		{vhdxLogicalSector, binary.LittleEndian.AppendUint64(nil, uint64(v.logicalSector))},
+	}
+	for i, item := range items {
+		entry := meta[32+i*32:]
+		copy(entry, item.guid[:])
+		itemOffset := 64<<10 + i*8
+		binary.LittleEndian.PutUint32(entry[16:], uint32(itemOffset))
+		copy(meta[itemOffset:], item.value)
+	}
+
+	if err := os.WriteFile(path, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVHDXMalformedHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		img  vhdxImage
+		want string
+	}{
+		{"valid", vhdxImage{blockSize: 1 << 20, logicalSector: 512, size: 16 << 20}, ""},
+		{"zero-sized blocks", vhdxImage{blockSize: 1, logicalSector: 512, size: 16 << 20}, "invalid block size"},
+		{"huge blocks", vhdxImage{blockSize: 1 << 31, logicalSector: 512, size: 16 << 20}, "invalid block size"},
+		{"invalid logical sector", vhdxImage{blockSize: 1 << 20, logicalSector: 1 << 30, size: 16 << 20}, "invalid logical sector size"},
+		{"huge virtual size", vhdxImage{blockSize: 1 << 20, logicalSector: 512, size: 1 << 62}, "invalid virtual disk size"},
+		{"block allocation table beyond the region", vhdxImage{blockSize: 1 << 20, logicalSector: 512, size: 1 << 40}, "BAT region too small"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "disk.vhdx")
+			tt.img.write(t, path)
+			if tt.want == "" {
+				img, err := Open(path, FormatVHDX)
+				if err != nil {
+					t.Fatal(err)
+				}
+				img.Close()
+				return
+			}
+			openFails(t, path, FormatVHDX, tt.want)
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package image
+
+// qcow2 格式定义，参见 https://gitlab.com/qemu-project/qemu/-/blob/master/docs/interop/qcow2.txt
+
+const (
+	qcow2Magic = 0x514649fb // "QFI\xfb"
+
+	qcow2Version        = 3
+	qcow2HeaderLength   = 104
+	qcow2RefcountOrder  = 4 // 16 位引用计数
+	qcow2MinClusterBits = 9
+	qcow2MaxClusterBits = 21
+
+	// 读取时对文件头中各项大小的上限，防止构造的头部导致巨大的内存分配
+	qcow2MaxL1Size      = 32 << 20 / 8 // 与 qemu 相同，L1 表最大 32MiB
+	qcow2MaxSize        = 1 << 61      // 最大簇大小和最大 L1 表能够寻址的虚拟大小
+	qcow2MaxBackingName = 1023
+
+	qcow2ExtEnd           = 0x00000000
+	qcow2ExtBackingFormat = 0xe2792aca
+
+	qcow2OflagCopied     = uint64(1) << 63
+	qcow2OflagCompressed = uint64(1) << 62
+	qcow2OflagZero       = uint64(1) << 0
+	qcow2OffsetMask      = uint64(0x00fffffffffffe00)
+
+	qcow2CompressedSectorSize = 512
+	qcow2DeflateWindow        = 4096
+)
+
+// qcow2Header 是 qcow2 文件头（版本 3，不含扩展）
+type qcow2Header struct {
+	Magic                 uint32
+	Version               uint32
+	BackingFileOffset     uint64
+	BackingFileSize       uint32
+	ClusterBits           uint32
+	Size                  uint64
+	CryptMethod           uint32
+	L1Size                uint32
+	L1TableOffset         uint64
+	RefcountTableOffset   uint64
+	RefcountTableClusters uint32
+	NbSnapshots           uint32
+	SnapshotsOffset       uint64
+	IncompatibleFeatures  uint64
+	CompatibleFeatures    uint64
+	AutoclearFeatures     uint64
+	RefcountOrder         uint32
+	HeaderLength          uint32
+}
+
+// clusterBitsFor 返回与 clusterSize 对应的位数，clusterSize 不是合法的 qcow2 簇大小时返回 0
+func clusterBitsFor(clusterSize int64) uint32 {
+	for bits := uint32(qcow2MinClusterBits); bits <= qcow2MaxClusterBits; bits++ {
+		if int64(1)<<bits == clusterSize {
+			return bits
+		}
+	}
+	return 0
+}
@@ -0,0 +1,328 @@
+package image
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	nbdbackend "nbd/backend"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// 只读方式下需要拒绝的不兼容特性
+const (
+	qcow2IncompatCorrupt      = uint64(1) << 1
+	qcow2IncompatDataFile     = uint64(1) << 2
+	qcow2IncompatCompressType = uint64(1) << 3
+	qcow2IncompatExtendedL2   = uint64(1) << 4
+
+	qcow2HeaderLengthV2 = 72
+	qcow2CacheSize      = 256
+)
+
+// Qcow2Image 是 qcow2 镜像的只读后端，支持压缩簇、零簇和后备镜像链
+type Qcow2Image struct {
+	f           *os.File
+	size        int64
+	clusterSize int64
+	l2Entries   int64
+	l1          []uint64
+	backing     Image
+
+	csizeShift uint32
+	csizeMask  uint64
+	offsetMask uint64
+
+	l2Cache      *lru.Cache // L2 表偏移 -> []uint64
+	clusterCache *lru.Cache // 压缩簇 L2 表项 -> 解压后的数据
+}
+
+// OpenQcow2 打开 qcow2 镜像，后备文件路径相对于镜像所在目录解析
+func OpenQcow2(path string) (*Qcow2Image, error) {
+	return openQcow2File(path, imageChain{}, false)
+}
+
+func openQcow2File(path string, parent imageChain, probed bool) (*Qcow2Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := parent.enter(f, probed)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	img, err := openQcow2(path, f, chain)
+	if err != nil {
+		f.Close()
+		return nil, imageError(path, err)
+	}
+	return img, nil
+}
+
+func openQcow2(path string, f *os.File, chain imageChain) (*Qcow2Image, error) {
+	var h qcow2Header
+	raw := make([]byte, qcow2HeaderLength)
+	if _, err := f.ReadAt(raw, 0); err != nil {
+		return nil, fmt.Errorf("failed to read qcow2 header: %v", err)
+	}
+	if err := binary.Read(bytes.NewReader(raw), binary.BigEndian, &h); err != nil {
+		return nil, err
+	}
+	if h.Magic != qcow2Magic {
+		return nil, fmt.Errorf("not a qcow2 image")
+	}
+	switch h.Version {
+	case 2:
+		h.IncompatibleFeatures = 0
+		h.HeaderLength = qcow2HeaderLengthV2
+	case 3:
+	default:
+		return nil, fmt.Errorf("unsupported qcow2 version %d", h.Version)
+	}
+	if h.ClusterBits < qcow2MinClusterBits || h.ClusterBits > qcow2MaxClusterBits {
+		return nil, fmt.Errorf("invalid cluster bits %d", h.ClusterBits)
+	}
+	if h.CryptMethod != 0 {
+		return nil, fmt.Errorf("encrypted qcow2 images are not supported")
+	}
+	if h.IncompatibleFeatures&qcow2IncompatCorrupt != 0 {
+		return nil, fmt.Errorf("image is marked corrupt, run qemu-img check first")
+	}
+	if h.IncompatibleFeatures&qcow2IncompatDataFile != 0 {
+		return nil, fmt.Errorf("qcow2 images with external data files are not supported")
+	}
+	if h.IncompatibleFeatures&qcow2IncompatExtendedL2 != 0 {
+		return nil, fmt.Errorf("qcow2 images with extended L2 entries are not supported")
+	}
+	if h.IncompatibleFeatures&qcow2IncompatCompressType != 0 {
+		compressionType := make([]byte, 1)
+		if _, err := f.ReadAt(compressionType, qcow2HeaderLength); err != nil {
+			return nil, err
+		}
+		if compressionType[0] != 0 {
+			return nil, fmt.Errorf("only zlib compressed qcow2 images are supported")
+		}
+	}
+
+	clusterSize := int64(1) << h.ClusterBits
+	img := &Qcow2Image{
+		f:           f,
+		size:        int64(h.Size),
+		clusterSize: clusterSize,
+		l2Entries:   clusterSize / 8,
+		csizeShift:  62 - (h.ClusterBits - 8),
+		csizeMask:   (uint64(1) << (h.ClusterBits - 8)) - 1,
+	}
+	img.offsetMask = (uint64(1) << img.csizeShift) - 1
+	img.l2Cache, _ = lru.New(qcow2CacheSize)
+	img.clusterCache, _ = lru.New(qcow2CacheSize)
+
+	// L1 表的大小来自文件头，分配之前先检查它与虚拟大小是否相符
+	if h.Size > qcow2MaxSize {
+		return nil, fmt.Errorf("virtual size %d is too large", h.Size)
+	}
+	if minL1 := (int64(h.Size) + clusterSize*img.l2Entries - 1) / (clusterSize * img.l2Entries); int64(h.L1Size) < minL1 {
+		return nil, fmt.Errorf("L1 table too small: %d entries for virtual size %d", h.L1Size, h.Size)
+	}
+	if h.L1Size > qcow2MaxL1Size {
+		return nil, fmt.Errorf("L1 table too large: %d entries", h.L1Size)
+	}
+	l1Raw, err := readTable(f, int64(h.L1TableOffset), int64(h.L1Size)*8)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read L1 table: %v", err)
+	}
+	img.l1 = make([]uint64, h.L1Size)
+	for i := range img.l1 {
+		img.l1[i] = binary.BigEndian.Uint64(l1Raw[i*8:])
+	}
+
+	// 后备文件及其格式
+	if h.BackingFileOffset != 0 {
+		if h.BackingFileSize == 0 || h.BackingFileSize > qcow2MaxBackingName {
+			return nil, fmt.Errorf("invalid backing file name length %d", h.BackingFileSize)
+		}
+		name := make([]byte, h.BackingFileSize)
+		if _, err := f.ReadAt(name, int64(h.BackingFileOffset)); err != nil {
+			return nil, fmt.Errorf("failed to read backing file name: %v", err)
+		}
+		backingPath := string(name)
+		if !filepath.IsAbs(backingPath) {
+			backingPath = filepath.Join(filepath.Dir(path), backingPath)
+		}
+		format, err := qcow2BackingFormat(f, &h, clusterSize)
+		if err != nil {
+			return nil, err
+		}
+		if img.backing, err = chain.openBacking("backing file", backingPath, format); err != nil {
+			return nil, err
+		}
+	}
+
+	return img, nil
+}
+
+// qcow2BackingFormat 从头部扩展中读取后备文件格式，没有记录时返回空字符串（自动识别）
+func qcow2BackingFormat(f *os.File, h *qcow2Header, clusterSize int64) (string, error) {
+	offset := int64(h.HeaderLength)
+	for offset+8 <= clusterSize {
+		var ext [2]uint32
+		buf := make([]byte, 8)
+		if _, err := f.ReadAt(buf, offset); err != nil {
+			return "", err
+		}
+		ext[0] = binary.BigEndian.Uint32(buf)
+		ext[1] = binary.BigEndian.Uint32(buf[4:])
+		if ext[0] == qcow2ExtEnd {
+			break
+		}
+		if ext[0] == qcow2ExtBackingFormat {
+			if int64(ext[1]) > clusterSize {
+				return "", fmt.Errorf("invalid backing format extension length %d", ext[1])
+			}
+			data := make([]byte, ext[1])
+			if _, err := f.ReadAt(data, offset+8); err != nil {
+				return "", err
+			}
+			return string(data), nil
+		}
+		offset += 8 + int64((ext[1]+7)/8*8)
+	}
+	return "", nil
+}
+
+// l2Table 读取并缓存一个 L2 表
+func (q *Qcow2Image) l2Table(offset int64) ([]uint64, error) {
+	if table, ok := q.l2Cache.Get(offset); ok {
+		return table.([]uint64), nil
+	}
+	raw := make([]byte, q.clusterSize)
+	if _, err := q.f.ReadAt(raw, offset); err != nil {
+		return nil, fmt.Errorf("failed to read L2 table at 0x%x: %v", offset, err)
+	}
+	table := make([]uint64, q.l2Entries)
+	for i := range table {
+		table[i] = binary.BigEndian.Uint64(raw[i*8:])
+	}
+	q.l2Cache.Add(offset, table)
+	return table, nil
+}
+
+// compressedCluster 读取并解压一个压缩簇
+func (q *Qcow2Image) compressedCluster(entry uint64) ([]byte, error) {
+	if data, ok := q.clusterCache.Get(entry); ok {
+		return data.([]byte), nil
+	}
+	coffset := int64(entry & q.offsetMask)
+	nbSectors := int64((entry>>q.csizeShift)&q.csizeMask) + 1
+	csize := nbSectors*qcow2CompressedSectorSize - coffset%qcow2CompressedSectorSize
+
+	compressed := make([]byte, csize)
+	n, err := q.f.ReadAt(compressed, coffset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	data := make([]byte, q.clusterSize)
+	if _, err := io.ReadFull(flate.NewReader(bytes.NewReader(compressed[:n])), data); err != nil {
+		return nil, fmt.Errorf("failed to decompress cluster at 0x%x: %v", coffset, err)
+	}
+	q.clusterCache.Add(entry, data)
+	return data, nil
+}
+
+// entry 返回虚拟簇对应的 L2 表项，L2 表未分配时返回 0
+func (q *Qcow2Image) entry(index int64) (uint64, error) {
+	l1Index := index / q.l2Entries
+	if l1Index >= int64(len(q.l1)) {
+		return 0, nil
+	}
+	l2Offset := int64(q.l1[l1Index] & qcow2OffsetMask)
+	if l2Offset == 0 {
+		return 0, nil
+	}
+	table, err := q.l2Table(l2Offset)
+	if err != nil {
+		return 0, err
+	}
+	return table[index%q.l2Entries], nil
+}
+
+// readCluster 读取一个簇内的数据，p 不会跨越簇边界
+func (q *Qcow2Image) readCluster(p []byte, off int64) error {
+	e, err := q.entry(off / q.clusterSize)
+	if err != nil {
+		return err
+	}
+	inCluster := off % q.clusterSize
+
+	switch {
+	case e&qcow2OflagCompressed != 0:
+		data, err := q.compressedCluster(e)
+		if err != nil {
+			return err
+		}
+		copy(p, data[inCluster:])
+	case e&qcow2OflagZero != 0:
+		clear(p)
+	case e&qcow2OffsetMask == 0:
+		return readBacking(q.backing, p, off)
+	default:
+		if _, err := q.f.ReadAt(p, int64(e&qcow2OffsetMask)+inCluster); err != nil {
+			return fmt.Errorf("failed to read cluster data: %v", err)
+		}
+	}
+	return nil
+}
+
+func (q *Qcow2Image) ReadAt(p []byte, off int64) (int, error) {
+	return readImage(p, off, q.size, q.clusterSize, q.readCluster)
+}
+
+// Extents 报告簇的分配情况：零簇和没有后备镜像的未分配簇为已知零，未分配簇按后备镜像报告
+func (q *Qcow2Image) Extents(off, length int64) ([]nbdbackend.Extent, error) {
+	var extents []nbdbackend.Extent
+	end := min(off+length, q.size)
+	for pos := off; pos < end; {
+		next := min((pos/q.clusterSize+1)*q.clusterSize, end)
+		e, err := q.entry(pos / q.clusterSize)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case e&qcow2OflagCompressed != 0:
+			extents = nbdbackend.AppendExtent(extents, nbdbackend.Extent{Offset: pos, Length: next - pos, Source: nbdbackend.ExtentBase})
+		case e&qcow2OflagZero != 0:
+			extents = nbdbackend.AppendExtent(extents, nbdbackend.Extent{Offset: pos, Length: next - pos, Source: nbdbackend.ExtentZero})
+		case e&qcow2OffsetMask == 0:
+			if extents, err = backingExtents(extents, q.backing, pos, next-pos); err != nil {
+				return nil, err
+			}
+		default:
+			extents = nbdbackend.AppendExtent(extents, nbdbackend.Extent{Offset: pos, Length: next - pos, Source: nbdbackend.ExtentBase})
+		}
+		pos = next
+	}
+	return extents, nil
+}
+
+// ZeroExtents 与 Extents 相同：L2 表有缓存，查询的代价与读取时查找簇相同
+func (q *Qcow2Image) ZeroExtents(off, length int64) ([]nbdbackend.Extent, error) {
+	return q.Extents(off, length)
+}
+
+func (q *Qcow2Image) WriteAt(p []byte, off int64) (int, error) { return 0, ErrReadOnly }
+func (q *Qcow2Image) Size() (int64, error)                     { return q.size, nil }
+func (q *Qcow2Image) Sync() error                              { return nil }
+func (q *Qcow2Image) Format() string                           { return FormatQcow2 }
+
+func (q *Qcow2Image) Close() error {
+	if q.backing != nil {
+		q.backing.Close()
+	}
+	return q.f.Close()
+}
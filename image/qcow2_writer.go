@@ -0,0 +1,269 @@
+package image
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// Qcow2Writer 以流的方式生成 qcow2 镜像
+// 数据簇按写入顺序追加在文件头之后，L2 表、L1 表和引用计数结构在 Close 时写到文件末尾，最后回写文件头
+type Qcow2Writer struct {
+	f             *os.File
+	size          int64
+	clusterBits   uint32
+	clusterSize   int64
+	l2Entries     int64
+	backing       string
+	backingFormat string
+
+	l2        map[int64][]uint64 // L1 下标 -> L2 表
+	refcounts map[int64]uint16   // 主机簇下标 -> 引用计数
+	end       int64              // 下一个可用的主机偏移
+	closed    bool
+}
+
+// NewQcow2Writer 创建一个 qcow2 镜像写入器
+// size 为虚拟磁盘大小，clusterSize 必须是 512 到 2MiB 之间的 2 的幂，backing 为空表示没有后备文件
+func NewQcow2Writer(f *os.File, size, clusterSize int64, backing, backingFormat string) (*Qcow2Writer, error) {
+	bits := clusterBitsFor(clusterSize)
+	if bits == 0 {
+		return nil, fmt.Errorf("invalid qcow2 cluster size %d", clusterSize)
+	}
+
+	// 文件头、扩展和后备文件名都放在第 0 个簇中
+	headerSize := int64(qcow2HeaderLength) + 8 + 8 + int64(len(backing))
+	if backingFormat != "" {
+		headerSize += 8 + int64((len(backingFormat)+7)/8*8)
+	}
+	if headerSize > clusterSize {
+		return nil, fmt.Errorf("backing file name too long for cluster size %d", clusterSize)
+	}
+
+	w := &Qcow2Writer{
+		f:             f,
+		size:          size,
+		clusterBits:   bits,
+		clusterSize:   clusterSize,
+		l2Entries:     clusterSize / 8,
+		backing:       backing,
+		backingFormat: backingFormat,
+		l2:            make(map[int64][]uint64),
+		refcounts:     map[int64]uint16{0: 1},
+		end:           clusterSize,
+	}
+	return w, nil
+}
+
+// ClusterSize 返回簇大小
+func (w *Qcow2Writer) ClusterSize() int64 {
+	return w.clusterSize
+}
+
+// setL2 设置虚拟簇 index 对应的 L2 表项
+func (w *Qcow2Writer) setL2(index int64, entry uint64) error {
+	if index < 0 || index*w.clusterSize >= w.size {
+		return fmt.Errorf("cluster %d is beyond the virtual size", index)
+	}
+	l1Index := index / w.l2Entries
+	table, ok := w.l2[l1Index]
+	if !ok {
+		table = make([]uint64, w.l2Entries)
+		w.l2[l1Index] = table
+	}
+	table[index%w.l2Entries] = entry
+	return nil
+}
+
+// allocClusters 在文件末尾按簇对齐分配 n 个簇，返回起始偏移
+func (w *Qcow2Writer) allocClusters(n int64) int64 {
+	w.end = (w.end + w.clusterSize - 1) / w.clusterSize * w.clusterSize
+	offset := w.end
+	for i := int64(0); i < n; i++ {
+		w.refcounts[offset/w.clusterSize+i]++
+	}
+	w.end += n * w.clusterSize
+	return offset
+}
+
+// WriteCluster 写入一个完整的虚拟簇，data 长度必须等于簇大小
+func (w *Qcow2Writer) WriteCluster(index int64, data []byte) error {
+	if int64(len(data)) != w.clusterSize {
+		return fmt.Errorf("cluster data must be %d bytes", w.clusterSize)
+	}
+	offset := w.allocClusters(1)
+	if _, err := w.f.WriteAt(data, offset); err != nil {
+		return err
+	}
+	return w.setL2(index, uint64(offset)|qcow2OflagCopied)
+}
+
+// WriteZeroCluster 把一个虚拟簇标记为全零，不占用数据空间，也不会从后备文件读取
+func (w *Qcow2Writer) WriteZeroCluster(index int64) error {
+	return w.setL2(index, qcow2OflagZero)
+}
+
+// WriteCompressedCluster 以 deflate 压缩的形式写入一个虚拟簇，压缩后不能变小时按普通簇写入
+func (w *Qcow2Writer) WriteCompressedCluster(index int64, data []byte) error {
+	if int64(len(data)) != w.clusterSize {
+		return fmt.Errorf("cluster data must be %d bytes", w.clusterSize)
+	}
+
+	// qemu 以 4KiB 窗口（windowBits -12）解压，compress/flate 的回溯距离最大为 32KiB，
+	// 簇大于 4KiB 时只能使用不产生回溯引用的 Huffman 编码
+	level := flate.DefaultCompression
+	if w.clusterSize > qcow2DeflateWindow {
+		level = flate.HuffmanOnly
+	}
+
+	var buf bytes.Buffer
+	zw, err := flate.NewWriter(&buf, level)
+	if err != nil {
+		return err
+	}
+	if _, err := zw.Write(data); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if int64(buf.Len()) >= w.clusterSize-qcow2CompressedSectorSize {
+		return w.WriteCluster(index, data)
+	}
+
+	// 压缩数据按字节紧密排列，可以跨越簇边界，涉及的每个主机簇引用计数都加一
+	offset := w.end
+	length := int64(buf.Len())
+	if _, err := w.f.WriteAt(buf.Bytes(), offset); err != nil {
+		return err
+	}
+	for c := offset / w.clusterSize; c <= (offset+length-1)/w.clusterSize; c++ {
+		w.refcounts[c]++
+	}
+	w.end = offset + length
+
+	csizeShift := 62 - (w.clusterBits - 8)
+	nbSectors := uint64((offset+length-1)/qcow2CompressedSectorSize - offset/qcow2CompressedSectorSize)
+	entry := qcow2OflagCompressed | nbSectors<<csizeShift | uint64(offset)
+	return w.setL2(index, entry)
+}
+
+// writeTable 把一组大端 uint64 写到 offset
+func (w *Qcow2Writer) writeTable(offset int64, entries []uint64) error {
+	buf := make([]byte, len(entries)*8)
+	for i, e := range entries {
+		binary.BigEndian.PutUint64(buf[i*8:], e)
+	}
+	_, err := w.f.WriteAt(buf, offset)
+	return err
+}
+
+// Close 写入 L2 表、L1 表、引用计数结构和文件头
+func (w *Qcow2Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	// L2 表
+	l1Size := (w.size + w.clusterSize*w.l2Entries - 1) / (w.clusterSize * w.l2Entries)
+	l1 := make([]uint64, l1Size)
+	indexes := make([]int64, 0, len(w.l2))
+	for i := range w.l2 {
+		indexes = append(indexes, i)
+	}
+	sort.Slice(indexes, func(a, b int) bool { return indexes[a] < indexes[b] })
+	for _, i := range indexes {
+		offset := w.allocClusters(1)
+		if err := w.writeTable(offset, w.l2[i]); err != nil {
+			return err
+		}
+		l1[i] = uint64(offset) | qcow2OflagCopied
+	}
+
+	// L1 表
+	l1Clusters := max(1, (l1Size*8+w.clusterSize-1)/w.clusterSize)
+	l1Offset := w.allocClusters(l1Clusters)
+	if err := w.writeTable(l1Offset, l1); err != nil {
+		return err
+	}
+
+	// 引用计数表和引用计数块需要覆盖包括它们自身在内的所有簇，反复计算直到结果稳定
+	w.end = (w.end + w.clusterSize - 1) / w.clusterSize * w.clusterSize
+	dataClusters := w.end / w.clusterSize
+	perBlock := w.clusterSize / 2
+	var blocks, tableClusters int64
+	for {
+		total := dataClusters + blocks + tableClusters
+		newBlocks := (total + perBlock - 1) / perBlock
+		newTableClusters := max(1, (newBlocks*8+w.clusterSize-1)/w.clusterSize)
+		if newBlocks == blocks && newTableClusters == tableClusters {
+			break
+		}
+		blocks, tableClusters = newBlocks, newTableClusters
+	}
+	tableOffset := w.allocClusters(tableClusters)
+	blocksOffset := w.allocClusters(blocks)
+
+	table := make([]uint64, tableClusters*w.clusterSize/8)
+	for b := int64(0); b < blocks; b++ {
+		table[b] = uint64(blocksOffset + b*w.clusterSize)
+	}
+	if err := w.writeTable(tableOffset, table); err != nil {
+		return err
+	}
+	for b := int64(0); b < blocks; b++ {
+		block := make([]byte, w.clusterSize)
+		for i := int64(0); i < perBlock; i++ {
+			binary.BigEndian.PutUint16(block[i*2:], w.refcounts[b*perBlock+i])
+		}
+		if _, err := w.f.WriteAt(block, blocksOffset+b*w.clusterSize); err != nil {
+			return err
+		}
+	}
+
+	// 文件头、扩展和后备文件名
+	header := &bytes.Buffer{}
+	h := qcow2Header{
+		Magic:                 qcow2Magic,
+		Version:               qcow2Version,
+		ClusterBits:           w.clusterBits,
+		Size:                  uint64(w.size),
+		L1Size:                uint32(l1Size),
+		L1TableOffset:         uint64(l1Offset),
+		RefcountTableOffset:   uint64(tableOffset),
+		RefcountTableClusters: uint32(tableClusters),
+		RefcountOrder:         qcow2RefcountOrder,
+		HeaderLength:          qcow2HeaderLength,
+	}
+	if err := binary.Write(header, binary.BigEndian, h); err != nil {
+		return err
+	}
+	if w.backingFormat != "" {
+		binary.Write(header, binary.BigEndian, [2]uint32{qcow2ExtBackingFormat, uint32(len(w.backingFormat))})
+		header.WriteString(w.backingFormat)
+		header.Write(make([]byte, (8-len(w.backingFormat)%8)%8))
+	}
+	binary.Write(header, binary.BigEndian, [2]uint32{qcow2ExtEnd, 0})
+	if w.backing != "" {
+		h.BackingFileOffset = uint64(header.Len())
+		h.BackingFileSize = uint32(len(w.backing))
+		header.WriteString(w.backing)
+
+		// 回填后备文件的位置
+		fixed := &bytes.Buffer{}
+		binary.Write(fixed, binary.BigEndian, h)
+		copy(header.Bytes(), fixed.Bytes())
+	}
+	if _, err := w.f.WriteAt(header.Bytes(), 0); err != nil {
+		return err
+	}
+
+	if err := w.f.Truncate(w.end); err != nil {
+		return err
+	}
+	return w.f.Sync()
+}
@@ -0,0 +1,283 @@
+package image
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// VHD 格式定义，参见 Microsoft Virtual Hard Disk Image Format Specification
+
+const (
+	vhdCookie        = "conectix"
+	vhdDynamicCookie = "cxsparse"
+	vhdFooterSize    = 512
+	vhdSectorSize    = 512
+	vhdUnallocated   = 0xffffffff
+
+	vhdMaxLocatorSize = 64 << 10 // 父镜像定位器中路径的最大长度
+
+	vhdTypeFixed        = 2
+	vhdTypeDynamic      = 3
+	vhdTypeDifferencing = 4
+
+	vhdPlatformW2ru = 0x57327275 // Windows 相对路径，UTF-16LE
+	vhdPlatformW2ku = 0x57326b75 // Windows 绝对路径，UTF-16LE
+	vhdPlatformMacX = 0x4d616358 // file:// URL，UTF-8
+)
+
+// VHDImage 是 VHD 镜像（固定、动态和差分）的只读后端
+type VHDImage struct {
+	f        *os.File
+	size     int64
+	diskType uint32
+
+	blockSize  int64
+	bitmapSize int64
+	bat        []uint32
+	parent     Image
+
+	bitmapCache *lru.Cache // 块下标 -> 扇区位图
+}
+
+// OpenVHD 打开 VHD 镜像，差分镜像通过父镜像定位器打开父镜像
+func OpenVHD(path string) (*VHDImage, error) {
+	return openVHDFile(path, imageChain{}, false)
+}
+
+func openVHDFile(path string, parent imageChain, probed bool) (*VHDImage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := parent.enter(f, probed)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	img, err := openVHD(path, f, chain)
+	if err != nil {
+		f.Close()
+		return nil, imageError(path, err)
+	}
+	return img, nil
+}
+
+func openVHD(path string, f *os.File, chain imageChain) (*VHDImage, error) {
+	fileSize, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if fileSize < vhdFooterSize {
+		return nil, fmt.Errorf("file too small for a VHD image")
+	}
+
+	// 页脚在文件末尾，动态镜像在文件开头还有一份副本
+	footer := make([]byte, vhdFooterSize)
+	if _, err := f.ReadAt(footer, fileSize-vhdFooterSize); err != nil {
+		return nil, err
+	}
+	if string(footer[:8]) != vhdCookie {
+		if _, err := f.ReadAt(footer, 0); err != nil {
+			return nil, err
+		}
+		if string(footer[:8]) != vhdCookie {
+			return nil, fmt.Errorf("VHD footer not found")
+		}
+	}
+
+	img := &VHDImage{
+		f:        f,
+		size:     int64(binary.BigEndian.Uint64(footer[48:])),
+		diskType: binary.BigEndian.Uint32(footer[60:]),
+	}
+
+	switch img.diskType {
+	case vhdTypeFixed:
+		if img.size < 0 || img.size > fileSize-vhdFooterSize {
+			return nil, fmt.Errorf("fixed VHD is truncated")
+		}
+		return img, nil
+	case vhdTypeDynamic, vhdTypeDifferencing:
+	default:
+		return nil, fmt.Errorf("unsupported VHD disk type %d", img.diskType)
+	}
+
+	// 动态磁盘头
+	header := make([]byte, 1024)
+	if _, err := f.ReadAt(header, int64(binary.BigEndian.Uint64(footer[16:]))); err != nil {
+		return nil, fmt.Errorf("failed to read dynamic disk header: %v", err)
+	}
+	if string(header[:8]) != vhdDynamicCookie {
+		return nil, fmt.Errorf("invalid dynamic disk header")
+	}
+	tableOffset := int64(binary.BigEndian.Uint64(header[16:]))
+	entries := binary.BigEndian.Uint32(header[28:])
+	img.blockSize = int64(binary.BigEndian.Uint32(header[32:]))
+	if img.blockSize == 0 || img.blockSize%vhdSectorSize != 0 {
+		return nil, fmt.Errorf("invalid block size %d", img.blockSize)
+	}
+	if img.size < 0 || int64(entries) < (img.size+img.blockSize-1)/img.blockSize {
+		return nil, fmt.Errorf("block allocation table has %d entries, too few for virtual size %d", entries, img.size)
+	}
+	img.bitmapSize = (img.blockSize/vhdSectorSize/8 + vhdSectorSize - 1) / vhdSectorSize * vhdSectorSize
+	img.bitmapCache, _ = lru.New(256)
+
+	// 块分配表
+	raw, err := readTable(f, tableOffset, int64(entries)*4)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read block allocation table: %v", err)
+	}
+	img.bat = make([]uint32, entries)
+	for i := range img.bat {
+		img.bat[i] = binary.BigEndian.Uint32(raw[i*4:])
+	}
+
+	if img.diskType == vhdTypeDifferencing {
+		parentPath, err := vhdParentPath(f, path, header)
+		if err != nil {
+			return nil, err
+		}
+		if img.parent, err = chain.openBacking("parent image", parentPath, FormatVHD); err != nil {
+			return nil, err
+		}
+	}
+	return img, nil
+}
+
+// vhdParentPath 依次尝试父镜像定位器中的路径，最后尝试与本镜像同目录下的父镜像文件名
+func vhdParentPath(f *os.File, path string, header []byte) (string, error) {
+	var candidates []string
+	for i := 0; i < 8; i++ {
+		entry := header[576+i*24:]
+		code := binary.BigEndian.Uint32(entry)
+		length := binary.BigEndian.Uint32(entry[8:])
+		offset := int64(binary.BigEndian.Uint64(entry[16:]))
+		if code == 0 || length == 0 || length > vhdMaxLocatorSize {
+			continue
+		}
+		data, err := readTable(f, offset, int64(length))
+		if err != nil {
+			continue
+		}
+
+		var locator string
+		switch code {
+		case vhdPlatformW2ru, vhdPlatformW2ku:
+			locator = decodeUTF16(data, binary.LittleEndian)
+			locator = strings.ReplaceAll(locator, `\`, "/")
+		case vhdPlatformMacX:
+			locator = strings.TrimPrefix(string(data), "file://")
+		default:
+			continue
+		}
+		// 去掉 Windows 盘符前缀，按相对路径处理
+		if len(locator) > 2 && locator[1] == ':' {
+			locator = locator[2:]
+		}
+		candidates = append(candidates, locator)
+	}
+	if name := decodeUTF16(header[64:576], binary.BigEndian); name != "" {
+		candidates = append(candidates, filepath.Base(strings.ReplaceAll(name, `\`, "/")))
+	}
+
+	for _, candidate := range candidates {
+		if !filepath.IsAbs(candidate) {
+			candidate = filepath.Join(filepath.Dir(path), candidate)
+		}
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("parent image of differencing VHD not found")
+}
+
+// decodeUTF16 解码以 NUL 结尾的 UTF-16 字符串
+func decodeUTF16(data []byte, order binary.ByteOrder) string {
+	units := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		u := order.Uint16(data[i:])
+		if u == 0 {
+			break
+		}
+		units = append(units, u)
+	}
+	return string(utf16.Decode(units))
+}
+
+// bitmap 读取并缓存块的扇区位图，位为 1 的扇区保存在本镜像中
+func (v *VHDImage) bitmap(block int64) ([]byte, error) {
+	if bm, ok := v.bitmapCache.Get(block); ok {
+		return bm.([]byte), nil
+	}
+	bm := make([]byte, v.bitmapSize)
+	if _, err := v.f.ReadAt(bm, int64(v.bat[block])*vhdSectorSize); err != nil {
+		return nil, fmt.Errorf("failed to read sector bitmap: %v", err)
+	}
+	v.bitmapCache.Add(block, bm)
+	return bm, nil
+}
+
+// readBlock 读取一个块内的数据，p 不会跨越块边界
+func (v *VHDImage) readBlock(p []byte, off int64) error {
+	block := off / v.blockSize
+	if block >= int64(len(v.bat)) || v.bat[block] == vhdUnallocated {
+		return readBacking(v.parent, p, off)
+	}
+	dataOffset := int64(v.bat[block])*vhdSectorSize + v.bitmapSize
+	inBlock := off % v.blockSize
+
+	// 动态镜像直接读取块数据，差分镜像按扇区位图决定来自本镜像还是父镜像
+	if v.diskType == vhdTypeDynamic {
+		_, err := v.f.ReadAt(p, dataOffset+inBlock)
+		return err
+	}
+
+	bm, err := v.bitmap(block)
+	if err != nil {
+		return err
+	}
+	for done := int64(0); done < int64(len(p)); {
+		pos := inBlock + done
+		sector := pos / vhdSectorSize
+		n := min(vhdSectorSize-pos%vhdSectorSize, int64(len(p))-done)
+		chunk := p[done : done+n]
+		if bm[sector/8]&(0x80>>(sector%8)) != 0 {
+			if _, err := v.f.ReadAt(chunk, dataOffset+pos); err != nil {
+				return err
+			}
+		} else if err := readBacking(v.parent, chunk, off+done); err != nil {
+			return err
+		}
+		done += n
+	}
+	return nil
+}
+
+func (v *VHDImage) ReadAt(p []byte, off int64) (int, error) {
+	if v.diskType == vhdTypeFixed {
+		return readImage(p, off, v.size, v.size, func(p []byte, off int64) error {
+			_, err := v.f.ReadAt(p, off)
+			return err
+		})
+	}
+	return readImage(p, off, v.size, v.blockSize, v.readBlock)
+}
+
+func (v *VHDImage) WriteAt(p []byte, off int64) (int, error) { return 0, ErrReadOnly }
+func (v *VHDImage) Size() (int64, error)                     { return v.size, nil }
+func (v *VHDImage) Sync() error                              { return nil }
+func (v *VHDImage) Format() string                           { return FormatVHD }
+
+func (v *VHDImage) Close() error {
+	if v.parent != nil {
+		v.parent.Close()
+	}
+	return v.f.Close()
+}
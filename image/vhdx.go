@@ -0,0 +1,242 @@
+package image
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"strings"
+)
+
+// VHDX 格式定义，参见 [MS-VHDX] Virtual Hard Disk v2 (VHDX) File Format
+
+const (
+	vhdxHeader1Offset = 64 << 10
+	vhdxHeader2Offset = 128 << 10
+	vhdxRegion1Offset = 192 << 10
+	vhdxHeaderSize    = 4 << 10
+	vhdxRegionSize    = 64 << 10
+
+	vhdxHeaderSignature   = 0x64616568 // "head"
+	vhdxRegionSignature   = 0x69676572 // "regi"
+	vhdxMetadataSignature = "metadata"
+
+	vhdxBlockNotPresent    = 0
+	vhdxBlockUndefined     = 1
+	vhdxBlockZero          = 2
+	vhdxBlockUnmapped      = 3
+	vhdxBlockFullyPresent  = 6
+	vhdxBlockPartlyPresent = 7
+
+	vhdxFileParametersHasParent = 1 << 1
+
+	vhdxMinBlockSize = 1 << 20
+	vhdxMaxBlockSize = 256 << 20
+	vhdxMaxSize      = 64 << 40 // 规范允许的最大虚拟磁盘大小
+)
+
+var (
+	vhdxBATRegion       = vhdxGUID("2DC27766-F623-4200-9D64-115E9BFD4A08")
+	vhdxMetadataRegion  = vhdxGUID("8B7CA206-4790-4B9A-B8FE-575F050F886E")
+	vhdxFileParameters  = vhdxGUID("CAA16737-FA36-4D43-B3B6-33F0AA44E76B")
+	vhdxVirtualDiskSize = vhdxGUID("2FA54224-CD1B-4876-B211-5DBED83BF4B8")
+	vhdxLogicalSector   = vhdxGUID("8141BF1D-A96F-4709-BA47-F233A8FAAB5F")
+
+	crc32c = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// vhdxGUID 把 GUID 字符串转换为磁盘上的字节序（前三段为小端）
+func vhdxGUID(s string) [16]byte {
+	raw, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(raw) != 16 {
+		panic("invalid GUID " + s)
+	}
+	var g [16]byte
+	binary.LittleEndian.PutUint32(g[0:], binary.BigEndian.Uint32(raw[0:]))
+	binary.LittleEndian.PutUint16(g[4:], binary.BigEndian.Uint16(raw[4:]))
+	binary.LittleEndian.PutUint16(g[6:], binary.BigEndian.Uint16(raw[6:]))
+	copy(g[8:], raw[8:])
+	return g
+}
+
+// vhdxChecksumValid 校验结构的 CRC-32C，校验时把位于偏移 4 的校验和字段视为零
+func vhdxChecksumValid(data []byte) bool {
+	expected := binary.LittleEndian.Uint32(data[4:])
+	buf := make([]byte, len(data))
+	copy(buf, data)
+	binary.LittleEndian.PutUint32(buf[4:], 0)
+	return crc32.Checksum(buf, crc32c) == expected
+}
+
+// VHDXImage 是 VHDX 镜像（固定和动态）的只读后端
+type VHDXImage struct {
+	f          *os.File
+	size       int64
+	blockSize  int64
+	chunkRatio int64
+	bat        []uint64
+}
+
+// OpenVHDX 打开 VHDX 镜像，不支持差分镜像和需要重放日志的镜像
+func OpenVHDX(path string) (*VHDXImage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	img, err := openVHDX(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return img, nil
+}
+
+func openVHDX(f *os.File) (*VHDXImage, error) {
+	ident := make([]byte, 8)
+	if _, err := f.ReadAt(ident, 0); err != nil || string(ident) != "vhdxfile" {
+		return nil, fmt.Errorf("not a VHDX image")
+	}
+
+	// 两份头部中选择校验和正确且序列号更大的一份
+	var current []byte
+	var sequence uint64
+	for _, offset := range []int64{vhdxHeader1Offset, vhdxHeader2Offset} {
+		h := make([]byte, vhdxHeaderSize)
+		if _, err := f.ReadAt(h, offset); err != nil {
+			continue
+		}
+		if binary.LittleEndian.Uint32(h) != vhdxHeaderSignature || !vhdxChecksumValid(h) {
+			continue
+		}
+		if seq := binary.LittleEndian.Uint64(h[8:]); current == nil || seq > sequence {
+			current, sequence = h, seq
+		}
+	}
+	if current == nil {
+		return nil, fmt.Errorf("no valid VHDX header found")
+	}
+	var emptyGUID [16]byte
+	if [16]byte(current[48:64]) != emptyGUID {
+		return nil, fmt.Errorf("VHDX log must be replayed first, attach the image once in Hyper-V or run qemu-img check -r all")
+	}
+
+	// 区域表
+	regions := make([]byte, vhdxRegionSize)
+	if _, err := f.ReadAt(regions, vhdxRegion1Offset); err != nil {
+		return nil, fmt.Errorf("failed to read region table: %v", err)
+	}
+	if binary.LittleEndian.Uint32(regions) != vhdxRegionSignature || !vhdxChecksumValid(regions) {
+		if _, err := f.ReadAt(regions, vhdxRegion1Offset+vhdxRegionSize); err != nil {
+			return nil, fmt.Errorf("failed to read region table: %v", err)
+		}
+		if binary.LittleEndian.Uint32(regions) != vhdxRegionSignature || !vhdxChecksumValid(regions) {
+			return nil, fmt.Errorf("no valid VHDX region table found")
+		}
+	}
+	var batOffset, metaOffset int64
+	var batLength int64
+	count := binary.LittleEndian.Uint32(regions[8:])
+	for i := uint32(0); i < count && 16+int(i+1)*32 <= len(regions); i++ {
+		entry := regions[16+i*32:]
+		switch [16]byte(entry[:16]) {
+		case vhdxBATRegion:
+			batOffset = int64(binary.LittleEndian.Uint64(entry[16:]))
+			batLength = int64(binary.LittleEndian.Uint32(entry[24:]))
+		case vhdxMetadataRegion:
+			metaOffset = int64(binary.LittleEndian.Uint64(entry[16:]))
+		}
+	}
+	if batOffset == 0 || metaOffset == 0 {
+		return nil, fmt.Errorf("BAT or metadata region missing")
+	}
+
+	// 元数据
+	img := &VHDXImage{f: f}
+	metaTable := make([]byte, vhdxRegionSize)
+	if _, err := f.ReadAt(metaTable, metaOffset); err != nil {
+		return nil, fmt.Errorf("failed to read metadata table: %v", err)
+	}
+	if string(metaTable[:8]) != vhdxMetadataSignature {
+		return nil, fmt.Errorf("invalid metadata table")
+	}
+	var logicalSectorSize int64
+	entries := binary.LittleEndian.Uint16(metaTable[10:])
+	for i := 0; i < int(entries) && 32+(i+1)*32 <= len(metaTable); i++ {
+		entry := metaTable[32+i*32:]
+		itemOffset := metaOffset + int64(binary.LittleEndian.Uint32(entry[16:]))
+		item := make([]byte, 8)
+		if _, err := f.ReadAt(item, itemOffset); err != nil {
+			return nil, fmt.Errorf("failed to read metadata item: %v", err)
+		}
+		switch [16]byte(entry[:16]) {
+		case vhdxFileParameters:
+			img.blockSize = int64(binary.LittleEndian.Uint32(item))
+			if binary.LittleEndian.Uint32(item[4:])&vhdxFileParametersHasParent != 0 {
+				return nil, fmt.Errorf("differencing VHDX images are not supported")
+			}
+		case vhdxVirtualDiskSize:
+			img.size = int64(binary.LittleEndian.Uint64(item))
+		case vhdxLogicalSector:
+			logicalSectorSize = int64(binary.LittleEndian.Uint32(item))
+		}
+	}
+	if img.blockSize == 0 || img.size == 0 || logicalSectorSize == 0 {
+		return nil, fmt.Errorf("required metadata items missing")
+	}
+	// 规范要求块大小为 1MiB 到 256MiB 之间的 2 的幂，逻辑扇区为 512 或 4096 字节
+	if img.blockSize < vhdxMinBlockSize || img.blockSize > vhdxMaxBlockSize || img.blockSize&(img.blockSize-1) != 0 {
+		return nil, fmt.Errorf("invalid block size %d", img.blockSize)
+	}
+	if logicalSectorSize != 512 && logicalSectorSize != 4096 {
+		return nil, fmt.Errorf("invalid logical sector size %d", logicalSectorSize)
+	}
+	if img.size < 0 || img.size > vhdxMaxSize {
+		return nil, fmt.Errorf("invalid virtual disk size %d", img.size)
+	}
+	img.chunkRatio = (int64(1) << 23) * logicalSectorSize / img.blockSize
+
+	// 块分配表，每 chunkRatio 个数据块之后穿插一个扇区位图项
+	dataBlocks := (img.size + img.blockSize - 1) / img.blockSize
+	total := dataBlocks + (dataBlocks-1)/img.chunkRatio
+	if total*8 > batLength {
+		return nil, fmt.Errorf("BAT region too small")
+	}
+	raw, err := readTable(f, batOffset, total*8)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read BAT: %v", err)
+	}
+	img.bat = make([]uint64, total)
+	for i := range img.bat {
+		img.bat[i] = binary.LittleEndian.Uint64(raw[i*8:])
+	}
+	return img, nil
+}
+
+// readBlock 读取一个数据块内的数据，p 不会跨越块边界
+func (v *VHDXImage) readBlock(p []byte, off int64) error {
+	block := off / v.blockSize
+	entry := v.bat[block+block/v.chunkRatio]
+
+	switch entry & 7 {
+	case vhdxBlockFullyPresent:
+		fileOffset := int64(entry>>20) << 20
+		_, err := v.f.ReadAt(p, fileOffset+off%v.blockSize)
+		return err
+	case vhdxBlockNotPresent, vhdxBlockUndefined, vhdxBlockZero, vhdxBlockUnmapped:
+		clear(p)
+		return nil
+	default:
+		return fmt.Errorf("unsupported VHDX block state %d", entry&7)
+	}
+}
+
+func (v *VHDXImage) ReadAt(p []byte, off int64) (int, error) {
+	return readImage(p, off, v.size, v.blockSize, v.readBlock)
+}
+
+func (v *VHDXImage) WriteAt(p []byte, off int64) (int, error) { return 0, ErrReadOnly }
+func (v *VHDXImage) Size() (int64, error)                     { return v.size, nil }
+func (v *VHDXImage) Sync() error                              { return nil }
+func (v *VHDXImage) Format() string                           { return FormatVHDX }
+func (v *VHDXImage) Close() error                             { return v.f.Close() }
@@ -0,0 +1,475 @@
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// VMDK 格式定义，参见 VMware Virtual Disk Format 1.1
+
+const (
+	vmdkMagic      = 0x564d444b // "KDMV"
+	vmdkSectorSize = 512
+	vmdkHeaderSize = 512
+	vmdkGDAtEnd    = 0xffffffffffffffff
+
+	vmdkFlagZeroedGTE       = 1 << 2
+	vmdkFlagCompressed      = 1 << 16
+	vmdkCompressionDeflate  = 1
+	vmdkNoParentCID         = "ffffffff"
+	vmdkGrainTableCacheSize = 64
+
+	// 读取时对头部中各项大小的上限，防止构造的头部导致巨大的内存分配
+	vmdkMaxGrainSize      = 64 << 20
+	vmdkMaxGTEntries      = 512 // 与 qemu 相同
+	vmdkMaxDescriptorSize = 1 << 20
+)
+
+// vmdkExtent 是虚拟磁盘中的一段区域，由 sparse、flat 或 zero 区段提供数据
+type vmdkExtent struct {
+	start  int64 // 在虚拟磁盘中的起始偏移
+	size   int64
+	f      *os.File
+	offset int64 // flat 区段在文件中的起始偏移
+	sparse *vmdkSparse
+}
+
+// vmdkSparse 是 hosted sparse 区段的头部信息和粒度表
+type vmdkSparse struct {
+	f          *os.File
+	capacity   int64
+	grainSize  int64
+	gtEntries  int64
+	gd         []uint32
+	flags      uint32
+	compressed bool
+
+	gtCache    *lru.Cache // 粒度表扇区偏移 -> []uint32
+	grainCache *lru.Cache // 压缩粒度扇区偏移 -> 解压后的数据
+}
+
+// VMDKImage 是 VMDK 镜像的只读后端，支持 monolithicSparse、streamOptimized、
+// twoGbMaxExtent 和 monolithicFlat 等类型，以及通过 parentFileNameHint 指定的父镜像
+type VMDKImage struct {
+	size    int64
+	extents []vmdkExtent
+	files   []*os.File
+	parent  Image
+}
+
+// OpenVMDK 打开 VMDK 镜像，path 可以是描述符文件或带内嵌描述符的 sparse 文件
+func OpenVMDK(path string) (*VMDKImage, error) {
+	return openVMDKFile(path, imageChain{}, false)
+}
+
+func openVMDKFile(path string, parent imageChain, probed bool) (*VMDKImage, error) {
+	img := &VMDKImage{}
+	if err := img.open(path, parent, probed); err != nil {
+		img.Close()
+		return nil, imageError(path, err)
+	}
+	return img, nil
+}
+
+func (v *VMDKImage) openFile(path string) (*os.File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	v.files = append(v.files, f)
+	return f, nil
+}
+
+func (v *VMDKImage) open(path string, parent imageChain, probed bool) error {
+	f, err := v.openFile(path)
+	if err != nil {
+		return err
+	}
+	chain, err := parent.enter(f, probed)
+	if err != nil {
+		return err
+	}
+
+	var descriptor []byte
+	magic := make([]byte, 4)
+	if _, err := f.ReadAt(magic, 0); err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(magic) == vmdkMagic {
+		sparse, err := openVMDKSparse(f)
+		if err != nil {
+			return err
+		}
+		if descriptor, err = sparse.descriptor(); err != nil {
+			return err
+		}
+		// 没有内嵌描述符时把整个文件当作一个 sparse 区段
+		if descriptor == nil {
+			v.extents = []vmdkExtent{{size: sparse.capacity, f: f, sparse: sparse}}
+			v.size = sparse.capacity
+			return nil
+		}
+	} else {
+		if descriptor, err = io.ReadAll(io.NewSectionReader(f, 0, 1<<20)); err != nil {
+			return err
+		}
+	}
+
+	return v.parseDescriptor(path, f, descriptor, chain)
+}
+
+// parseDescriptor 解析描述符中的区段和父镜像信息
+func (v *VMDKImage) parseDescriptor(path string, self *os.File, descriptor []byte, chain imageChain) error {
+	dir := filepath.Dir(path)
+	parentCID := vmdkNoParentCID
+	parentHint := ""
+
+	scanner := bufio.NewScanner(bytes.NewReader(bytes.TrimRight(descriptor, "\x00")))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if key, value, ok := strings.Cut(line, "="); ok && !strings.ContainsAny(key, "\"") {
+			value = strings.Trim(strings.TrimSpace(value), "\"")
+			switch strings.TrimSpace(key) {
+			case "parentCID":
+				parentCID = strings.ToLower(value)
+			case "parentFileNameHint":
+				parentHint = value
+			}
+			continue
+		}
+
+		// 区段行: RW <扇区数> <类型> ["文件名" [偏移]]
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return fmt.Errorf("invalid descriptor line %q", line)
+		}
+		sectors, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid extent size in %q", line)
+		}
+		extent := vmdkExtent{start: v.size, size: sectors * vmdkSectorSize}
+		kind := fields[2]
+
+		if kind != "ZERO" {
+			_, rest, _ := strings.Cut(line, "\"")
+			name, rest, ok := strings.Cut(rest, "\"")
+			if !ok {
+				return fmt.Errorf("extent file name missing in %q", line)
+			}
+			extentPath := name
+			if !filepath.IsAbs(extentPath) {
+				extentPath = filepath.Join(dir, extentPath)
+			}
+			if offset := strings.TrimSpace(rest); offset != "" {
+				sectors, err := strconv.ParseInt(offset, 10, 64)
+				if err != nil {
+					return fmt.Errorf("invalid extent offset in %q", line)
+				}
+				extent.offset = sectors * vmdkSectorSize
+			}
+
+			if same, err := sameImageFile(self, extentPath); err != nil {
+				return err
+			} else if same {
+				extent.f = self
+			} else if err := chain.checkReference("extent file", extentPath); err != nil {
+				return err
+			} else if extent.f, err = v.openFile(extentPath); err != nil {
+				return err
+			}
+		}
+
+		switch kind {
+		case "SPARSE":
+			if extent.sparse, err = openVMDKSparse(extent.f); err != nil {
+				return fmt.Errorf("extent %s: %v", extent.f.Name(), err)
+			}
+		case "FLAT", "VMFS", "ZERO":
+		default:
+			return fmt.Errorf("unsupported extent type %s", kind)
+		}
+		v.extents = append(v.extents, extent)
+		v.size += extent.size
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(v.extents) == 0 {
+		return fmt.Errorf("no extents in descriptor")
+	}
+
+	if parentCID != vmdkNoParentCID {
+		if parentHint == "" {
+			return fmt.Errorf("parent image hint missing")
+		}
+		parentPath := parentHint
+		if !filepath.IsAbs(parentPath) {
+			parentPath = filepath.Join(dir, parentPath)
+		}
+		var err error
+		if v.parent, err = chain.openBacking("parent image", parentPath, FormatVMDK); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sameImageFile 判断 path 是否与已打开的文件是同一个文件
+func sameImageFile(f *os.File, path string) (bool, error) {
+	a, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	b, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(a, b), nil
+}
+
+// openVMDKSparse 读取 sparse 区段的头部和粒度目录
+func openVMDKSparse(f *os.File) (*vmdkSparse, error) {
+	header := make([]byte, vmdkHeaderSize)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(header) != vmdkMagic {
+		return nil, fmt.Errorf("not a VMDK sparse extent")
+	}
+
+	// streamOptimized 镜像的粒度目录位置记录在文件末尾的页脚中
+	if binary.LittleEndian.Uint64(header[56:]) == vmdkGDAtEnd {
+		size, err := f.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, err
+		}
+		if size < 3*vmdkSectorSize {
+			return nil, fmt.Errorf("VMDK footer missing")
+		}
+		if _, err := f.ReadAt(header, size-2*vmdkSectorSize); err != nil {
+			return nil, err
+		}
+		if binary.LittleEndian.Uint32(header) != vmdkMagic {
+			return nil, fmt.Errorf("invalid VMDK footer")
+		}
+	}
+
+	s := &vmdkSparse{
+		f:         f,
+		flags:     binary.LittleEndian.Uint32(header[8:]),
+		capacity:  int64(binary.LittleEndian.Uint64(header[12:])) * vmdkSectorSize,
+		grainSize: int64(binary.LittleEndian.Uint64(header[20:])) * vmdkSectorSize,
+		gtEntries: int64(binary.LittleEndian.Uint32(header[44:])),
+	}
+	if s.grainSize == 0 || s.grainSize > vmdkMaxGrainSize || s.gtEntries == 0 || s.gtEntries > vmdkMaxGTEntries {
+		return nil, fmt.Errorf("invalid grain size or grain table size")
+	}
+	if s.capacity < 0 {
+		return nil, fmt.Errorf("invalid capacity")
+	}
+	if s.flags&vmdkFlagCompressed != 0 {
+		if algorithm := binary.LittleEndian.Uint16(header[77:]); algorithm != vmdkCompressionDeflate {
+			return nil, fmt.Errorf("unsupported compression algorithm %d", algorithm)
+		}
+		s.compressed = true
+	}
+
+	gdOffset := int64(binary.LittleEndian.Uint64(header[56:])) * vmdkSectorSize
+	grains := (s.capacity + s.grainSize - 1) / s.grainSize
+	raw, err := readTable(f, gdOffset, (grains+s.gtEntries-1)/s.gtEntries*4)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read grain directory: %v", err)
+	}
+	s.gd = make([]uint32, len(raw)/4)
+	for i := range s.gd {
+		s.gd[i] = binary.LittleEndian.Uint32(raw[i*4:])
+	}
+
+	s.gtCache, _ = lru.New(vmdkGrainTableCacheSize)
+	s.grainCache, _ = lru.New(vmdkGrainTableCacheSize)
+	return s, nil
+}
+
+// descriptor 返回内嵌的描述符，没有内嵌描述符时返回 nil
+func (s *vmdkSparse) descriptor() ([]byte, error) {
+	header := make([]byte, vmdkHeaderSize)
+	if _, err := s.f.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	offset := int64(binary.LittleEndian.Uint64(header[28:]))
+	size := int64(binary.LittleEndian.Uint64(header[36:]))
+	if offset == 0 || size == 0 {
+		return nil, nil
+	}
+	if size > vmdkMaxDescriptorSize/vmdkSectorSize {
+		return nil, fmt.Errorf("embedded descriptor too large: %d sectors", size)
+	}
+	data, err := readTable(s.f, offset*vmdkSectorSize, size*vmdkSectorSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read embedded descriptor: %v", err)
+	}
+	return data, nil
+}
+
+// grainTable 读取并缓存一个粒度表
+func (s *vmdkSparse) grainTable(sector uint32) ([]uint32, error) {
+	if table, ok := s.gtCache.Get(sector); ok {
+		return table.([]uint32), nil
+	}
+	raw := make([]byte, s.gtEntries*4)
+	if _, err := s.f.ReadAt(raw, int64(sector)*vmdkSectorSize); err != nil {
+		return nil, fmt.Errorf("failed to read grain table at sector %d: %v", sector, err)
+	}
+	table := make([]uint32, s.gtEntries)
+	for i := range table {
+		table[i] = binary.LittleEndian.Uint32(raw[i*4:])
+	}
+	s.gtCache.Add(sector, table)
+	return table, nil
+}
+
+// compressedGrain 读取并解压一个压缩粒度，粒度前面是 LBA 和压缩长度组成的标记
+func (s *vmdkSparse) compressedGrain(sector uint32) ([]byte, error) {
+	if data, ok := s.grainCache.Get(sector); ok {
+		return data.([]byte), nil
+	}
+	marker := make([]byte, 12)
+	if _, err := s.f.ReadAt(marker, int64(sector)*vmdkSectorSize); err != nil {
+		return nil, err
+	}
+	// 压缩后的数据最多比粒度略大，超出许多说明标记已损坏
+	size := int64(binary.LittleEndian.Uint32(marker[8:]))
+	if size > 2*s.grainSize {
+		return nil, fmt.Errorf("invalid compressed grain size %d at sector %d", size, sector)
+	}
+	compressed := make([]byte, size)
+	if _, err := s.f.ReadAt(compressed, int64(sector)*vmdkSectorSize+12); err != nil {
+		return nil, err
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress grain at sector %d: %v", sector, err)
+	}
+	data := make([]byte, s.grainSize)
+	if _, err := io.ReadFull(zr, data); err != nil && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("failed to decompress grain at sector %d: %v", sector, err)
+	}
+	s.grainCache.Add(sector, data)
+	return data, nil
+}
+
+// readGrain 读取一个粒度内的数据，p 不会跨越粒度边界
+// 未分配的粒度返回 false，由调用者从父镜像读取
+func (s *vmdkSparse) readGrain(p []byte, off int64) (bool, error) {
+	grain := off / s.grainSize
+	gdIndex := grain / s.gtEntries
+	if gdIndex >= int64(len(s.gd)) || s.gd[gdIndex] == 0 {
+		return false, nil
+	}
+	table, err := s.grainTable(s.gd[gdIndex])
+	if err != nil {
+		return false, err
+	}
+	gte := table[grain%s.gtEntries]
+	inGrain := off % s.grainSize
+
+	switch {
+	case gte == 0:
+		return false, nil
+	case gte == 1 && (s.flags&vmdkFlagZeroedGTE != 0 || s.compressed):
+		clear(p)
+	case s.compressed:
+		data, err := s.compressedGrain(gte)
+		if err != nil {
+			return false, err
+		}
+		copy(p, data[inGrain:])
+	default:
+		if _, err := s.f.ReadAt(p, int64(gte)*vmdkSectorSize+inGrain); err != nil {
+			return false, fmt.Errorf("failed to read grain data: %v", err)
+		}
+	}
+	return true, nil
+}
+
+// readExtent 读取一个区段内的数据，p 不会跨越区段边界
+func (v *VMDKImage) readExtent(e *vmdkExtent, p []byte, off int64) error {
+	inExtent := off - e.start
+	switch {
+	case e.sparse != nil:
+		return readSparse(e.sparse, p, inExtent, func(p []byte, pos int64) error {
+			return readBacking(v.parent, p, e.start+pos)
+		})
+	case e.f == nil:
+		clear(p)
+		return nil
+	default:
+		_, err := e.f.ReadAt(p, e.offset+inExtent)
+		return err
+	}
+}
+
+// readSparse 按粒度读取 sparse 区段，未分配的粒度交给 fallback 读取
+func readSparse(s *vmdkSparse, p []byte, off int64, fallback func(p []byte, off int64) error) error {
+	for done := int64(0); done < int64(len(p)); {
+		pos := off + done
+		n := min(s.grainSize-pos%s.grainSize, int64(len(p))-done)
+		chunk := p[done : done+n]
+		if pos >= s.capacity {
+			clear(chunk)
+		} else if ok, err := s.readGrain(chunk, pos); err != nil {
+			return err
+		} else if !ok {
+			if err := fallback(chunk, pos); err != nil {
+				return err
+			}
+		}
+		done += n
+	}
+	return nil
+}
+
+func (v *VMDKImage) ReadAt(p []byte, off int64) (int, error) {
+	return readImage(p, off, v.size, v.size, func(p []byte, off int64) error {
+		for i := range v.extents {
+			e := &v.extents[i]
+			if off >= e.start+e.size || off+int64(len(p)) <= e.start {
+				continue
+			}
+			from := max(off, e.start)
+			to := min(off+int64(len(p)), e.start+e.size)
+			if err := v.readExtent(e, p[from-off:to-off], from); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (v *VMDKImage) WriteAt(p []byte, off int64) (int, error) { return 0, ErrReadOnly }
+func (v *VMDKImage) Size() (int64, error)                     { return v.size, nil }
+func (v *VMDKImage) Sync() error                              { return nil }
+func (v *VMDKImage) Format() string                           { return FormatVMDK }
+
+func (v *VMDKImage) Close() error {
+	if v.parent != nil {
+		v.parent.Close()
+	}
+	for _, f := range v.files {
+		f.Close()
+	}
+	return nil
+}
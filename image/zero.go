@@ -0,0 +1,26 @@
+package image
+
+import (
+	nbdbackend "nbd/backend"
+)
+
+// FormatZero 是没有基础设备的空白磁盘，所有数据都来自扇区目录
+const FormatZero = "zero"
+
+// zeroImage 把全零后端包装为只读镜像
+type zeroImage struct {
+	*nbdbackend.ZeroBackend
+}
+
+// NewZero 返回一个大小为 size 的全零镜像，供离线命令读取空白磁盘的扇区目录
+func NewZero(size int64) Image {
+	return zeroImage{nbdbackend.NewZeroBackend(size)}
+}
+
+func (zeroImage) Format() string {
+	return FormatZero
+}
+
+func (zeroImage) Close() error {
+	return nil
+}
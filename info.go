@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	nbdbackend "nbd/backend"
+)
+
+// InfoExtent 是一段连续的脏扇区
+type InfoExtent struct {
+	Offset  int64 `json:"offset"`
+	Length  int64 `json:"length"`
+	Sectors int64 `json:"sectors"`
+}
+
+// InfoBucket 是直方图中的一个区域
+type InfoBucket struct {
+	Offset       int64 `json:"offset"`
+	Length       int64 `json:"length"`
+	DirtySectors int64 `json:"dirty_sectors"`
+	DirtyBytes   int64 `json:"dirty_bytes"`
+}
+
+// OverlayInfo 汇总扇区目录的状态
+type OverlayInfo struct {
+	SectorDir    string                  `json:"sector_dir"`
+	SectorSize   int64                   `json:"sector_size"`
+	Base         *nbdbackend.Fingerprint `json:"base,omitempty"`
+	VirtualSize  int64                   `json:"virtual_size"`
+	DirtySectors int64                   `json:"dirty_sectors"`
+	LogicalBytes int64                   `json:"logical_bytes"` // 脏扇区覆盖的虚拟磁盘字节数
+	UsedBytes    int64                   `json:"used_bytes"`    // 扇区文件实际占用的磁盘空间
+	Extents      []InfoExtent            `json:"extents"`
+	Histogram    []InfoBucket            `json:"histogram"`
+	Invalid      []string                `json:"invalid"`       // 无法解析的扇区文件名
+	Misplaced    []string                `json:"misplaced"`     // 文件名合法但不在四级目录中应在的位置，读取时不会被使用
+	SizeMismatch []string                `json:"size_mismatch"` // 文件大小既不是扇区大小也不是带校验尾部的扇区大小
+	OtherFiles   []string                `json:"other_files"`   // 扇区文件和元数据以外的文件，例如中断写入遗留的临时文件
+}
+
+// collectOverlayInfo 遍历扇区目录，统计脏扇区并找出异常文件
+func collectOverlayInfo(sectorDir string, buckets int) (*OverlayInfo, error) {
+	meta, err := nbdbackend.LoadMetadata(sectorDir)
+	if err != nil {
+		return nil, err
+	}
+	info := &OverlayInfo{
+		SectorDir:    sectorDir,
+		Invalid:      []string{},
+		Misplaced:    []string{},
+		SizeMismatch: []string{},
+		OtherFiles:   []string{},
+	}
+	if meta != nil {
+		info.SectorSize = meta.SectorSize
+		info.Base = meta.Base
+		if meta.Base != nil {
+			info.VirtualSize = meta.Base.Size
+		}
+		info.VirtualSize = max(info.VirtualSize, meta.Size)
+	}
+
+	var sectors []SectorInfo
+	err = filepath.Walk(sectorDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			info.UsedBytes += st.Blocks * 512
+		}
+
+		rel, _ := filepath.Rel(sectorDir, path)
+		if filepath.Ext(path) != ".sector" {
+			if !nbdbackend.IsControlFile(rel) {
+				info.OtherFiles = append(info.OtherFiles, rel)
+			}
+			return nil
+		}
+
+		sector, size, err := parseSectorName(filepath.Base(path))
+		if err != nil {
+			info.Invalid = append(info.Invalid, rel)
+			return nil
+		}
+		if path != nbdbackend.SectorPath(sectorDir, sector, size) {
+			info.Misplaced = append(info.Misplaced, rel)
+			return nil
+		}
+		if fi.Size() != size && fi.Size() != size+nbdbackend.ChecksumTrailerSize {
+			info.SizeMismatch = append(info.SizeMismatch, rel)
+		}
+		sectors = append(sectors, SectorInfo{Path: path, Offset: sector, Size: size})
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to scan sector files: %v", err)
+	}
+
+	sortSectors(sectors)
+	if info.SectorSize == 0 && len(sectors) > 0 {
+		info.SectorSize = sectors[0].Size
+	}
+
+	// 合并相邻扇区为连续区段
+	for _, s := range sectors {
+		offset := s.Offset * s.Size
+		info.DirtySectors++
+		info.LogicalBytes += s.Size
+		if n := len(info.Extents); n > 0 && info.Extents[n-1].Offset+info.Extents[n-1].Length == offset {
+			info.Extents[n-1].Length += s.Size
+			info.Extents[n-1].Sectors++
+		} else if n == 0 || info.Extents[n-1].Offset+info.Extents[n-1].Length < offset {
+			info.Extents = append(info.Extents, InfoExtent{Offset: offset, Length: s.Size, Sectors: 1})
+		}
+		info.VirtualSize = max(info.VirtualSize, offset+s.Size)
+	}
+	if info.Extents == nil {
+		info.Extents = []InfoExtent{}
+	}
+
+	// 按虚拟磁盘区域统计脏扇区分布
+	info.Histogram = []InfoBucket{}
+	if buckets > 0 && info.VirtualSize > 0 {
+		length := (info.VirtualSize + int64(buckets) - 1) / int64(buckets)
+		if info.SectorSize > 0 {
+			length = (length + info.SectorSize - 1) / info.SectorSize * info.SectorSize
+		}
+		for off := int64(0); off < info.VirtualSize; off += length {
+			info.Histogram = append(info.Histogram, InfoBucket{Offset: off, Length: min(length, info.VirtualSize-off)})
+		}
+		for _, s := range sectors {
+			b := &info.Histogram[min(s.Offset*s.Size/length, int64(len(info.Histogram)-1))]
+			b.DirtySectors++
+			b.DirtyBytes += s.Size
+		}
+	}
+
+	sort.Strings(info.Invalid)
+	sort.Strings(info.Misplaced)
+	sort.Strings(info.SizeMismatch)
+	sort.Strings(info.OtherFiles)
+	return info, nil
+}
+
+// formatBytes 以二进制单位格式化字节数
+func formatBytes(n int64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	v := float64(n)
+	i := -1
+	for v >= 1024 && i < len(units)-1 {
+		v /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %ciB", v, units[i])
+}
+
+// parseSize 解析字节数，支持 K、M、G、T 后缀（按 1024 进位，可写作 G 或 GiB）
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	number := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(s), "IB"), "B")
+	shift := 0
+	if n := len(number); n > 0 {
+		if i := strings.IndexByte("KMGT", number[n-1]); i >= 0 {
+			shift = 10 * (i + 1)
+			number = number[:n-1]
+		}
+	}
+	v, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || v < 0 || v > math.MaxInt64>>shift {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return v << shift, nil
+}
+
+// printOverlayInfo 以文本形式输出扇区目录的状态
+func printOverlayInfo(w io.Writer, info *OverlayInfo, maxList int) {
+	fmt.Fprintf(w, "Sector directory: %s\n", info.SectorDir)
+	fmt.Fprintf(w, "Sector size:      %d\n", info.SectorSize)
+	if info.Base != nil {
+		fmt.Fprintf(w, "Base device:      %s (%s)\n", info.Base.Path, formatBytes(info.Base.Size))
+	} else {
+		fmt.Fprintf(w, "Base device:      unknown (no %s)\n", nbdbackend.MetadataFile)
+	}
+	fmt.Fprintf(w, "Dirty sectors:    %d\n", info.DirtySectors)
+	ratio := 0.0
+	if info.VirtualSize > 0 {
+		ratio = float64(info.LogicalBytes) * 100 / float64(info.VirtualSize)
+	}
+	fmt.Fprintf(w, "Logical bytes:    %s (%.2f%% of %s)\n", formatBytes(info.LogicalBytes), ratio, formatBytes(info.VirtualSize))
+	fmt.Fprintf(w, "Used on disk:     %s\n", formatBytes(info.UsedBytes))
+
+	fmt.Fprintf(w, "\nDirty extents: %d\n", len(info.Extents))
+	for i, e := range info.Extents {
+		if maxList > 0 && i >= maxList {
+			fmt.Fprintf(w, "  ... %d more (use -json for the full list)\n", len(info.Extents)-i)
+			break
+		}
+		fmt.Fprintf(w, "  0x%012x - 0x%012x  %10s  %d sectors\n", e.Offset, e.Offset+e.Length, formatBytes(e.Length), e.Sectors)
+	}
+
+	if len(info.Histogram) > 0 {
+		fmt.Fprintln(w, "\nDistribution:")
+		const width = 40
+		for _, b := range info.Histogram {
+			bar := int((b.DirtyBytes*width + b.Length - 1) / b.Length)
+			fmt.Fprintf(w, "  0x%012x  %-*s  %5.1f%%  %s\n", b.Offset, width, strings.Repeat("#", min(bar, width)),
+				float64(b.DirtyBytes)*100/float64(b.Length), formatBytes(b.DirtyBytes))
+		}
+	}
+
+	problems := []struct {
+		title string
+		files []string
+	}{
+		{"Invalid sector file names", info.Invalid},
+		{"Misplaced sector files (ignored by the server)", info.Misplaced},
+		{"Sector files with wrong size", info.SizeMismatch},
+		{"Other files", info.OtherFiles},
+	}
+	for _, p := range problems {
+		if len(p.files) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\n%s: %d\n", p.title, len(p.files))
+		for i, f := range p.files {
+			if maxList > 0 && i >= maxList {
+				fmt.Fprintf(w, "  ... %d more\n", len(p.files)-i)
+				break
+			}
+			fmt.Fprintf(w, "  %s\n", f)
+		}
+	}
+}
+
+// showOverlayInfo 实现 info 命令
+func showOverlayInfo(sectorDir string, jsonOutput bool, buckets, maxList int) error {
+	if _, err := os.Stat(sectorDir); err != nil {
+		return fmt.Errorf("sector directory: %v", err)
+	}
+	info, err := collectOverlayInfo(sectorDir, buckets)
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(info)
+	}
+	printOverlayInfo(os.Stdout, info, maxList)
+	return nil
+}
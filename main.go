@@ -5,17 +5,43 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
+// splitList 把逗号分隔的列表拆分为切片，忽略空项
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func main() {
 	if len(os.Args) < 2 {
 		fmt.Println("Usage:")
 		fmt.Println("  snap-nbd server [options]")
 		fmt.Println("  snap-nbd patch [options]")
+		fmt.Println("  snap-nbd unpatch [options]")
+		fmt.Println("  snap-nbd export-overlay [options]")
+		fmt.Println("  snap-nbd convert [options]")
+		fmt.Println("  snap-nbd info [options]")
+		fmt.Println("  snap-nbd fsck [options]")
+		fmt.Println("  snap-nbd merge [options]")
+		fmt.Println("  snap-nbd diff [options] <old-sector-dir> <new-sector-dir>")
+		fmt.Println("  snap-nbd send [options]")
+		fmt.Println("  snap-nbd receive [options]")
+		fmt.Println("  snap-nbd bench [options]")
 		fmt.Println("\nOptions:")
 		fmt.Println("  server:")
-		fmt.Println("    -device string                Block device or image file path (required)")
+		fmt.Println("    -device string                Block device or image file path (omit with -size for a blank disk)")
+		fmt.Println("    -device-format string         Base image format: raw, qcow2, vhd, vhdx, vmdk or auto (default raw)")
 		fmt.Println("    -sector-dir string            CopyOnWrite sector file directory (required)")
+		fmt.Println("    -lower-dirs string            Read-only lower sector directories, comma separated, oldest first")
 		fmt.Println("    -listen string                Listen address, format like :10809 (default :10809)")
 		fmt.Println("    -sector-size int              Sector size (must be a multiple of 512 and power of 2) (default 4096)")
 		fmt.Println("    -log string                   Log file path (optional, default to stderr)")
@@ -25,11 +51,113 @@ func main() {
 		fmt.Println("    -enable-prefetch              Enable prefetch cache")
 		fmt.Println("    -prefetch-multiplier int      Prefetch multiplier (relative to sector size) (default 16)")
 		fmt.Println("    -max-consecutive-reads int    Maximum consecutive reads before prefetch (default 4)")
+		fmt.Println("    -verify-policy string         On sector checksum failure: eio, fallback (to base data) or log (default eio)")
+		fmt.Println("    -scrub-interval duration      Verify all sector files periodically, e.g. 24h (default 0, disabled)")
+		fmt.Println("    -scrub-rate int               Maximum scrub read rate in bytes per second (default 0, unlimited)")
+		fmt.Println("    -size string                  Virtual disk size, e.g. 20G; may exceed the base, without -device serves a blank disk; can only grow (default base size)")
+		fmt.Println("    -admin-listen string          HTTP admin address for online resize, e.g. 127.0.0.1:10810 (default disabled)")
+		fmt.Println("    -direct                       Open the base device or raw file with O_DIRECT, bypassing the page cache")
+		fmt.Println("    -io-engine string             Base device I/O engine: pread or uring, falls back to pread if io_uring is unavailable (default pread)")
+		fmt.Println("    -exclusive                    Open a base block device with O_EXCL so it cannot be mounted while serving (default true)")
+		fmt.Println("    -base-check-interval duration Check the base for changes by other programs, 0 disables (default 10s)")
+		fmt.Println("    -on-base-change string        When the base changes: readonly (reject writes) or error (fail all I/O) (default readonly)")
+		fmt.Println("    -durability string            When overlay writes reach disk: strict (every write), batched (on flush/FUA) or unsafe (never) (default batched)")
 		fmt.Println("\n  patch:")
 		fmt.Println("    -sector-dir string            Sector file directory (required)")
 		fmt.Println("    -device string                Target block device or image file path (required)")
 		fmt.Println("    -device-offset int            Offset in the target device to start writing (in bytes)")
 		fmt.Println("    -dry-run                      Dry run mode (don't actually write to device)")
+		fmt.Println("    -undo-dir string              Directory to save original data for unpatch (default <sector-dir>.undo)")
+		fmt.Println("    -no-undo                      Don't save original data (the patch cannot be undone)")
+		fmt.Println("    -strict                       Abort on the first error")
+		fmt.Println("    -retries int                  Number of retries for each failed sector (default 0)")
+		fmt.Println("    -report string                Write a JSON report to this path")
+		fmt.Println("    -checkpoint string            Progress checkpoint file (default <sector-dir>.checkpoint)")
+		fmt.Println("    -resume                       Continue an interrupted patch from the checkpoint")
+		fmt.Println("    -workers int                  Number of concurrent writers (default 4)")
+		fmt.Println("    -max-write int                Maximum size of a merged write in bytes (default 8388608)")
+		fmt.Println("    -direct                       Open the target device with O_DIRECT")
+		fmt.Println("    -yes                          Don't ask for confirmation (requires -confirm-device)")
+		fmt.Println("    -confirm-device string        Restate the target device, must match -device")
+		fmt.Println("    -confirm-size int             Expected target size in bytes (optional)")
+		fmt.Println("    -confirm-id string            Expected target serial or WWID (optional)")
+		fmt.Println("    -json-progress                Write JSON progress events to stdout")
+		fmt.Println("    -force                        Ignore base fingerprint and sector size checks")
+		fmt.Println("\n  unpatch:")
+		fmt.Println("    -undo-dir string              Undo directory created by patch (required)")
+		fmt.Println("    -device string                Target block device or image file path (required)")
+		fmt.Println("    -device-offset int            Offset in the target device used by patch (in bytes)")
+		fmt.Println("    -dry-run                      Dry run mode (don't actually write to device)")
+		fmt.Println("    -strict                       Abort on the first error")
+		fmt.Println("    -retries int                  Number of retries for each failed sector (default 0)")
+		fmt.Println("    -report string                Write a JSON report to this path")
+		fmt.Println("    -checkpoint string            Progress checkpoint file (default <undo-dir>.checkpoint)")
+		fmt.Println("    -resume                       Continue an interrupted unpatch from the checkpoint")
+		fmt.Println("    -workers int                  Number of concurrent writers (default 4)")
+		fmt.Println("    -max-write int                Maximum size of a merged write in bytes (default 8388608)")
+		fmt.Println("    -direct                       Open the target device with O_DIRECT")
+		fmt.Println("    -yes                          Don't ask for confirmation (requires -confirm-device)")
+		fmt.Println("    -confirm-device string        Restate the target device, must match -device")
+		fmt.Println("    -confirm-size int             Expected target size in bytes (optional)")
+		fmt.Println("    -confirm-id string            Expected target serial or WWID (optional)")
+		fmt.Println("    -json-progress                Write JSON progress events to stdout")
+		fmt.Println("    -force                        Ignore base fingerprint and sector size checks")
+		fmt.Println("\n  export-overlay:")
+		fmt.Println("    -sector-dir string            Sector file directory (required)")
+		fmt.Println("    -output string                Output image path (required)")
+		fmt.Println("    -format string                Output format: qcow2 or raw (default qcow2)")
+		fmt.Println("    -backing string               Base device or image used as qcow2 backing file (default from metadata)")
+		fmt.Println("    -size int                     Virtual size in bytes (default size of the backing file)")
+		fmt.Println("\n  convert:")
+		fmt.Println("    -device string                Base device or image (default from sector directory metadata)")
+		fmt.Println("    -device-format string         Base image format: raw, qcow2, vhd, vhdx, vmdk or auto (default from metadata, else raw)")
+		fmt.Println("    -lower-dirs string            Lower sector directories, comma separated, oldest first (default from metadata)")
+		fmt.Println("    -sector-dir string            Sector file directory (optional, convert the base only if omitted)")
+		fmt.Println("    -output string                Output image path (required)")
+		fmt.Println("    -format string                Output format: qcow2 or raw (default raw)")
+		fmt.Println("    -cluster-size int             Read block size and qcow2 cluster size (default 65536)")
+		fmt.Println("    -compress                     Write compressed qcow2 clusters")
+		fmt.Println("    -checksum-file string         Write the SHA256 of the virtual disk in sha256sum format")
+		fmt.Println("    -verify                       Read back the output and compare checksums")
+		fmt.Println("\n  info:")
+		fmt.Println("    -sector-dir string            Sector file directory (required)")
+		fmt.Println("    -json                         Print the full report as JSON")
+		fmt.Println("    -buckets int                  Number of regions in the distribution histogram (default 16)")
+		fmt.Println("    -max-list int                 Maximum number of extents and files listed per section, 0 for all (default 20)")
+		fmt.Println("\n  fsck:")
+		fmt.Println("    -sector-dir string            Sector file directory (required)")
+		fmt.Println("    -repair                       Quarantine or fix the problems found (stop the server first)")
+		fmt.Println("    -quarantine-dir string        Directory for quarantined files (default <sector-dir>.quarantine)")
+		fmt.Println("    -json                         Print the report as JSON")
+		fmt.Println("\n  merge:")
+		fmt.Println("    -from string                  Sector directories to merge, comma separated, oldest first (required)")
+		fmt.Println("    -into string                  Target sector directory, usually the parent layer (required)")
+		fmt.Println("    -delete-source                Delete the merged directories afterwards")
+		fmt.Println("    -dry-run                      Only count the sector files that would be copied")
+		fmt.Println("    -force                        Skip invalid file names and ignore base device mismatches")
+		fmt.Println("\n  diff:")
+		fmt.Println("    -device string                Base device, used to compare sectors stored on one side only (default from metadata)")
+		fmt.Println("    -device-format string         Base image format: raw, qcow2, vhd, vhdx, vmdk or auto (default from metadata, else raw)")
+		fmt.Println("    -output-dir string            Write the changed sectors as a new overlay, applicable with patch")
+		fmt.Println("    -json                         Print the changed extents as JSON")
+		fmt.Println("\n  send:")
+		fmt.Println("    -sector-dir string            Sector directory to send, including its lower layers (required)")
+		fmt.Println("    -from string                  Older snapshot, send only the changes since it")
+		fmt.Println("    -device string                Base device, needed for sectors reverted since -from (default from metadata)")
+		fmt.Println("    -device-format string         Base image format: raw, qcow2, vhd, vhdx, vmdk or auto (default from metadata, else raw)")
+		fmt.Println("    -output string                Output file (default stdout)")
+		fmt.Println("\n  receive:")
+		fmt.Println("    -sector-dir string            Sector directory to create, must not exist or be empty (required)")
+		fmt.Println("    -input string                 Input file (default stdin)")
+		fmt.Println("    -lower string                 Previously received sector directory an incremental stream builds on")
+		fmt.Println("\n  bench:")
+		fmt.Println("    -device string                Block device or raw file to benchmark (required)")
+		fmt.Println("    -engine string                I/O engine: pread, uring or both (default both)")
+		fmt.Println("    -block-size int               Request size in bytes (default 4096)")
+		fmt.Println("    -concurrency int              Concurrent requests (default 16)")
+		fmt.Println("    -duration duration            Run time per engine (default 5s)")
+		fmt.Println("    -direct                       Open the device with O_DIRECT")
+		fmt.Println("    -write                        Write each block back after reading it (contents are unchanged)")
 		os.Exit(0)
 	}
 
@@ -39,8 +167,10 @@ func main() {
 	switch command {
 	case "server":
 		var (
-			device                  = flag.String("device", "", "Block device or image file path (required)")
+			device                  = flag.String("device", "", "Block device or image file path (omit with -size for a blank disk)")
+			deviceFormat            = flag.String("device-format", "raw", "Base image format: raw, qcow2, vhd, vhdx, vmdk or auto")
 			sectorDir               = flag.String("sector-dir", "", "CopyOnWrite sector file directory (required)")
+			lowerDirs               = flag.String("lower-dirs", "", "Read-only lower sector directories, comma separated, oldest first")
 			listenAddr              = flag.String("listen", ":10809", "Listen address, format like :10809")
 			sectorSize              = flag.Int64("sector-size", 4096, "Sector size (must be a multiple of 512 and power of 2)")
 			logFile                 = flag.String("log", "", "Log file path (optional, default to stderr)")
@@ -50,17 +180,33 @@ func main() {
 			enablePrefetch          = flag.Bool("enable-prefetch", false, "Enable prefetch cache")
 			prefetchMultiplier      = flag.Int("prefetch-multiplier", 16, "Prefetch multiplier (relative to sector size)")
 			maxConsecutiveReads     = flag.Int("max-consecutive-reads", 4, "Maximum consecutive reads before prefetch")
+			verifyPolicy            = flag.String("verify-policy", "eio", "On sector checksum failure: eio, fallback (to base data) or log")
+			scrubInterval           = flag.Duration("scrub-interval", 0, "Verify all sector files periodically, e.g. 24h (0 disables)")
+			scrubRate               = flag.Int64("scrub-rate", 0, "Maximum scrub read rate in bytes per second (0 for unlimited)")
+			size                    = flag.String("size", "", "Virtual disk size, e.g. 20G; may exceed the base, without -device serves a blank disk; can only grow")
+			adminListen             = flag.String("admin-listen", "", "HTTP admin address for online resize, e.g. 127.0.0.1:10810")
+			direct                  = flag.Bool("direct", false, "Open the base device or raw file with O_DIRECT, bypassing the page cache")
+			durability              = flag.String("durability", "batched", "When overlay writes reach disk: strict (every write), batched (on flush/FUA) or unsafe (never)")
+			ioEngine                = flag.String("io-engine", ioEnginePread, "Base device I/O engine: pread or uring, falls back to pread if io_uring is unavailable")
+			exclusive               = flag.Bool("exclusive", true, "Open a base block device with O_EXCL so it cannot be mounted while serving")
+			baseCheckInterval       = flag.Duration("base-check-interval", 10*time.Second, "Check the base for changes by other programs, 0 disables")
+			onBaseChange            = flag.String("on-base-change", "readonly", "When the base changes: readonly (reject writes) or error (fail all I/O)")
 		)
 		flag.Parse()
 
-		if *device == "" {
-			log.Fatal("Block device or image file path is required (-device)")
-		}
 		if *sectorDir == "" {
 			log.Fatal("Sector file directory is required (-sector-dir)")
 		}
 
-		if err := startServer(*device, *sectorDir, *listenAddr, *sectorSize, *logFile, *filterSize, *filterFalsePositiveRate, *cacheSize, *enablePrefetch, *prefetchMultiplier, *maxConsecutiveReads); err != nil {
+		var virtualSize int64
+		if *size != "" {
+			var err error
+			if virtualSize, err = parseSize(*size); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		if err := startServer(*device, *deviceFormat, splitList(*lowerDirs), *sectorDir, *listenAddr, *sectorSize, *logFile, *filterSize, *filterFalsePositiveRate, *cacheSize, *enablePrefetch, *prefetchMultiplier, *maxConsecutiveReads, *verifyPolicy, *scrubInterval, *scrubRate, *durability, virtualSize, *adminListen, *direct, *ioEngine, *exclusive, *baseCheckInterval, *onBaseChange); err != nil {
 			log.Fatalf("Server error: %v", err)
 		}
 
@@ -70,6 +216,22 @@ func main() {
 			device       = flag.String("device", "", "Target block device or image file path (required)")
 			deviceOffset = flag.Int64("device-offset", 0, "Offset in the target device to start writing (in bytes)")
 			dryRun       = flag.Bool("dry-run", false, "Dry run mode (don't actually write to device)")
+			undoDir      = flag.String("undo-dir", "", "Directory to save original data for unpatch (default <sector-dir>.undo)")
+			noUndo       = flag.Bool("no-undo", false, "Don't save original data (the patch cannot be undone)")
+			strict       = flag.Bool("strict", false, "Abort on the first error")
+			retries      = flag.Int("retries", 0, "Number of retries for each failed sector")
+			reportPath   = flag.String("report", "", "Write a JSON report to this path")
+			checkpoint   = flag.String("checkpoint", "", "Progress checkpoint file (default <sector-dir>.checkpoint)")
+			resume       = flag.Bool("resume", false, "Continue an interrupted patch from the checkpoint")
+			workers      = flag.Int("workers", 4, "Number of concurrent writers")
+			maxWrite     = flag.Int64("max-write", 8<<20, "Maximum size of a merged write in bytes")
+			direct       = flag.Bool("direct", false, "Open the target device with O_DIRECT")
+			yes          = flag.Bool("yes", false, "Don't ask for confirmation (requires -confirm-device)")
+			confirmDev   = flag.String("confirm-device", "", "Restate the target device, must match -device")
+			confirmSize  = flag.Int64("confirm-size", 0, "Expected target size in bytes (optional)")
+			confirmID    = flag.String("confirm-id", "", "Expected target serial or WWID (optional)")
+			jsonProgress = flag.Bool("json-progress", false, "Write JSON progress events to stdout")
+			force        = flag.Bool("force", false, "Ignore base fingerprint and sector size checks")
 		)
 		flag.Parse()
 
@@ -79,11 +241,315 @@ func main() {
 		if *device == "" {
 			log.Fatal("Target device or image file path is required (-device)")
 		}
+		if *noUndo {
+			*undoDir = ""
+		} else if *undoDir == "" {
+			*undoDir = filepath.Clean(*sectorDir) + ".undo"
+		}
+		if *checkpoint == "" {
+			*checkpoint = filepath.Clean(*sectorDir) + ".checkpoint"
+		}
 
-		if err := patchSectors(*sectorDir, *device, *deviceOffset, *dryRun); err != nil {
+		if err := patchSectors(PatchOptions{
+			SectorDir:    *sectorDir,
+			Device:       *device,
+			DeviceOffset: *deviceOffset,
+			DryRun:       *dryRun,
+			UndoDir:      *undoDir,
+			Strict:       *strict,
+			Retries:      *retries,
+			ReportPath:   *reportPath,
+			Checkpoint:   *checkpoint,
+			Resume:       *resume,
+			Workers:      *workers,
+			MaxWrite:     *maxWrite,
+			Direct:       *direct,
+			Yes:          *yes,
+			ConfirmDev:   *confirmDev,
+			ConfirmSize:  *confirmSize,
+			ConfirmID:    *confirmID,
+			JSONProgress: *jsonProgress,
+			Force:        *force,
+		}); err != nil {
 			log.Fatalf("Patch error: %v", err)
 		}
 
+	case "unpatch":
+		var (
+			undoDir      = flag.String("undo-dir", "", "Undo directory created by patch (required)")
+			device       = flag.String("device", "", "Target block device or image file path (required)")
+			deviceOffset = flag.Int64("device-offset", 0, "Offset in the target device used by patch (in bytes)")
+			dryRun       = flag.Bool("dry-run", false, "Dry run mode (don't actually write to device)")
+			strict       = flag.Bool("strict", false, "Abort on the first error")
+			retries      = flag.Int("retries", 0, "Number of retries for each failed sector")
+			reportPath   = flag.String("report", "", "Write a JSON report to this path")
+			checkpoint   = flag.String("checkpoint", "", "Progress checkpoint file (default <undo-dir>.checkpoint)")
+			resume       = flag.Bool("resume", false, "Continue an interrupted unpatch from the checkpoint")
+			workers      = flag.Int("workers", 4, "Number of concurrent writers")
+			maxWrite     = flag.Int64("max-write", 8<<20, "Maximum size of a merged write in bytes")
+			direct       = flag.Bool("direct", false, "Open the target device with O_DIRECT")
+			yes          = flag.Bool("yes", false, "Don't ask for confirmation (requires -confirm-device)")
+			confirmDev   = flag.String("confirm-device", "", "Restate the target device, must match -device")
+			confirmSize  = flag.Int64("confirm-size", 0, "Expected target size in bytes (optional)")
+			confirmID    = flag.String("confirm-id", "", "Expected target serial or WWID (optional)")
+			jsonProgress = flag.Bool("json-progress", false, "Write JSON progress events to stdout")
+			force        = flag.Bool("force", false, "Ignore base fingerprint and sector size checks")
+		)
+		flag.Parse()
+
+		if *undoDir == "" {
+			log.Fatal("Undo directory is required (-undo-dir)")
+		}
+		if *device == "" {
+			log.Fatal("Target device or image file path is required (-device)")
+		}
+		if *checkpoint == "" {
+			*checkpoint = filepath.Clean(*undoDir) + ".checkpoint"
+		}
+
+		// 撤销目录与扇区目录格式相同，直接写回即可，不再生成新的撤销数据
+		if err := patchSectors(PatchOptions{
+			SectorDir:    *undoDir,
+			Device:       *device,
+			DeviceOffset: *deviceOffset,
+			DryRun:       *dryRun,
+			Strict:       *strict,
+			Retries:      *retries,
+			ReportPath:   *reportPath,
+			Checkpoint:   *checkpoint,
+			Resume:       *resume,
+			Workers:      *workers,
+			MaxWrite:     *maxWrite,
+			Direct:       *direct,
+			Yes:          *yes,
+			ConfirmDev:   *confirmDev,
+			ConfirmSize:  *confirmSize,
+			ConfirmID:    *confirmID,
+			JSONProgress: *jsonProgress,
+			Force:        *force,
+		}); err != nil {
+			log.Fatalf("Unpatch error: %v", err)
+		}
+
+	case "export-overlay":
+		var (
+			sectorDir = flag.String("sector-dir", "", "Sector file directory (required)")
+			output    = flag.String("output", "", "Output image path (required)")
+			format    = flag.String("format", "qcow2", "Output format: qcow2 or raw")
+			backing   = flag.String("backing", "", "Base device or image used as qcow2 backing file (default from metadata)")
+			size      = flag.Int64("size", 0, "Virtual size in bytes (default size of the backing file)")
+		)
+		flag.Parse()
+
+		if *sectorDir == "" {
+			log.Fatal("Sector file directory is required (-sector-dir)")
+		}
+		if *output == "" {
+			log.Fatal("Output image path is required (-output)")
+		}
+
+		if err := exportOverlay(*sectorDir, *output, *format, *backing, *size); err != nil {
+			log.Fatalf("Export error: %v", err)
+		}
+
+	case "convert":
+		var (
+			device       = flag.String("device", "", "Base device or image (default from sector directory metadata)")
+			deviceFormat = flag.String("device-format", "", "Base image format: raw, qcow2, vhd, vhdx, vmdk or auto (default from metadata, else raw)")
+			lowerDirs    = flag.String("lower-dirs", "", "Lower sector directories, comma separated, oldest first (default from metadata)")
+			sectorDir    = flag.String("sector-dir", "", "Sector file directory (optional, convert the base only if omitted)")
+			output       = flag.String("output", "", "Output image path (required)")
+			format       = flag.String("format", "raw", "Output format: qcow2 or raw")
+			clusterSize  = flag.Int64("cluster-size", 65536, "Read block size and qcow2 cluster size")
+			compress     = flag.Bool("compress", false, "Write compressed qcow2 clusters")
+			checksumFile = flag.String("checksum-file", "", "Write the SHA256 of the virtual disk in sha256sum format")
+			verify       = flag.Bool("verify", false, "Read back the output and compare checksums")
+		)
+		flag.Parse()
+
+		if *device == "" && *sectorDir == "" {
+			log.Fatal("Base device (-device) or sector file directory (-sector-dir) is required")
+		}
+		if *output == "" {
+			log.Fatal("Output image path is required (-output)")
+		}
+
+		opts := ConvertOptions{
+			Device:       *device,
+			DeviceFormat: *deviceFormat,
+			LowerDirs:    splitList(*lowerDirs),
+			SectorDir:    *sectorDir,
+			Output:       *output,
+			Format:       *format,
+			ClusterSize:  *clusterSize,
+			Compress:     *compress,
+			ChecksumFile: *checksumFile,
+			Verify:       *verify,
+		}
+		if err := convertImage(opts); err != nil {
+			log.Fatalf("Convert error: %v", err)
+		}
+
+	case "info":
+		var (
+			sectorDir  = flag.String("sector-dir", "", "Sector file directory (required)")
+			jsonOutput = flag.Bool("json", false, "Print the full report as JSON")
+			buckets    = flag.Int("buckets", 16, "Number of regions in the distribution histogram")
+			maxList    = flag.Int("max-list", 20, "Maximum number of extents and files listed per section, 0 for all")
+		)
+		flag.Parse()
+
+		if *sectorDir == "" {
+			log.Fatal("Sector file directory is required (-sector-dir)")
+		}
+
+		if err := showOverlayInfo(*sectorDir, *jsonOutput, *buckets, *maxList); err != nil {
+			log.Fatalf("Info error: %v", err)
+		}
+
+	case "fsck":
+		var (
+			sectorDir     = flag.String("sector-dir", "", "Sector file directory (required)")
+			repair        = flag.Bool("repair", false, "Quarantine or fix the problems found (stop the server first)")
+			quarantineDir = flag.String("quarantine-dir", "", "Directory for quarantined files (default <sector-dir>.quarantine)")
+			jsonOutput    = flag.Bool("json", false, "Print the report as JSON")
+		)
+		flag.Parse()
+
+		if *sectorDir == "" {
+			log.Fatal("Sector file directory is required (-sector-dir)")
+		}
+
+		if err := runFsck(*sectorDir, *repair, *quarantineDir, *jsonOutput); err != nil {
+			log.Fatalf("Fsck error: %v", err)
+		}
+
+	case "merge":
+		var (
+			from         = flag.String("from", "", "Sector directories to merge, comma separated, oldest first (required)")
+			into         = flag.String("into", "", "Target sector directory, usually the parent layer (required)")
+			deleteSource = flag.Bool("delete-source", false, "Delete the merged directories afterwards")
+			dryRun       = flag.Bool("dry-run", false, "Only count the sector files that would be copied")
+			force        = flag.Bool("force", false, "Skip invalid file names and ignore base device mismatches")
+		)
+		flag.Parse()
+
+		if *from == "" {
+			log.Fatal("Source sector directories are required (-from)")
+		}
+		if *into == "" {
+			log.Fatal("Target sector directory is required (-into)")
+		}
+
+		opts := MergeOptions{
+			From:         splitList(*from),
+			Into:         *into,
+			DeleteSource: *deleteSource,
+			DryRun:       *dryRun,
+			Force:        *force,
+		}
+		if err := mergeLayers(opts); err != nil {
+			log.Fatalf("Merge error: %v", err)
+		}
+
+	case "diff":
+		var (
+			device       = flag.String("device", "", "Base device, used to compare sectors stored on one side only (default from metadata)")
+			deviceFormat = flag.String("device-format", "", "Base image format: raw, qcow2, vhd, vhdx, vmdk or auto (default from metadata, else raw)")
+			outputDir    = flag.String("output-dir", "", "Write the changed sectors as a new overlay, applicable with patch")
+			jsonOutput   = flag.Bool("json", false, "Print the changed extents as JSON")
+		)
+		flag.Parse()
+
+		if flag.NArg() != 2 {
+			log.Fatal("Usage: snap-nbd diff [options] <old-sector-dir> <new-sector-dir>")
+		}
+
+		opts := DiffOptions{
+			Old:          flag.Arg(0),
+			New:          flag.Arg(1),
+			Device:       *device,
+			DeviceFormat: *deviceFormat,
+			OutputDir:    *outputDir,
+			JSON:         *jsonOutput,
+		}
+		if err := runDiff(opts); err != nil {
+			log.Fatalf("Diff error: %v", err)
+		}
+
+	case "send":
+		var (
+			sectorDir    = flag.String("sector-dir", "", "Sector directory to send, including its lower layers (required)")
+			from         = flag.String("from", "", "Older snapshot, send only the changes since it")
+			device       = flag.String("device", "", "Base device, needed for sectors reverted since -from (default from metadata)")
+			deviceFormat = flag.String("device-format", "", "Base image format: raw, qcow2, vhd, vhdx, vmdk or auto (default from metadata, else raw)")
+			output       = flag.String("output", "", "Output file (default stdout)")
+		)
+		flag.Parse()
+
+		if *sectorDir == "" {
+			log.Fatal("Sector file directory is required (-sector-dir)")
+		}
+
+		opts := SendOptions{
+			SectorDir:    *sectorDir,
+			From:         *from,
+			Device:       *device,
+			DeviceFormat: *deviceFormat,
+			Output:       *output,
+		}
+		if err := sendOverlay(opts); err != nil {
+			log.Fatalf("Send error: %v", err)
+		}
+
+	case "receive":
+		var (
+			sectorDir = flag.String("sector-dir", "", "Sector directory to create, must not exist or be empty (required)")
+			input     = flag.String("input", "", "Input file (default stdin)")
+			lower     = flag.String("lower", "", "Previously received sector directory an incremental stream builds on")
+		)
+		flag.Parse()
+
+		if *sectorDir == "" {
+			log.Fatal("Sector file directory is required (-sector-dir)")
+		}
+
+		if err := receiveOverlay(ReceiveOptions{SectorDir: *sectorDir, Input: *input, Lower: *lower}); err != nil {
+			log.Fatalf("Receive error: %v", err)
+		}
+
+	case "bench":
+		var (
+			device      = flag.String("device", "", "Block device or raw file to benchmark (required)")
+			engine      = flag.String("engine", "both", "I/O engine: pread, uring or both")
+			blockSize   = flag.Int("block-size", 4096, "Request size in bytes")
+			concurrency = flag.Int("concurrency", 16, "Concurrent requests")
+			duration    = flag.Duration("duration", 5*time.Second, "Run time per engine")
+			direct      = flag.Bool("direct", false, "Open the device with O_DIRECT")
+			write       = flag.Bool("write", false, "Write each block back after reading it (contents are unchanged)")
+		)
+		flag.Parse()
+
+		if *device == "" {
+			log.Fatal("Device is required (-device)")
+		}
+		engines := []string{*engine}
+		if *engine == "both" {
+			engines = []string{ioEnginePread, ioEngineUring}
+		}
+
+		if err := runBench(BenchOptions{
+			Device:      *device,
+			Engines:     engines,
+			BlockSize:   *blockSize,
+			Concurrency: *concurrency,
+			Duration:    *duration,
+			Direct:      *direct,
+			Write:       *write,
+		}); err != nil {
+			log.Fatalf("Bench error: %v", err)
+		}
+
 	default:
 		log.Fatalf("Unknown command: %s", command)
 	}
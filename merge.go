@@ -0,0 +1,346 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	nbdbackend "nbd/backend"
+)
+
+// MergeOptions 控制 merge 命令的行为
+type MergeOptions struct {
+	From         []string // 要合并的上层目录，从下往上（旧到新）排列，后面的覆盖前面的
+	Into         string   // 目标目录，通常是 From 中第一层的父层
+	DeleteSource bool     // 合并完成后删除 From 中的目录
+	DryRun       bool
+	Force        bool // 忽略扇区大小以外的一致性检查
+}
+
+// writeSectorFile 以临时文件加重命名的方式写入扇区文件，不单独同步，由调用方在最后统一同步
+func writeSectorFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, nbdbackend.AppendChecksum(data), 0666); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// mergeLayers 把若干覆盖层依次合并到目标目录中，同一扇区保留最上层的版本
+// 只能离线执行：所有目录都要加排他锁，服务器正在使用任何一层时拒绝执行
+// 源目录在全部写入并同步之前不会被修改，中断后重新执行即可
+func mergeLayers(opts MergeOptions) error {
+	dirs := append(append([]string{}, opts.From...), opts.Into)
+	for i, dir := range dirs {
+		for _, other := range dirs[:i] {
+			if sameFile(dir, other) {
+				return fmt.Errorf("directory %s is listed twice", dir)
+			}
+		}
+	}
+	for _, dir := range opts.From {
+		if _, err := os.Stat(dir); err != nil {
+			return fmt.Errorf("source directory: %v", err)
+		}
+	}
+	for _, dir := range dirs {
+		lock, err := nbdbackend.LockDir(dir, true)
+		if err != nil {
+			return fmt.Errorf("%v, stop the server before merging", err)
+		}
+		defer lock.Unlock()
+	}
+
+	// 检查各层的扇区大小和基础设备是否一致
+	intoMeta, err := nbdbackend.LoadMetadata(opts.Into)
+	if err != nil {
+		return err
+	}
+	meta := intoMeta
+	sources := make([][]SectorInfo, len(opts.From))
+	srcMetas := make([]*nbdbackend.Metadata, len(opts.From))
+	var sectorSize, virtualSize int64
+	var lower []string // 最下面一个源目录的下层目录，合并到新目录时沿用
+	if intoMeta != nil {
+		sectorSize = intoMeta.SectorSize
+		virtualSize = intoMeta.Size
+	}
+	for i, dir := range opts.From {
+		sectors, invalid, err := walkSectorFiles(dir)
+		if err != nil {
+			return fmt.Errorf("failed to scan %s: %v", dir, err)
+		}
+		if len(invalid) > 0 {
+			if !opts.Force {
+				return fmt.Errorf("found %d invalid sector file names in %s, run fsck first (or use -force to skip them)", len(invalid), dir)
+			}
+			log.Printf("Skipping %d invalid sector file names in %s", len(invalid), dir)
+		}
+		sortSectors(sectors)
+		sources[i] = sectors
+
+		srcMeta, err := nbdbackend.LoadMetadata(dir)
+		if err != nil {
+			return err
+		}
+		srcMetas[i] = srcMeta
+		size, err := checkSectorSizes(sectors, srcMeta)
+		if err != nil {
+			return fmt.Errorf("%s: inconsistent sector sizes: %v", dir, err)
+		}
+		if sectorSize == 0 {
+			sectorSize = size
+		} else if size != 0 && size != sectorSize {
+			return fmt.Errorf("%s uses sector size %d, but %s uses %d", dir, size, opts.Into, sectorSize)
+		}
+
+		// 虚拟大小只会扩大，合并结果取各层中最大的一个
+		if srcMeta != nil {
+			virtualSize = max(virtualSize, srcMeta.Size)
+			if i == 0 {
+				lower = srcMeta.Lower
+			}
+		}
+
+		if srcMeta != nil && srcMeta.Base != nil {
+			if meta != nil && meta.Base != nil {
+				if err := meta.Base.Match(srcMeta.Base); err != nil {
+					if !opts.Force {
+						return fmt.Errorf("%s was created on a different base device: %v (use -force to override)", dir, err)
+					}
+					log.Printf("Ignoring base device mismatch of %s: %v", dir, err)
+				}
+			} else {
+				meta = srcMeta
+			}
+		}
+	}
+
+	// 源目录必须依次叠加在目标目录之上，否则合并结果与任何一层看到的内容都不同
+	if err := checkAdjacent(opts, intoMeta, srcMetas); err != nil {
+		if !opts.Force {
+			return fmt.Errorf("%v (use -force to override)", err)
+		}
+		log.Printf("Ignoring layer order: %v", err)
+	}
+	// 以源目录或目标目录为下层的其他目录：删除源目录后需要改写它们记录的下层目录
+	dependents, err := findDependents(opts)
+	if err != nil {
+		if !opts.Force {
+			return fmt.Errorf("%v (use -force to override)", err)
+		}
+		log.Printf("Ignoring dependent layers: %v", err)
+	}
+	if opts.DeleteSource && !opts.DryRun {
+		for dir := range dependents {
+			lock, err := nbdbackend.LockDir(dir, true)
+			if err != nil {
+				return fmt.Errorf("%v, stop the server using %s before merging", err, dir)
+			}
+			defer lock.Unlock()
+		}
+	}
+
+	total := 0
+	for _, sectors := range sources {
+		total += len(sectors)
+	}
+	fmt.Printf("Merging %d sector files from %d layers into %s (sector size %d)\n", total, len(opts.From), opts.Into, sectorSize)
+
+	copied, replaced := 0, 0
+	start := time.Now()
+	lastReport := start
+	for i, dir := range opts.From {
+		for _, s := range sources[i] {
+			// 先校验再写入，避免把损坏的数据带进合并结果
+			data, err := nbdbackend.ReadSectorFile(s.Path, s.Size)
+			if err != nil {
+				return fmt.Errorf("%s: %v (run fsck on %s first)", s.Path, err, dir)
+			}
+			target := nbdbackend.SectorPath(opts.Into, s.Offset, s.Size)
+			if _, err := os.Stat(target); err == nil {
+				replaced++
+			}
+			if !opts.DryRun {
+				if err := writeSectorFile(target, data); err != nil {
+					return fmt.Errorf("failed to write %s: %v", target, err)
+				}
+			}
+			copied++
+
+			if now := time.Now(); now.Sub(lastReport) >= 2*time.Second {
+				lastReport = now
+				fmt.Printf("Progress: %d/%d sector files\n", copied, total)
+			}
+		}
+	}
+
+	if opts.DryRun {
+		fmt.Printf("Dry run: would copy %d sector files, replacing %d existing ones in %s\n", copied, replaced, opts.Into)
+		return nil
+	}
+
+	// 所有数据落盘之后才记录元数据并删除源目录
+	syscall.Sync()
+	switch {
+	case intoMeta == nil && (meta != nil || virtualSize > 0 || len(lower) > 0):
+		newMeta := &nbdbackend.Metadata{SectorSize: sectorSize, Lower: lower, Size: virtualSize}
+		if meta != nil {
+			newMeta.Base = meta.Base
+		}
+		if err := nbdbackend.SaveMetadata(opts.Into, newMeta); err != nil {
+			return fmt.Errorf("failed to write metadata: %v", err)
+		}
+	case intoMeta != nil && virtualSize > intoMeta.Size:
+		intoMeta.Size = virtualSize
+		if err := nbdbackend.SaveMetadata(opts.Into, intoMeta); err != nil {
+			return fmt.Errorf("failed to write metadata: %v", err)
+		}
+	}
+	fmt.Printf("Merged %d sector files (%d replaced existing sectors) in %v\n", copied, replaced, time.Since(start).Round(time.Millisecond))
+
+	if opts.DeleteSource {
+		// 先让上层目录直接叠加在目标目录上，再删除源目录，中断后上层目录仍然完整
+		for dir, depMeta := range dependents {
+			depMeta.Lower = replaceSources(depMeta.Lower, opts.From, opts.Into)
+			if err := nbdbackend.SaveMetadata(dir, depMeta); err != nil {
+				return fmt.Errorf("failed to update lower directories of %s: %v", dir, err)
+			}
+			fmt.Printf("Updated lower directories of %s: %v\n", dir, depMeta.Lower)
+		}
+		for _, dir := range opts.From {
+			if err := os.RemoveAll(dir); err != nil {
+				return fmt.Errorf("failed to delete %s: %v", dir, err)
+			}
+			fmt.Printf("Deleted %s\n", dir)
+		}
+	}
+	return nil
+}
+
+// sameDir 判断两个路径是否指向同一个目录，任何一个不存在时比较绝对路径
+func sameDir(a, b string) bool {
+	fa, errA := os.Stat(a)
+	fb, errB := os.Stat(b)
+	if errA == nil && errB == nil {
+		return os.SameFile(fa, fb)
+	}
+	absA, _ := filepath.Abs(a)
+	absB, _ := filepath.Abs(b)
+	return absA == absB
+}
+
+// sameDirs 判断两组路径是否依次指向相同的目录
+func sameDirs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !sameDir(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// indexDir 返回 dir 在 dirs 中的位置，不存在时返回 -1
+func indexDir(dirs []string, dir string) int {
+	for i, d := range dirs {
+		if sameDir(d, dir) {
+			return i
+		}
+	}
+	return -1
+}
+
+// checkAdjacent 检查源目录是否依次叠加在目标目录之上：
+// 每一层记录的下层目录必须正好是它下面一层的下层目录加上那一层本身
+// 合并到新目录时不检查最下面的源目录，没有元数据的目录无法检查，只给出警告
+func checkAdjacent(opts MergeOptions, intoMeta *nbdbackend.Metadata, srcMetas []*nbdbackend.Metadata) error {
+	below, belowMeta := opts.Into, intoMeta
+	for i, dir := range opts.From {
+		srcMeta := srcMetas[i]
+		switch {
+		case i == 0 && intoMeta == nil:
+		case srcMeta == nil || belowMeta == nil:
+			log.Printf("Warning: cannot check that %s is stacked directly on %s, metadata missing", dir, below)
+		default:
+			want := append(append([]string{}, belowMeta.Lower...), below)
+			if !sameDirs(srcMeta.Lower, want) {
+				return fmt.Errorf("%s is not stacked directly on %s: its lower directories are %v", dir, below, srcMeta.Lower)
+			}
+		}
+		below, belowMeta = dir, srcMeta
+	}
+	return nil
+}
+
+// findDependents 在源目录和目标目录所在的父目录中查找以它们为下层的其他扇区目录，返回引用了源目录的那些
+// 只以目标目录为下层、却没有叠加在源目录之上的目录会因为合并而改变内容，此时返回错误
+func findDependents(opts MergeOptions) (map[string]*nbdbackend.Metadata, error) {
+	merged := append(append([]string{}, opts.From...), opts.Into)
+	parents := make(map[string]bool)
+	for _, dir := range merged {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		parents[filepath.Dir(abs)] = true
+	}
+
+	dependents := make(map[string]*nbdbackend.Metadata)
+	for parent := range parents {
+		entries, err := os.ReadDir(parent)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			dir := filepath.Join(parent, entry.Name())
+			if !entry.IsDir() || indexDir(merged, dir) >= 0 || dependents[dir] != nil {
+				continue
+			}
+			meta, err := nbdbackend.LoadMetadata(dir)
+			if err != nil || meta == nil {
+				continue
+			}
+			first, into := indexDir(meta.Lower, opts.From[0]), indexDir(meta.Lower, opts.Into)
+			switch {
+			case first >= 0:
+				if first+len(opts.From) > len(meta.Lower) || !sameDirs(meta.Lower[first:first+len(opts.From)], opts.From) {
+					return nil, fmt.Errorf("%s is stacked on %s but not on all merged layers, merging would change its contents", dir, opts.From[0])
+				}
+				dependents[dir] = meta
+			case into >= 0:
+				return nil, fmt.Errorf("%s is also stacked on %s, merging would change its contents", dir, opts.Into)
+			default:
+				for _, src := range opts.From[1:] {
+					if indexDir(meta.Lower, src) >= 0 {
+						return nil, fmt.Errorf("%s is stacked on %s but not on all merged layers, merging would change its contents", dir, src)
+					}
+				}
+			}
+		}
+	}
+	return dependents, nil
+}
+
+// replaceSources 把下层目录列表中连续的源目录替换为目标目录，目标目录已经在它们下面时直接去掉
+func replaceSources(lower, sources []string, into string) []string {
+	first := indexDir(lower, sources[0])
+	result := append([]string{}, lower[:first]...)
+	if first == 0 || !sameDir(lower[first-1], into) {
+		abs, err := filepath.Abs(into)
+		if err != nil {
+			abs = into
+		}
+		result = append(result, abs)
+	}
+	return append(result, lower[first+len(sources):]...)
+}
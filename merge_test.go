@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	nbdbackend "nbd/backend"
+)
+
+// newLayer 在 root 下创建名为 name 的扇区目录，记录下层目录 lower，并在第 sector 个扇区写入 fill
+func newLayer(t *testing.T, root, name string, lower []string, sector int64, fill byte) string {
+	t.Helper()
+	dir := filepath.Join(root, name)
+	if err := nbdbackend.SaveMetadata(dir, &nbdbackend.Metadata{SectorSize: 4096, Lower: lower}); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeSectorFile(nbdbackend.SectorPath(dir, sector, 4096), bytes.Repeat([]byte{fill}, 4096)); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// readLayerSector 读取扇区目录中第 sector 个扇区的第一个字节
+func readLayerSector(t *testing.T, dir string, sector int64) byte {
+	t.Helper()
+	data, err := nbdbackend.ReadSectorFile(nbdbackend.SectorPath(dir, sector, 4096), 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data[0]
+}
+
+func TestMergeRejectsNonAdjacentLayers(t *testing.T) {
+	root := t.TempDir()
+	day1 := newLayer(t, root, "day1", nil, 0, 1)
+	day2 := newLayer(t, root, "day2", []string{day1}, 1, 2)
+	day3 := newLayer(t, root, "day3", []string{day1, day2}, 2, 3)
+
+	// day3 叠加在 day2 上，不能跳过 day2 直接合并到 day1
+	err := mergeLayers(MergeOptions{From: []string{day3}, Into: day1})
+	if err == nil || !strings.Contains(err.Error(), "not stacked directly on") {
+		t.Fatalf("merging day3 into day1 = %v, want a layer order error", err)
+	}
+	err = mergeLayers(MergeOptions{From: []string{day3, day2}, Into: day1})
+	if err == nil || !strings.Contains(err.Error(), "not stacked directly on") {
+		t.Fatalf("merging day3,day2 into day1 = %v, want a layer order error", err)
+	}
+	if _, err := os.Stat(nbdbackend.SectorPath(day1, 2, 4096)); !os.IsNotExist(err) {
+		t.Fatal("rejected merge copied sector files")
+	}
+}
+
+func TestMergeDeleteSourceUpdatesDependents(t *testing.T) {
+	root := t.TempDir()
+	day1 := newLayer(t, root, "day1", nil, 0, 1)
+	day2 := newLayer(t, root, "day2", []string{day1}, 1, 2)
+	day3 := newLayer(t, root, "day3", []string{day1, day2}, 2, 3)
+	day4 := newLayer(t, root, "day4", []string{day1, day2, day3}, 3, 4)
+
+	if err := mergeLayers(MergeOptions{From: []string{day2, day3}, Into: day1, DeleteSource: true}); err != nil {
+		t.Fatal(err)
+	}
+	for sector, want := range []byte{1, 2, 3} {
+		if got := readLayerSector(t, day1, int64(sector)); got != want {
+			t.Fatalf("sector %d of day1 = %d, want %d", sector, got, want)
+		}
+	}
+	for _, dir := range []string{day2, day3} {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Fatalf("%s was not deleted", dir)
+		}
+	}
+	meta, err := nbdbackend.LoadMetadata(day4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meta.Lower) != 1 || meta.Lower[0] != day1 {
+		t.Fatalf("lower directories of day4 = %v, want [%s]", meta.Lower, day1)
+	}
+}
+
+func TestMergeRejectsSiblingBranch(t *testing.T) {
+	root := t.TempDir()
+	day1 := newLayer(t, root, "day1", nil, 0, 1)
+	day2 := newLayer(t, root, "day2", []string{day1}, 1, 2)
+	newLayer(t, root, "branch", []string{day1}, 1, 9)
+
+	// branch 也叠加在 day1 上，把 day2 合并进 day1 会改变 branch 看到的内容
+	err := mergeLayers(MergeOptions{From: []string{day2}, Into: day1})
+	if err == nil || !strings.Contains(err.Error(), "also stacked on") {
+		t.Fatalf("merge = %v, want an error about the sibling branch", err)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
@@ -9,6 +10,11 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
+
+	nbdbackend "nbd/backend"
+	"nbd/image"
 )
 
 type SectorInfo struct {
@@ -17,8 +23,27 @@ type SectorInfo struct {
 	Size   int64
 }
 
-func walkSectorFiles(dir string) ([]SectorInfo, error) {
+// parseSectorName 解析扇区文件名，格式：0000000012345678_00001000.sector
+func parseSectorName(filename string) (sector, size int64, err error) {
+	parts := strings.Split(strings.TrimSuffix(filename, ".sector"), "_")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid sector filename format")
+	}
+
+	// 解析偏移量和大小
+	if sector, err = strconv.ParseInt(parts[0], 16, 64); err != nil {
+		return 0, 0, fmt.Errorf("invalid offset: %v", err)
+	}
+	if size, err = strconv.ParseInt(parts[1], 16, 64); err != nil {
+		return 0, 0, fmt.Errorf("invalid size: %v", err)
+	}
+	return sector, size, nil
+}
+
+// walkSectorFiles 遍历扇区目录，返回合法的扇区文件和无法解析的文件名
+func walkSectorFiles(dir string) ([]SectorInfo, []string, error) {
 	var sectors []SectorInfo
+	var invalid []string
 	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -31,24 +56,11 @@ func walkSectorFiles(dir string) ([]SectorInfo, error) {
 
 		// 检查是否是扇区文件
 		if filepath.Ext(path) == ".sector" {
-			// 解析扇区文件名
-			// 格式：0000000012345678_00001000.sector
 			filename := filepath.Base(path)
-			parts := strings.Split(strings.TrimSuffix(filename, ".sector"), "_")
-			if len(parts) != 2 {
-				log.Printf("Invalid sector filename format: %s", filename)
-				return nil
-			}
-
-			// 解析偏移量和大小
-			offset, err := strconv.ParseInt(parts[0], 16, 64)
-			if err != nil {
-				log.Printf("Invalid offset in filename %s: %v", filename, err)
-				return nil
-			}
-			size, err := strconv.ParseInt(parts[1], 16, 64)
+			offset, size, err := parseSectorName(filename)
 			if err != nil {
-				log.Printf("Invalid size in filename %s: %v", filename, err)
+				log.Printf("Invalid sector filename %s: %v", filename, err)
+				invalid = append(invalid, path)
 				return nil
 			}
 
@@ -61,123 +73,688 @@ func walkSectorFiles(dir string) ([]SectorInfo, error) {
 		return nil
 	})
 
-	return sectors, err
+	return sectors, invalid, err
+}
+
+// writeFileSync 以临时文件加重命名的方式写入文件，并同步到磁盘
+func writeFileSync(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	// 同步目录，确保重命名本身已落盘
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// checkUndoDir 确保撤销目录中没有旧的扇区文件，避免覆盖上一次补丁的原始数据
+func checkUndoDir(undoDir, sectorDir string) error {
+	if filepath.Clean(undoDir) == filepath.Clean(sectorDir) {
+		return fmt.Errorf("undo directory must be different from sector directory")
+	}
+	if _, err := os.Stat(undoDir); os.IsNotExist(err) {
+		return nil
+	}
+	existing, _, err := walkSectorFiles(undoDir)
+	if err != nil {
+		return fmt.Errorf("failed to scan undo directory: %v", err)
+	}
+	if len(existing) > 0 {
+		return fmt.Errorf("undo directory %s already contains %d sector files from a previous patch, remove it or choose another -undo-dir", undoDir, len(existing))
+	}
+	return nil
+}
+
+// checkpointInterval 是两次写入检查点之间的最短时间
+const checkpointInterval = 2 * time.Second
+
+// PatchOptions 描述一次补丁操作的参数
+type PatchOptions struct {
+	SectorDir    string
+	Device       string
+	DeviceOffset int64
+	DryRun       bool
+	UndoDir      string // 保存原始数据的撤销目录，为空表示不保存
+	Strict       bool   // 遇到第一个错误立即中止
+	Retries      int    // 每个扇区失败后的重试次数
+	ReportPath   string // JSON 报告输出路径，为空表示不输出
+	Checkpoint   string // 检查点文件路径，为空表示不记录进度
+	Resume       bool   // 从检查点继续上一次中断的补丁
+	Workers      int    // 并发写入的协程数
+	MaxWrite     int64  // 合并后单次写入的最大字节数
+	Direct       bool   // 以 O_DIRECT 方式打开目标设备
+	Yes          bool   // 不交互确认，改为核对 Confirm* 参数
+	ConfirmDev   string // -yes 时必须与 Device 指向同一个目标
+	ConfirmSize  int64  // 大于 0 时必须与目标大小一致
+	ConfirmID    string // 不为空时必须与目标设备的序列号或 WWID 一致
+	JSONProgress bool   // 在 stdout 上输出 JSON 进度事件
+	Force        bool   // 忽略基础设备指纹和扇区大小一致性检查
+}
+
+// targetSize 返回补丁目标的大小，对块设备同样有效
+func targetSize(device string) (int64, error) {
+	f, err := os.Open(device)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open device/file: %v", err)
+	}
+	defer f.Close()
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get device size: %v", err)
+	}
+	return size, nil
+}
+
+// targetFingerprint 计算补丁目标的指纹
+func targetFingerprint(device string) (*nbdbackend.Fingerprint, error) {
+	f, err := os.Open(device)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open device/file: %v", err)
+	}
+	defer f.Close()
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get device size: %v", err)
+	}
+	return nbdbackend.ComputeFingerprint(device, f, size)
+}
+
+// checkSectorSizes 检查扇区文件的大小后缀是否一致，不一致时按 扇区号*大小 计算出的写入位置会互相重叠
+// 返回统一的扇区大小，没有扇区文件时返回元数据中的扇区大小
+func checkSectorSizes(sectors []SectorInfo, meta *nbdbackend.Metadata) (int64, error) {
+	var sectorSize int64
+	if meta != nil {
+		sectorSize = meta.SectorSize
+	}
+	for _, s := range sectors {
+		if sectorSize == 0 {
+			sectorSize = s.Size
+		}
+		if s.Size != sectorSize {
+			return 0, fmt.Errorf("sector file %s has size 0x%x, expected 0x%x", s.Path, s.Size, sectorSize)
+		}
+	}
+	return sectorSize, nil
+}
+
+// checkTarget 核对目标设备与扇区目录元数据中记录的基础设备指纹
+// 头部可能已经被之前中断的补丁修改，继续时跳过头部哈希检查
+func checkTarget(opts PatchOptions, meta *nbdbackend.Metadata) error {
+	if meta == nil || meta.Base == nil {
+		return nil
+	}
+	target, err := targetFingerprint(opts.Device)
+	if err != nil {
+		return err
+	}
+	if opts.Resume {
+		target.HeaderHash = ""
+	}
+	return meta.Base.Match(target)
+}
+
+// sameFile 判断两个路径是否指向同一个文件或设备
+func sameFile(a, b string) bool {
+	if filepath.Clean(a) == filepath.Clean(b) {
+		return true
+	}
+	ra, errA := filepath.EvalSymlinks(a)
+	rb, errB := filepath.EvalSymlinks(b)
+	return errA == nil && errB == nil && ra == rb
 }
 
-func patchSectors(sectorDir, device string, deviceOffset int64, dryRun bool) error {
+// confirmTarget 在非交互模式下核对调用方重复给出的目标信息，任何一项不符都拒绝执行
+func confirmTarget(opts PatchOptions) error {
+	if opts.ConfirmDev == "" {
+		return fmt.Errorf("-yes requires -confirm-device to restate the target device")
+	}
+	if !sameFile(opts.ConfirmDev, opts.Device) {
+		return fmt.Errorf("-confirm-device %s does not match -device %s", opts.ConfirmDev, opts.Device)
+	}
+
+	if opts.ConfirmSize > 0 {
+		f, err := os.Open(opts.Device)
+		if err != nil {
+			return fmt.Errorf("failed to open device/file: %v", err)
+		}
+		size, err := f.Seek(0, io.SeekEnd)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to get device size: %v", err)
+		}
+		if size != opts.ConfirmSize {
+			return fmt.Errorf("-confirm-size %d does not match device size %d", opts.ConfirmSize, size)
+		}
+	}
+
+	if opts.ConfirmID != "" {
+		id := nbdbackend.DeviceSerial(opts.Device)
+		if id == "" {
+			return fmt.Errorf("-confirm-id given but the identifier of %s is not available", opts.Device)
+		}
+		if id != opts.ConfirmID {
+			return fmt.Errorf("-confirm-id %s does not match device identifier %s", opts.ConfirmID, id)
+		}
+	}
+	return nil
+}
+
+// PatchFailure 记录一个未能写入的扇区
+type PatchFailure struct {
+	Path     string `json:"path"`
+	Sector   int64  `json:"sector"`
+	Offset   int64  `json:"offset"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error"`
+}
+
+// PatchReport 是补丁结果的机器可读报告
+type PatchReport struct {
+	SectorDir    string         `json:"sector_dir"`
+	Device       string         `json:"device"`
+	DeviceOffset int64          `json:"device_offset"`
+	DryRun       bool           `json:"dry_run"`
+	Total        int            `json:"total"`
+	Resumed      int            `json:"resumed"`
+	Applied      int            `json:"applied"`
+	Failed       []PatchFailure `json:"failed"`
+	Invalid      []string       `json:"invalid"`
+	Aborted      bool           `json:"aborted"`
+	Success      bool           `json:"success"`
+	Error        string         `json:"error,omitempty"`
+	StartTime    time.Time      `json:"start_time"`
+	EndTime      time.Time      `json:"end_time"`
+}
+
+// writePatchReport 把报告写入 JSON 文件
+func writePatchReport(path string, report *PatchReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0666)
+}
+
+// applyWithRetry 执行 fn，失败后按 retries 重试，返回尝试次数和最后一次错误
+func applyWithRetry(retries int, name string, fn func() error) (int, error) {
+	var err error
+	attempts := 0
+	for attempt := 0; attempt <= retries; attempt++ {
+		attempts++
+		if err = fn(); err == nil {
+			return attempts, nil
+		}
+		if attempt < retries {
+			log.Printf("Attempt %d for %s failed: %v, retrying", attempts, name, err)
+			time.Sleep(time.Duration(attempts) * 100 * time.Millisecond)
+		}
+	}
+	return attempts, err
+}
+
+// patchSectors 把扇区目录中的数据写入目标设备
+// 如果设置了撤销目录，会先把即将被覆盖的原始数据保存下来
+func patchSectors(opts PatchOptions) (err error) {
+	report := &PatchReport{
+		SectorDir:    opts.SectorDir,
+		Device:       opts.Device,
+		DeviceOffset: opts.DeviceOffset,
+		DryRun:       opts.DryRun,
+		Failed:       []PatchFailure{},
+		Invalid:      []string{},
+		StartTime:    time.Now(),
+	}
+
+	// 输出 JSON 进度时，stdout 只用于进度事件，其余信息输出到 stderr
+	var out io.Writer = os.Stdout
+	progress := newProgressStream(nil)
+	if opts.JSONProgress {
+		out = os.Stderr
+		progress = newProgressStream(os.Stdout)
+	}
+
+	defer func() {
+		report.EndTime = time.Now()
+		report.Success = err == nil && !report.Aborted
+		if err != nil {
+			report.Error = err.Error()
+		}
+		progress.emit("done", map[string]any{
+			"success": report.Success,
+			"applied": report.Resumed + report.Applied,
+			"failed":  len(report.Failed),
+			"invalid": len(report.Invalid),
+			"total":   report.Total,
+			"error":   report.Error,
+		})
+		if opts.ReportPath != "" {
+			if werr := writePatchReport(opts.ReportPath, report); werr != nil {
+				log.Printf("Failed to write report %s: %v", opts.ReportPath, werr)
+			}
+		}
+	}()
+
 	// 显示警告信息（只在非 dry-run 模式下显示）
-	if !dryRun {
-		fmt.Println("\n" + strings.Repeat("!", 80))
-		fmt.Println("WARNING: This program will write data directly to the target device.")
-		fmt.Println("         Incorrect usage may result in data loss or system damage.")
-		fmt.Println("         Make sure you have a backup of your data.")
-		fmt.Println("         Double-check the target device and offset.")
-		fmt.Println(strings.Repeat("!", 80) + "\n")
+	if !opts.DryRun {
+		fmt.Fprintln(out, "\n"+strings.Repeat("!", 80))
+		fmt.Fprintln(out, "WARNING: This program will write data directly to the target device.")
+		fmt.Fprintln(out, "         Incorrect usage may result in data loss or system damage.")
+		fmt.Fprintln(out, "         Make sure you have a backup of your data.")
+		fmt.Fprintln(out, "         Double-check the target device and offset.")
+		fmt.Fprintln(out, strings.Repeat("!", 80)+"\n")
+	}
+
+	// 目标正被服务器作为基础设备使用时，写入会破坏服务器看到的数据，加排他锁确认没有服务器在使用它
+	if !opts.DryRun {
+		lock, err := nbdbackend.LockBase(opts.Device, true)
+		if err != nil {
+			return fmt.Errorf("cannot patch %s: %v", opts.Device, err)
+		}
+		defer lock.Unlock()
 	}
 
 	// 遍历并收集扇区文件信息
-	fmt.Println("Scanning sector files...")
-	sectors, err := walkSectorFiles(sectorDir)
+	fmt.Fprintln(out, "Scanning sector files...")
+	sectors, invalid, err := walkSectorFiles(opts.SectorDir)
 	if err != nil {
 		return fmt.Errorf("failed to scan sector files: %v", err)
 	}
+	sortSectors(sectors)
+	report.Total = len(sectors)
+	report.Invalid = append(report.Invalid, invalid...)
+
+	// 核对扇区大小和目标设备，防止把补丁写到错误的设备上
+	meta, err := nbdbackend.LoadMetadata(opts.SectorDir)
+	if err != nil {
+		return err
+	}
+	sectorSize, err := checkSectorSizes(sectors, meta)
+	if err != nil {
+		if !opts.Force {
+			return fmt.Errorf("inconsistent sector sizes: %v (use -force to override)", err)
+		}
+		log.Printf("Ignoring inconsistent sector sizes: %v", err)
+	}
+	if err := checkTarget(opts, meta); err != nil {
+		if !opts.Force {
+			return fmt.Errorf("target %s does not match the base recorded in %s: %v (use -force to override)", opts.Device, opts.SectorDir, err)
+		}
+		log.Printf("Ignoring base fingerprint mismatch: %v", err)
+	}
+	// 补丁按原始偏移写入，不能直接写入 qcow2 等容器格式的镜像文件
+	if format, err := image.Detect(opts.Device); err != nil {
+		return fmt.Errorf("failed to detect target format: %v", err)
+	} else if format != image.FormatRaw {
+		if !opts.Force {
+			return fmt.Errorf("target %s is a %s image, patch only writes raw devices or images (convert it first, or use -force)", opts.Device, format)
+		}
+		log.Printf("Ignoring target image format %s", format)
+	}
+
+	// 补丁从不写到目标末尾之后，完全落在末尾之后的扇区直接中止
+	deviceSize, err := targetSize(opts.Device)
+	if err != nil {
+		return err
+	}
+	for _, s := range sectors {
+		if offset := s.Offset*s.Size + opts.DeviceOffset; offset >= deviceSize {
+			report.Aborted = true
+			return fmt.Errorf("sector file %s at offset 0x%x is beyond the end of %s (size %d)", s.Path, offset, opts.Device, deviceSize)
+		}
+	}
+
+	// 严格模式下，无法解析的文件名直接中止，此时还没有写入任何数据
+	if opts.Strict && len(invalid) > 0 {
+		report.Aborted = true
+		return fmt.Errorf("found %d invalid sector file names, first: %s", len(invalid), invalid[0])
+	}
 
 	// 显示统计信息
 	var totalSize int64
 	for _, s := range sectors {
 		totalSize += s.Size
 	}
-	fmt.Printf("\nFound %d sector files, total size: %d bytes (%.2f MB)\n",
+	fmt.Fprintf(out, "\nFound %d sector files, total size: %d bytes (%.2f MB)\n",
 		len(sectors), totalSize, float64(totalSize)/1024/1024)
-	fmt.Printf("Target device: %s (offset: 0x%x)\n", device, deviceOffset)
-	if dryRun {
-		fmt.Println("\nDRY RUN MODE: No data will be written to the device")
+	if len(invalid) > 0 {
+		fmt.Fprintf(out, "Skipping %d files with invalid sector file names\n", len(invalid))
 	}
+	progress.emit("scan", map[string]any{
+		"sectors": len(sectors),
+		"bytes":   totalSize,
+		"invalid": len(invalid),
+	})
+	fmt.Fprintf(out, "Target device: %s (offset: 0x%x)\n", opts.Device, opts.DeviceOffset)
 
-	// 只在非 dry-run 模式下请求确认
-	if !dryRun {
-		fmt.Print("\nTo proceed, type 'YES' (case sensitive): ")
+	// 处理检查点，确定从哪个扇区开始写入
+	start := 0
+	var checkpoint *PatchCheckpoint
+	if opts.Checkpoint != "" && !opts.DryRun {
+		setHash, err := sectorSetHash(opts.SectorDir, sectors)
+		if err != nil {
+			return fmt.Errorf("failed to fingerprint sector files: %v", err)
+		}
+		previous, err := loadCheckpoint(opts.Checkpoint)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case previous == nil:
+			if opts.Resume {
+				fmt.Fprintf(out, "No checkpoint found at %s, starting from the beginning\n", opts.Checkpoint)
+			}
+		case !opts.Resume:
+			return fmt.Errorf("checkpoint %s exists from an interrupted patch, use -resume to continue or remove it", opts.Checkpoint)
+		case previous.Device != opts.Device || previous.DeviceOffset != opts.DeviceOffset:
+			return fmt.Errorf("checkpoint %s was created for device %s (offset 0x%x)", opts.Checkpoint, previous.Device, previous.DeviceOffset)
+		case previous.SetHash != setHash || previous.Total != len(sectors) || previous.Applied > len(sectors):
+			fmt.Fprintln(out, "Sector files changed since the checkpoint was written, checkpoint invalidated, starting from the beginning")
+		default:
+			start = previous.Applied
+			fmt.Fprintf(out, "Resuming from checkpoint: %d of %d sectors already applied\n", start, len(sectors))
+		}
+
+		checkpoint = &PatchCheckpoint{
+			SetHash:      setHash,
+			Device:       opts.Device,
+			DeviceOffset: opts.DeviceOffset,
+			Total:        len(sectors),
+			Applied:      start,
+		}
+	}
+	report.Resumed = start
+
+	if opts.UndoDir != "" {
+		fmt.Fprintf(out, "Undo directory: %s\n", opts.UndoDir)
+		// 继续中断的补丁时，撤销目录中本来就有上一次保存的原始数据
+		if !opts.Resume {
+			if err := checkUndoDir(opts.UndoDir, opts.SectorDir); err != nil {
+				return err
+			}
+		}
+	} else {
+		fmt.Fprintln(out, "Undo directory: none (this patch cannot be undone)")
+	}
+	if opts.DryRun {
+		fmt.Fprintln(out, "\nDRY RUN MODE: No data will be written to the device")
+	}
+
+	// 只在非 dry-run 模式下请求确认，-yes 时改为核对调用方重复给出的目标设备信息
+	if !opts.DryRun && opts.Yes {
+		if err := confirmTarget(opts); err != nil {
+			report.Aborted = true
+			return err
+		}
+		fmt.Fprintln(out, "\nTarget confirmed by command line, proceeding without prompt")
+	} else if !opts.DryRun {
+		fmt.Fprint(out, "\nTo proceed, type 'YES' (case sensitive): ")
 		reader := bufio.NewReader(os.Stdin)
 		response, err := reader.ReadString('\n')
 		if err != nil {
 			return fmt.Errorf("failed to read response: %v", err)
 		}
 		if strings.TrimSpace(response) != "YES" {
-			fmt.Println("Operation cancelled by user")
+			fmt.Fprintln(out, "Operation cancelled by user")
+			report.Aborted = true
 			return nil
 		}
 	}
 
+	// 按写入位置合并相邻扇区
+	runs := buildPatchRuns(sectors, start, opts.DeviceOffset, opts.MaxWrite)
+	fmt.Fprintf(out, "Merged %d sectors into %d writes, using %d workers\n", len(sectors)-start, len(runs), opts.Workers)
+	progress.emit("start", map[string]any{
+		"device":        opts.Device,
+		"device_offset": opts.DeviceOffset,
+		"dry_run":       opts.DryRun,
+		"total":         len(sectors),
+		"resumed":       start,
+		"writes":        len(runs),
+	})
+
+	// O_DIRECT 要求偏移和长度都按块对齐
+	flags := os.O_RDWR
+	if opts.DryRun {
+		flags = os.O_RDONLY // 只读模式打开
+	}
+	if opts.Direct {
+		for _, run := range runs {
+			if run.offset%nbdbackend.DirectIOAlignment != 0 || run.size%nbdbackend.DirectIOAlignment != 0 {
+				return fmt.Errorf("-direct requires device offset and sector size aligned to %d bytes", nbdbackend.DirectIOAlignment)
+			}
+			if run.offset+run.size > deviceSize && (deviceSize-run.offset)%nbdbackend.DirectIOAlignment != 0 {
+				return fmt.Errorf("-direct requires the target size aligned to %d bytes when the last sector crosses its end", nbdbackend.DirectIOAlignment)
+			}
+		}
+		flags |= syscall.O_DIRECT
+	}
+
+	// 块设备以 O_EXCL 打开，已挂载时拒绝写入
+	if fi, err := os.Stat(opts.Device); err == nil && fi.Mode()&os.ModeDevice != 0 && !opts.DryRun {
+		flags |= syscall.O_EXCL
+	}
+
 	// 打开目标设备/文件
-	var dev *os.File
-	if dryRun {
-		dev, err = os.OpenFile(device, os.O_RDONLY, 0666) // 只读模式打开
-		if err != nil {
+	dev, err := os.OpenFile(opts.Device, flags, 0666)
+	if err != nil {
+		if opts.DryRun {
 			return fmt.Errorf("failed to open device in read-only mode: %v", err)
 		}
-	} else {
-		dev, err = os.OpenFile(device, os.O_RDWR, 0666)
-		if err != nil {
-			return fmt.Errorf("failed to open device/file: %v", err)
-		}
+		return fmt.Errorf("failed to open device/file: %v", err)
 	}
 	defer dev.Close()
 
-	// 写入扇区文件
-	fmt.Println("\nApplying sectors...")
-	for _, s := range sectors {
-		// 计算实际写入位置（扇区号 * 扇区大小 + 设备偏移）
-		actualOffset := (s.Offset * s.Size) + deviceOffset
+	// 先保存原始数据，全部保存成功后才开始写入
+	if opts.UndoDir != "" {
+		if opts.DryRun {
+			fmt.Fprintf(out, "\nWould save original data of %d sectors to %s\n", len(sectors)-start, opts.UndoDir)
+		} else {
+			fmt.Fprintln(out, "\nSaving original data to undo directory...")
+
+			// 撤销目录记录目标设备的大小和标识，头部会被本次补丁修改，不记录头部哈希
+			undoMeta := &nbdbackend.Metadata{SectorSize: sectorSize}
+			if target, err := targetFingerprint(opts.Device); err == nil {
+				target.HeaderHash = ""
+				undoMeta.Base = target
+			}
+			if err := nbdbackend.SaveMetadata(opts.UndoDir, undoMeta); err != nil {
+				report.Aborted = true
+				return fmt.Errorf("failed to write undo metadata: %v", err)
+			}
 
-		if dryRun {
-			// 尝试 seek 到目标位置
-			if _, err := dev.Seek(actualOffset, io.SeekStart); err != nil {
-				return fmt.Errorf("failed to seek to offset 0x%x: %v", actualOffset, err)
+			var undoErr error
+			runPatchJobs(runs, opts.Workers, func(run patchRun, buf []byte) runResult {
+				return runResult{err: saveUndoRun(dev, sectors, run, buf, opts.UndoDir, deviceSize)}
+			}, func(i int, result runResult) bool {
+				if result.err != nil && undoErr == nil {
+					undoErr = result.err
+				}
+				return undoErr == nil
+			})
+			if undoErr != nil {
+				report.Aborted = true
+				return undoErr
 			}
-			fmt.Printf("Would apply sector %s to offset 0x%x (sector: 0x%x * size: %d + device-offset: 0x%x), size %d bytes\n",
-				filepath.Base(s.Path), actualOffset, s.Offset, s.Size, deviceOffset, s.Size)
-			continue
+			fmt.Fprintf(out, "Saved original data of %d sectors, use 'snap-nbd unpatch -undo-dir %s' to restore\n", len(sectors)-start, opts.UndoDir)
+			progress.emit("undo", map[string]any{"undo_dir": opts.UndoDir, "sectors": len(sectors) - start})
 		}
+	}
 
-		// 打开扇区文件
-		sectorFile, err := os.Open(s.Path)
-		if err != nil {
-			log.Printf("Failed to open sector file %s: %v", s.Path, err)
-			continue
+	// 检查点只能记录已经同步到设备的连续前缀，先同步设备再更新检查点
+	lastCheckpoint := time.Now()
+	updateCheckpoint := func(applied int) error {
+		if err := dev.Sync(); err != nil {
+			return fmt.Errorf("failed to sync device: %v", err)
+		}
+		checkpoint.Applied = applied
+		if err := saveCheckpoint(opts.Checkpoint, checkpoint); err != nil {
+			return fmt.Errorf("failed to write checkpoint: %v", err)
+		}
+		lastCheckpoint = time.Now()
+		progress.emit("checkpoint", map[string]any{"applied": applied})
+		return nil
+	}
+	if checkpoint != nil {
+		if err := updateCheckpoint(start); err != nil {
+			return err
 		}
+	}
+
+	// 并发写入扇区文件
+	fmt.Fprintln(out, "\nApplying sectors...")
+	prefix := start // 从头开始连续写入成功的扇区数
+	var bytesDone int64
+	runOK := make([]bool, len(runs))
+	prefixRun := 0
+	var fatalErr error
+	runPatchJobs(runs, opts.Workers, func(run patchRun, buf []byte) runResult {
+		return applyRun(dev, sectors, run, buf, opts, deviceSize)
+	}, func(ri int, result runResult) bool {
+		run := runs[ri]
+		for i := run.first; i < run.first+run.count; i++ {
+			s := sectors[i]
+			// 计算实际写入位置（扇区号 * 扇区大小 + 设备偏移）
+			actualOffset := (s.Offset * s.Size) + opts.DeviceOffset
+
+			if applyErr, ok := result.failed[i]; ok {
+				log.Printf("Failed to apply sector file %s: %v", s.Path, applyErr)
+				report.Failed = append(report.Failed, PatchFailure{
+					Path:     s.Path,
+					Sector:   s.Offset,
+					Offset:   actualOffset,
+					Attempts: result.attempts,
+					Error:    applyErr.Error(),
+				})
+				progress.emit("failed", map[string]any{
+					"path":   s.Path,
+					"sector": s.Offset,
+					"offset": actualOffset,
+					"error":  applyErr.Error(),
+				})
+				continue
+			}
 
-		// 定位到目标位置
-		if _, err := dev.Seek(actualOffset, io.SeekStart); err != nil {
-			log.Printf("Failed to seek to offset %d in device: %v", actualOffset, err)
-			sectorFile.Close()
-			continue
+			report.Applied++
+			bytesDone += s.Size
+			if opts.DryRun {
+				fmt.Fprintf(out, "Would apply sector %s to offset 0x%x (sector: 0x%x * size: %d + device-offset: 0x%x), size %d bytes\n",
+					filepath.Base(s.Path), actualOffset, s.Offset, s.Size, opts.DeviceOffset, s.Size)
+			} else {
+				fmt.Fprintf(out, "Applied sector %s to offset 0x%x (sector: 0x%x * size: %d + device-offset: 0x%x), size %d bytes\n",
+					filepath.Base(s.Path), actualOffset, s.Offset, s.Size, opts.DeviceOffset, s.Size)
+			}
 		}
 
-		// 写入数据
-		if _, err := io.CopyN(dev, sectorFile, s.Size); err != nil {
-			log.Printf("Failed to write sector file %s to device: %v", s.Path, err)
-			sectorFile.Close()
-			continue
+		progress.emit("progress", map[string]any{
+			"applied": report.Resumed + report.Applied,
+			"failed":  len(report.Failed),
+			"total":   report.Total,
+			"bytes":   bytesDone,
+			"percent": float64(report.Resumed+report.Applied+len(report.Failed)) * 100 / float64(max(report.Total, 1)),
+		})
+
+		if len(result.failed) > 0 {
+			if opts.Strict {
+				report.Aborted = true
+				return false
+			}
+			return true
 		}
 
-		fmt.Printf("Applied sector %s to offset 0x%x (sector: 0x%x * size: %d + device-offset: 0x%x), size %d bytes\n",
-			filepath.Base(s.Path), actualOffset, s.Offset, s.Size, deviceOffset, s.Size)
-		sectorFile.Close()
+		// 推进连续写入成功的前缀，并定期更新检查点
+		runOK[ri] = true
+		for prefixRun < len(runs) && runOK[prefixRun] {
+			prefix = runs[prefixRun].first + runs[prefixRun].count
+			prefixRun++
+		}
+		if checkpoint != nil && time.Since(lastCheckpoint) >= checkpointInterval {
+			if err := updateCheckpoint(prefix); err != nil {
+				fatalErr = err
+				return false
+			}
+		}
+		return true
+	})
+	if fatalErr != nil {
+		return fatalErr
 	}
 
-	if dryRun {
-		fmt.Println("\nDry run completed successfully (no data was written)")
-	} else {
-		fmt.Println("Note: The data is still being written to the device in the background.")
-		fmt.Println("Please wait for this program to exit before proceeding.")
-		fmt.Println("\n!!! DO NOT MANUALLY CLOSE THIS PROGRAM !!!")
+	if !opts.DryRun {
+		fmt.Fprintln(out, "Note: The data is still being written to the device in the background.")
+		fmt.Fprintln(out, "Please wait for this program to exit before proceeding.")
+		fmt.Fprintln(out, "\n!!! DO NOT MANUALLY CLOSE THIS PROGRAM !!!")
 
-		// 强制同步所有写入到设备
+		// 强制同步所有写入到设备，即使部分扇区失败也要保证已写入的数据落盘
 		if err := dev.Sync(); err != nil {
 			return fmt.Errorf("failed to sync device: %v", err)
 		}
 
-		fmt.Println("\nApply completed successfully")
+		// 全部写入成功后删除检查点，否则保留进度以便 -resume 重试失败的扇区
+		if checkpoint != nil {
+			if prefix == len(sectors) {
+				if err := os.Remove(opts.Checkpoint); err != nil && !os.IsNotExist(err) {
+					log.Printf("Failed to remove checkpoint %s: %v", opts.Checkpoint, err)
+				}
+			} else {
+				if err := updateCheckpoint(prefix); err != nil {
+					return err
+				}
+				fmt.Fprintf(out, "\nProgress saved to %s, rerun with -resume to continue\n", opts.Checkpoint)
+			}
+		}
+	}
+
+	// 显示失败汇总
+	if len(report.Failed) > 0 || len(report.Invalid) > 0 {
+		fmt.Fprintf(out, "\nApplied %d of %d sectors\n", report.Resumed+report.Applied, report.Total)
+		for _, f := range report.Failed {
+			fmt.Fprintf(out, "  FAILED %s (offset 0x%x, %d attempts): %s\n", f.Path, f.Offset, f.Attempts, f.Error)
+		}
+		for _, path := range report.Invalid {
+			fmt.Fprintf(out, "  INVALID %s\n", path)
+		}
+		if report.Aborted {
+			return fmt.Errorf("aborted after failing to apply %s", report.Failed[len(report.Failed)-1].Path)
+		}
+		return fmt.Errorf("%d sectors failed to apply and %d files were skipped", len(report.Failed), len(report.Invalid))
+	}
+
+	if opts.DryRun {
+		fmt.Fprintln(out, "\nDry run completed successfully (no data was written)")
+	} else {
+		fmt.Fprintln(out, "\nApply completed successfully")
 	}
 
 	return nil
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	nbdbackend "nbd/backend"
+)
+
+// patchRun 是一组在目标设备上首尾相连的扇区，合并成一次顺序写入
+type patchRun struct {
+	first    int   // 在排序后的扇区列表中的起始下标
+	count    int   // 扇区个数
+	offset   int64 // 目标设备上的起始位置
+	size     int64 // 总字节数
+	overlaps bool  // 是否与之前的写入区域重叠，重叠时必须等之前的写入全部完成
+}
+
+// buildPatchRuns 把排序后的扇区合并成连续写入，每次写入不超过 maxWrite 字节
+func buildPatchRuns(sectors []SectorInfo, start int, deviceOffset, maxWrite int64) []patchRun {
+	var runs []patchRun
+	var maxEnd int64
+	for i := start; i < len(sectors); i++ {
+		s := sectors[i]
+		offset := s.Offset*s.Size + deviceOffset
+		if n := len(runs); n > 0 {
+			last := &runs[n-1]
+			prev := sectors[last.first+last.count-1]
+			if prev.Size == s.Size && last.offset+last.size == offset && last.size+s.Size <= maxWrite {
+				last.count++
+				last.size += s.Size
+				maxEnd = max(maxEnd, offset+s.Size)
+				continue
+			}
+		}
+		runs = append(runs, patchRun{
+			first:    i,
+			count:    1,
+			offset:   offset,
+			size:     s.Size,
+			overlaps: len(runs) > 0 && offset < maxEnd,
+		})
+		maxEnd = max(maxEnd, offset+s.Size)
+	}
+	return runs
+}
+
+// readSectorInto 把扇区文件的内容读入 data，文件长度不足或校验失败时返回错误
+func readSectorInto(s SectorInfo, data []byte) error {
+	sector, err := nbdbackend.ReadSectorFile(s.Path, s.Size)
+	if err != nil {
+		return fmt.Errorf("failed to read sector file: %v", err)
+	}
+	copy(data, sector)
+	return nil
+}
+
+// writeRun 读取一组扇区文件并一次写入目标设备，dryRun 时只读取扇区文件
+// 最后一个扇区跨过目标末尾 targetSize 时只写入末尾之前的部分，超出的部分必须全为零
+func writeRun(dev *os.File, sectors []SectorInfo, run patchRun, buf []byte, dryRun bool, targetSize int64) error {
+	data := buf[:run.size]
+	var pos int64
+	for i := run.first; i < run.first+run.count; i++ {
+		s := sectors[i]
+		if err := readSectorInto(s, data[pos:pos+s.Size]); err != nil {
+			return fmt.Errorf("%s: %v", s.Path, err)
+		}
+		pos += s.Size
+	}
+
+	if run.offset+run.size > targetSize {
+		tail := data[targetSize-run.offset:]
+		if !bytes.Equal(tail, make([]byte, len(tail))) {
+			return fmt.Errorf("%d bytes beyond the end of the target (size %d) are not zero", len(tail), targetSize)
+		}
+		data = data[:targetSize-run.offset]
+	}
+
+	if dryRun {
+		return nil
+	}
+	if _, err := dev.WriteAt(data, run.offset); err != nil {
+		return fmt.Errorf("failed to write to device at offset 0x%x: %v", run.offset, err)
+	}
+	return nil
+}
+
+// applyRun 写入一组扇区，合并写入失败时逐个扇区重试，把错误定位到具体的扇区
+func applyRun(dev *os.File, sectors []SectorInfo, run patchRun, buf []byte, opts PatchOptions, targetSize int64) runResult {
+	attempts, err := applyWithRetry(opts.Retries, sectors[run.first].Path, func() error {
+		return writeRun(dev, sectors, run, buf, opts.DryRun, targetSize)
+	})
+	if err == nil {
+		return runResult{attempts: attempts}
+	}
+	if run.count == 1 {
+		return runResult{attempts: attempts, failed: map[int]error{run.first: err}}
+	}
+
+	failed := make(map[int]error)
+	offset := run.offset
+	for i := run.first; i < run.first+run.count; i++ {
+		single := patchRun{first: i, count: 1, offset: offset, size: sectors[i].Size}
+		n, err := applyWithRetry(opts.Retries, sectors[i].Path, func() error {
+			return writeRun(dev, sectors, single, buf, opts.DryRun, targetSize)
+		})
+		attempts += n
+		if err != nil {
+			failed[i] = err
+		}
+		offset += sectors[i].Size
+	}
+	return runResult{attempts: attempts, failed: failed}
+}
+
+// saveUndoRun 一次读出一组扇区在目标设备上的原始数据，再拆分保存为撤销目录中的扇区文件
+// 继续中断的补丁时，已有的撤销文件保存的才是真正的原始数据，不能覆盖
+// 跨过目标末尾 targetSize 的部分按零保存
+func saveUndoRun(dev *os.File, sectors []SectorInfo, run patchRun, buf []byte, undoDir string, targetSize int64) error {
+	data := buf[:run.size]
+	n := min(run.size, targetSize-run.offset)
+	if _, err := dev.ReadAt(data[:n], run.offset); err != nil {
+		return fmt.Errorf("failed to read original data at offset 0x%x: %v", run.offset, err)
+	}
+	clear(data[n:])
+
+	var pos int64
+	for i := run.first; i < run.first+run.count; i++ {
+		s := sectors[i]
+		undoPath := nbdbackend.SectorPath(undoDir, s.Offset, s.Size)
+		if _, err := os.Stat(undoPath); err != nil {
+			if err := writeFileSync(undoPath, nbdbackend.AppendChecksum(data[pos:pos+s.Size])); err != nil {
+				return fmt.Errorf("failed to save undo sector %s: %v", undoPath, err)
+			}
+		}
+		pos += s.Size
+	}
+	return nil
+}
+
+// runResult 是一个 patchRun 的处理结果
+type runResult struct {
+	attempts int           // 总尝试次数
+	failed   map[int]error // 写入失败的扇区下标及错误
+	err      error         // 整体失败的错误
+}
+
+// runPatchJobs 用 workers 个协程并发处理 runs，每个协程有自己的对齐缓冲区
+// done 在调用方协程中按完成顺序回调，返回 false 时不再派发新的任务
+func runPatchJobs(runs []patchRun, workers int, work func(run patchRun, buf []byte) runResult, done func(i int, result runResult) bool) {
+	if len(runs) == 0 {
+		return
+	}
+	var bufSize int64
+	for _, run := range runs {
+		bufSize = max(bufSize, run.size)
+	}
+	workers = max(1, min(workers, len(runs)))
+
+	type jobResult struct {
+		index  int
+		result runResult
+	}
+	jobs := make(chan int)
+	results := make(chan jobResult)
+	for w := 0; w < workers; w++ {
+		go func() {
+			buf := nbdbackend.AlignedBuffer(int(bufSize), nbdbackend.DirectIOAlignment)
+			for i := range jobs {
+				results <- jobResult{index: i, result: work(runs[i], buf)}
+			}
+		}()
+	}
+
+	next, inFlight := 0, 0
+	stopped := false
+	for (next < len(runs) && !stopped) || inFlight > 0 {
+		// 与之前的写入重叠的任务必须等其他任务完成后单独执行，保证写入顺序
+		var jobCh chan int
+		if next < len(runs) && !stopped && inFlight < workers && !(runs[next].overlaps && inFlight > 0) {
+			jobCh = jobs
+		}
+
+		select {
+		case jobCh <- next:
+			next++
+			inFlight++
+		case r := <-results:
+			inFlight--
+			if !done(r.index, r.result) {
+				stopped = true
+			}
+		}
+	}
+	close(jobs)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	nbdbackend "nbd/backend"
+)
+
+// oddTargetSize 是测试用的目标大小，最后一个 4096 字节的扇区只有 1000 字节在目标范围内
+const oddTargetSize = 2*4096 + 1000
+
+// newOddTarget 创建一个 oddTargetSize 字节、内容随机的目标文件，返回打开的文件和内容
+func newOddTarget(t *testing.T) (*os.File, []byte) {
+	t.Helper()
+	path, data := newRandomFile(t, t.TempDir(), "target.img", oddTargetSize)
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f, data
+}
+
+// writeTailSector 在新的扇区目录中写入最后一个扇区，返回扇区列表和对应的写入
+func writeTailSector(t *testing.T, data []byte) ([]SectorInfo, patchRun) {
+	t.Helper()
+	path := nbdbackend.SectorPath(t.TempDir(), 2, 4096)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, nbdbackend.AppendChecksum(data), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return []SectorInfo{{Path: path, Offset: 2, Size: 4096}}, patchRun{first: 0, count: 1, offset: 2 * 4096, size: 4096}
+}
+
+// readTarget 读出目标文件的全部内容
+func readTarget(t *testing.T, f *os.File) []byte {
+	t.Helper()
+	got, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestWriteRunTail(t *testing.T) {
+	f, want := newOddTarget(t)
+	sector := make([]byte, 4096)
+	copy(sector, bytes.Repeat([]byte{0x5a}, 1000))
+	sectors, run := writeTailSector(t, sector)
+
+	if err := writeRun(f, sectors, run, make([]byte, 4096), false, oddTargetSize); err != nil {
+		t.Fatal(err)
+	}
+	// 只写入末尾之前的 1000 字节，目标不会被扩大
+	copy(want[2*4096:], sector[:1000])
+	if got := readTarget(t, f); !bytes.Equal(got, want) {
+		t.Fatalf("target differs after writing the tail (%d bytes, want %d)", len(got), len(want))
+	}
+}
+
+func TestWriteRunNonZeroTail(t *testing.T) {
+	f, want := newOddTarget(t)
+	sector := make([]byte, 4096)
+	sector[1000] = 1
+	sectors, run := writeTailSector(t, sector)
+
+	if err := writeRun(f, sectors, run, make([]byte, 4096), false, oddTargetSize); err == nil {
+		t.Fatal("writeRun accepted non-zero bytes beyond the end of the target")
+	}
+	if got := readTarget(t, f); !bytes.Equal(got, want) {
+		t.Fatal("rejected writeRun modified the target")
+	}
+}
+
+func TestSaveUndoRunTail(t *testing.T) {
+	f, data := newOddTarget(t)
+	sectors, run := writeTailSector(t, make([]byte, 4096))
+	undoDir := t.TempDir()
+
+	buf := bytes.Repeat([]byte{0xff}, 4096)
+	if err := saveUndoRun(f, sectors, run, buf, undoDir, oddTargetSize); err != nil {
+		t.Fatal(err)
+	}
+	// 撤销数据是末尾之前的原始内容，超出末尾的部分补零
+	undo, err := nbdbackend.ReadSectorFile(nbdbackend.SectorPath(undoDir, 2, 4096), 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append(append([]byte{}, data[2*4096:]...), make([]byte, 4096-1000)...)
+	if !bytes.Equal(undo, want) {
+		t.Fatal("undo sector does not hold the original tail followed by zeros")
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// progressStream 以每行一个 JSON 对象的形式输出进度事件，供自动化工具解析
+// 未启用时所有方法都不输出
+type progressStream struct {
+	enc *json.Encoder
+}
+
+// newProgressStream 创建进度输出，w 为 nil 表示不输出
+func newProgressStream(w io.Writer) *progressStream {
+	if w == nil {
+		return &progressStream{}
+	}
+	return &progressStream{enc: json.NewEncoder(w)}
+}
+
+// emit 输出一个事件，fields 会与事件名和时间合并到同一个对象中
+func (p *progressStream) emit(event string, fields map[string]any) {
+	if p.enc == nil {
+		return
+	}
+	obj := map[string]any{
+		"event": event,
+		"time":  time.Now().Format(time.RFC3339Nano),
+	}
+	for k, v := range fields {
+		obj[k] = v
+	}
+	p.enc.Encode(obj)
+}
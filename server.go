@@ -1,18 +1,23 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"slices"
 	"syscall"
+	"time"
 
 	nbdbackend "nbd/backend"
+	"nbd/image"
+	"nbd/server"
 
 	"github.com/pojntfx/go-nbd/pkg/backend"
-	"github.com/pojntfx/go-nbd/pkg/server"
 )
 
 type AppendWriter struct {
@@ -37,7 +42,115 @@ func (w *AppendWriter) Close() error {
 	return nil
 }
 
-func startServer(device, sectorDir, listenAddr string, sectorSize int64, logFile string, filterSize uint, filterFalsePositiveRate float64, cacheSize int, enablePrefetch bool, prefetchMultiplier, maxConsecutiveReads int) error {
+// 基础设备被修改后的处理方式
+const (
+	baseChangeReadOnly = "readonly" // 拒绝写入，仍可读取
+	baseChangeError    = "error"    // 读写都返回错误
+)
+
+// baseFormatName 返回指纹中记录的基础镜像格式名称，空表示 raw
+func baseFormatName(format string) string {
+	if format == "" {
+		return image.FormatRaw
+	}
+	return format
+}
+
+// prepareMetadata 在扇区目录中记录基础设备的指纹和下层目录，已有元数据时核对扇区大小和基础设备
+func prepareMetadata(device, sectorDir string, sectorSize int64, base backend.Backend, lowerDirs []string) error {
+	meta, err := nbdbackend.LoadMetadata(sectorDir)
+	if err != nil {
+		return err
+	}
+	if meta != nil && meta.SectorSize != 0 && meta.SectorSize != sectorSize {
+		return fmt.Errorf("sector directory was created with sector size %d, but -sector-size is %d", meta.SectorSize, sectorSize)
+	}
+
+	// 空白磁盘没有基础设备，不记录指纹，但不能用于原本基于某个设备创建的扇区目录
+	var fp *nbdbackend.Fingerprint
+	if device == "" {
+		if meta != nil && meta.Base != nil {
+			return fmt.Errorf("sector directory was created on base device %s, use -device", meta.Base.Path)
+		}
+	} else {
+		if meta.IsBlank() {
+			return fmt.Errorf("sector directory %s is a blank disk created without a base device, omit -device", sectorDir)
+		}
+		size, err := base.Size()
+		if err != nil {
+			return fmt.Errorf("failed to get device size: %v", err)
+		}
+		if fp, err = nbdbackend.ComputeFingerprint(device, base, size); err != nil {
+			return err
+		}
+		// 记录镜像格式，离线命令据此打开基础设备，不需要自动识别
+		if img, ok := base.(image.Image); ok && img.Format() != image.FormatRaw {
+			fp.Format = img.Format()
+		}
+	}
+
+	// 下层目录记录为绝对路径，convert 等离线命令据此还原完整的快照链
+	lower := make([]string, 0, len(lowerDirs))
+	for _, dir := range lowerDirs {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		lower = append(lower, abs)
+	}
+
+	changed := false
+	if meta == nil {
+		meta = &nbdbackend.Metadata{SectorSize: sectorSize}
+		changed = true
+	}
+	switch {
+	case fp == nil:
+		// 空白磁盘，没有需要记录的指纹
+	case meta.Base != nil:
+		// 基础设备可能被合法地修改过（例如已经应用过补丁），只给出警告，保留最初的指纹
+		if err := meta.Base.Match(fp); err != nil {
+			log.Printf("Warning: base device does not match the fingerprint recorded in %s: %v", sectorDir, err)
+		}
+		// 旧的元数据没有记录格式，补充记录；格式与记录的不同时只给出警告
+		switch {
+		case meta.Base.Format == fp.Format:
+		case meta.Base.Format == "" && meta.Base.Match(fp) == nil:
+			meta.Base.Format = fp.Format
+			changed = true
+		default:
+			log.Printf("Warning: base device was recorded as a %s image in %s, now opened as %s", baseFormatName(meta.Base.Format), sectorDir, baseFormatName(fp.Format))
+		}
+	default:
+		meta.SectorSize = sectorSize
+		meta.Base = fp
+		changed = true
+		fmt.Printf("Recorded base fingerprint in %s\n", sectorDir)
+	}
+	if !slices.Equal(meta.Lower, lower) {
+		if len(meta.Lower) > 0 {
+			log.Printf("Lower directories of %s changed from %v to %v", sectorDir, meta.Lower, lower)
+		}
+		meta.Lower = lower
+		changed = true
+	}
+
+	if changed {
+		if err := nbdbackend.SaveMetadata(sectorDir, meta); err != nil {
+			return fmt.Errorf("failed to write metadata: %v", err)
+		}
+	}
+	return nil
+}
+
+func startServer(device, deviceFormat string, lowerDirs []string, sectorDir, listenAddr string, sectorSize int64, logFile string, filterSize uint, filterFalsePositiveRate float64, cacheSize int, enablePrefetch bool, prefetchMultiplier, maxConsecutiveReads int, verifyPolicy string, scrubInterval time.Duration, scrubRate int64, durability string, size int64, adminListen string, direct bool, ioEngine string, exclusive bool, baseCheckInterval time.Duration, onBaseChange string) error {
+	if err := checkIOEngine(ioEngine); err != nil {
+		return err
+	}
+	if onBaseChange != baseChangeReadOnly && onBaseChange != baseChangeError {
+		return fmt.Errorf("unknown -on-base-change action %s, use readonly or error", onBaseChange)
+	}
+
 	// 设置日志输出
 	var logger io.Writer = os.Stderr
 	if logFile != "" {
@@ -45,37 +158,200 @@ func startServer(device, sectorDir, listenAddr string, sectorSize int64, logFile
 		logger = writer
 	}
 
-	// 检查设备类型
-	fi, err := os.Stat(device)
+	// 创建基础后端
+	var baseBackend backend.Backend
+	var baseState *nbdbackend.BaseState
+	if device == "" {
+		// 没有基础设备时以全零设备为基础，扇区目录就是一块独立的精简置备磁盘
+		if size == 0 {
+			meta, err := nbdbackend.LoadMetadata(sectorDir)
+			if err != nil {
+				return err
+			}
+			if meta != nil && meta.Base != nil {
+				return fmt.Errorf("sector directory was created on base device %s, use -device", meta.Base.Path)
+			}
+			if meta != nil {
+				size = meta.Size
+			}
+		}
+		if size == 0 {
+			return fmt.Errorf("either -device or -size is required")
+		}
+		baseBackend = nbdbackend.NewZeroBackend(size)
+		fmt.Printf("No base device, serving a blank %s disk\n", formatBytes(size))
+	} else {
+		// 检查设备类型
+		fi, err := os.Stat(device)
+		if err != nil {
+			return fmt.Errorf("device or file does not exist: %v", err)
+		}
+
+		// 对基础设备加共享锁，patch 等需要写入它的命令无法同时运行
+		baseLock, err := nbdbackend.LockBase(device, false)
+		if err != nil {
+			return err
+		}
+		defer baseLock.Unlock()
+		if baseState, err = nbdbackend.ReadBaseState(device); err != nil {
+			return fmt.Errorf("failed to read base device state: %v", err)
+		}
+
+		// qcow2/VHD/VHDX/VMDK 镜像以只读方式作为基础后端，写入全部落在扇区目录中
+		// 只有 -device-format auto 时才识别格式，识别出的镜像不能引用其他文件
+		if deviceFormat == "" {
+			deviceFormat = image.FormatRaw
+		}
+		format := deviceFormat
+		if fi.Mode()&os.ModeDevice == 0 && format == "auto" {
+			if format, err = image.Detect(device); err != nil {
+				return fmt.Errorf("failed to detect image format: %v", err)
+			}
+		}
+
+		if format != "auto" && format != image.FormatRaw {
+			img, err := image.Open(device, deviceFormat)
+			if err != nil {
+				return fmt.Errorf("failed to open %s image: %v", format, err)
+			}
+			defer img.Close()
+			size, _ := img.Size()
+			fmt.Printf("Opened %s image %s, virtual size %d bytes\n", format, device, size)
+			baseBackend = img
+		} else if fi.Mode()&os.ModeDevice != 0 || direct || ioEngine == ioEngineUring {
+			// 块设备，或以 O_DIRECT、io_uring 读写的 raw 文件
+			devBackend, err := nbdbackend.NewDeviceBackend(device, direct, exclusive)
+			if err != nil && errors.Is(err, syscall.EBUSY) {
+				return fmt.Errorf("failed to create block device backend: %v (servers sharing a base device need -exclusive=false)", err)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to create block device backend: %v", err)
+			}
+			defer devBackend.Close()
+			if direct {
+				fmt.Printf("Opened %s with O_DIRECT, logical block size %d bytes\n", device, devBackend.BlockSize())
+			}
+			if ioEngine == ioEngineUring {
+				if err := devBackend.EnableIOUring(uringEntries); err != nil {
+					log.Printf("io_uring unavailable (%v), falling back to pread/pwrite", err)
+				} else {
+					fmt.Printf("Using io_uring for %s\n", device)
+				}
+			}
+			baseBackend = devBackend
+		} else {
+			// 普通文件
+			f, err := os.OpenFile(device, os.O_RDWR, 0666)
+			if err != nil {
+				return fmt.Errorf("failed to open file: %v", err)
+			}
+			defer f.Close()
+			baseBackend = backend.NewFileBackend(f)
+		}
+	}
+
+	// 扇区文件校验失败时的处理方式
+	policy, err := nbdbackend.ParseVerifyPolicy(verifyPolicy)
 	if err != nil {
-		return fmt.Errorf("device or file does not exist: %v", err)
+		return err
 	}
 
-	// 创建基础后端
-	var baseBackend backend.Backend
-	if fi.Mode()&os.ModeDevice != 0 {
-		// 块设备
-		devBackend, err := nbdbackend.NewDeviceBackend(device)
+	// 覆盖层写入何时落盘
+	durabilityMode, err := nbdbackend.ParseDurabilityMode(durability)
+	if err != nil {
+		return err
+	}
+
+	// 依次叠加只读的下层目录（快照链），加共享锁防止被 merge 修改
+	layers := make([]*nbdbackend.CowBackend, 0, len(lowerDirs)+1)
+	var lower backend.Backend = baseBackend
+	for _, dir := range lowerDirs {
+		if _, err := os.Stat(dir); err != nil {
+			return fmt.Errorf("lower directory: %v", err)
+		}
+		meta, err := nbdbackend.LoadMetadata(dir)
 		if err != nil {
-			return fmt.Errorf("failed to create block device backend: %v", err)
+			return err
 		}
-		defer devBackend.Close()
-		baseBackend = devBackend
-	} else {
-		// 普通文件
-		f, err := os.OpenFile(device, os.O_RDWR, 0666)
+		if meta != nil && meta.SectorSize != 0 && meta.SectorSize != sectorSize {
+			return fmt.Errorf("lower directory %s uses sector size %d, but -sector-size is %d", dir, meta.SectorSize, sectorSize)
+		}
+		lock, err := nbdbackend.LockDir(dir, false)
+		if err != nil {
+			return err
+		}
+		defer lock.Unlock()
+
+		layer, err := nbdbackend.NewCowBackend(lower, dir, sectorSize, filterSize, filterFalsePositiveRate, cacheSize)
 		if err != nil {
-			return fmt.Errorf("failed to open file: %v", err)
+			return fmt.Errorf("failed to open lower directory %s: %v", dir, err)
+		}
+		if err := restoreSize(layer, meta); err != nil {
+			return fmt.Errorf("lower directory %s: %v", dir, err)
 		}
-		defer f.Close()
-		baseBackend = backend.NewFileBackend(f)
+		layers = append(layers, layer)
+		lower = layer
 	}
 
+	// 可写的扇区目录加排他锁，同一目录不能同时被两个服务器或离线命令修改
+	lock, err := nbdbackend.LockDir(sectorDir, true)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
 	// 创建 COW 后端
-	cowBackend, err := nbdbackend.NewCowBackend(baseBackend, sectorDir, sectorSize, filterSize, filterFalsePositiveRate, cacheSize)
+	cowBackend, err := nbdbackend.NewCowBackend(lower, sectorDir, sectorSize, filterSize, filterFalsePositiveRate, cacheSize)
 	if err != nil {
 		return fmt.Errorf("failed to create COW backend: %v", err)
 	}
+	cowBackend.SetDurability(durabilityMode)
+	layers = append(layers, cowBackend)
+
+	// 后台定期校验所有层的扇区目录
+	for _, layer := range layers {
+		layer.SetVerifyPolicy(policy)
+		if scrubInterval > 0 {
+			layer.StartScrubber(scrubInterval, scrubRate, make(chan struct{}))
+		}
+	}
+	if scrubInterval > 0 {
+		fmt.Printf("Scrubbing sector files every %v\n", scrubInterval)
+	}
+
+	// 后台检查基础设备是否被其他程序修改，修改后覆盖层看到的数据已经不一致，停止写入或停止服务
+	if baseState != nil && baseCheckInterval > 0 {
+		nbdbackend.WatchBase(device, baseState, baseCheckInterval, func(err error) {
+			if onBaseChange == baseChangeReadOnly {
+				log.Printf("Export is now read-only, restart the server after checking the base device")
+			} else {
+				log.Printf("Export now fails all I/O, restart the server after checking the base device")
+			}
+			cowBackend.Fence(err, onBaseChange == baseChangeReadOnly)
+		}, make(chan struct{}))
+		fmt.Printf("Checking base device for changes every %v\n", baseCheckInterval)
+	}
+
+	// 记录基础设备指纹，patch 时用于确认目标设备
+	if err := prepareMetadata(device, sectorDir, sectorSize, baseBackend, lowerDirs); err != nil {
+		return err
+	}
+
+	// 虚拟大小可以超过基础设备，-size 指定时扩容并记录在元数据中
+	if err := resizeOverlay(cowBackend, sectorDir, size); err != nil {
+		return fmt.Errorf("failed to set virtual size: %v", err)
+	}
+	if size, err := cowBackend.Size(); err == nil {
+		fmt.Printf("Export size %d bytes\n", size)
+	}
+
+	// HTTP 管理接口，用于在线扩容
+	if adminListen != "" {
+		admin := &adminServer{cow: cowBackend, sectorDir: sectorDir, sectorSize: sectorSize}
+		if err := startAdmin(adminListen, admin); err != nil {
+			return err
+		}
+	}
 
 	// 如果启用预读取缓存，创建预读取后端
 	var backend backend.Backend = cowBackend
@@ -121,9 +397,14 @@ func startServer(device, sectorDir, listenAddr string, sectorSize int64, logFile
 					Name:        "disk",
 					Description: "cow disk",
 					Backend:     logBackend,
+					MultiConn:   true,
 				}},
 				&server.Options{
 					ReadOnly: false,
+					// 小于扇区的写入需要读改写，建议客户端按扇区大小对齐
+					MinimumBlockSize:   512,
+					PreferredBlockSize: uint32(sectorSize),
+					MaximumBlockSize:   server.DefaultMaximumBlockSize,
 				},
 			)
 			if err != nil {
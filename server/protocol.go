@@ -0,0 +1,107 @@
+package server
+
+// 协议常量，参见 https://github.com/NetworkBlockDevice/nbd/blob/master/doc/proto.md
+
+// 握手阶段
+const (
+	magicInit   = uint64(0x4e42444d41474943) // "NBDMAGIC"
+	magicOption = uint64(0x49484156454F5054) // "IHAVEOPT"
+	magicReply  = uint64(0x3e889045565a9)
+
+	flagFixedNewstyle = uint16(1 << 0)
+	flagNoZeroes      = uint16(1 << 1)
+
+	clientFlagFixedNewstyle = uint32(1 << 0)
+	clientFlagNoZeroes      = uint32(1 << 1)
+
+	optExportName      = uint32(1)
+	optAbort           = uint32(2)
+	optList            = uint32(3)
+	optStartTLS        = uint32(5)
+	optInfo            = uint32(6)
+	optGo              = uint32(7)
+	optStructuredReply = uint32(8)
+	optListMetaContext = uint32(9)
+	optSetMetaContext  = uint32(10)
+
+	repAck         = uint32(1)
+	repServer      = uint32(2)
+	repInfo        = uint32(3)
+	repMetaContext = uint32(4)
+
+	repErrUnsup   = uint32(1 | 1<<31)
+	repErrPolicy  = uint32(2 | 1<<31)
+	repErrInvalid = uint32(3 | 1<<31)
+	repErrUnknown = uint32(6 | 1<<31)
+	repErrTooBig  = uint32(9 | 1<<31)
+
+	infoExport      = uint16(0)
+	infoName        = uint16(1)
+	infoDescription = uint16(2)
+	infoBlockSize   = uint16(3)
+
+	// maxOptionLength 限制单个选项的数据长度，防止客户端让服务器分配过多内存
+	maxOptionLength = 64 << 10
+)
+
+// 传输标志
+const (
+	transHasFlags     = uint16(1 << 0)
+	transReadOnly     = uint16(1 << 1)
+	transSendFlush    = uint16(1 << 2)
+	transSendFUA      = uint16(1 << 3)
+	transSendDF       = uint16(1 << 7)
+	transCanMultiConn = uint16(1 << 8)
+)
+
+// 传输阶段
+const (
+	magicRequest          = uint32(0x25609513)
+	magicSimpleReply      = uint32(0x67446698)
+	magicStructuredReply  = uint32(0x668e33ef)
+	cmdRead               = uint16(0)
+	cmdWrite              = uint16(1)
+	cmdDisc               = uint16(2)
+	cmdFlush              = uint16(3)
+	cmdBlockStatus        = uint16(7)
+	cmdFlagFUA            = uint16(1 << 0)
+	cmdFlagDF             = uint16(1 << 2)
+	cmdFlagReqOne         = uint16(1 << 3)
+	replyFlagDone         = uint16(1 << 0)
+	replyTypeNone         = uint16(0)
+	replyTypeOffsetData   = uint16(1)
+	replyTypeOffsetHole   = uint16(2)
+	replyTypeBlockStatus  = uint16(5)
+	replyTypeError        = uint16(1<<15 | 1)
+	replyTypeErrorOffset  = uint16(1<<15 | 2)
+	requestHeaderLength   = 28
+	maxBlockStatusExtents = 1 << 16
+)
+
+// DefaultMaximumBlockSize 是默认的最大请求长度，更大的读写请求会被拒绝
+const DefaultMaximumBlockSize = 32 << 20
+
+// 错误码
+const (
+	errPerm     = uint32(1)
+	errIO       = uint32(5)
+	errNoMem    = uint32(12)
+	errInval    = uint32(22)
+	errNoSpc    = uint32(28)
+	errOverflow = uint32(75)
+	errNotSup   = uint32(95)
+)
+
+// 元数据上下文
+const (
+	// ContextBaseAllocation 是标准的分配状态上下文：区段是否为空洞、是否读出全零
+	ContextBaseAllocation = "base:allocation"
+	// ContextDirty 报告区段是否保存在覆盖层中（与基础设备不同），以及是否已知全零
+	ContextDirty = "snap-nbd:dirty"
+
+	stateHole = uint32(1 << 0) // base:allocation
+	stateZero = uint32(1 << 1) // base:allocation
+
+	DirtyOverlay = uint32(1 << 0) // snap-nbd:dirty：数据来自覆盖层
+	DirtyZero    = uint32(1 << 1) // snap-nbd:dirty：已知全零
+)
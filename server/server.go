@@ -0,0 +1,419 @@
+// Package server 实现 NBD 协议的服务端，在 go-nbd 的基础上增加了结构化回复和 NBD_CMD_BLOCK_STATUS
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/pojntfx/go-nbd/pkg/backend"
+)
+
+var (
+	ErrInvalidMagic = errors.New("invalid magic")
+)
+
+// Export 是一个可以被客户端连接的导出
+type Export struct {
+	Name        string
+	Description string
+
+	Backend backend.Backend
+
+	// MultiConn 表示 Backend 可以被多个连接同时使用，并且任一连接上的 flush 都覆盖所有连接已完成的写入，
+	// 为 true 时告知客户端可以为同一设备打开多个连接（NBD_FLAG_CAN_MULTI_CONN）
+	MultiConn bool
+}
+
+// Options 是服务端的选项，块大小为 0 时使用默认值
+// 块大小通过 NBD_INFO_BLOCK_SIZE 告知客户端：PreferredBlockSize 以下的写入需要读改写，
+// 超过 MaximumBlockSize 的读写请求会被拒绝
+type Options struct {
+	ReadOnly           bool
+	MinimumBlockSize   uint32
+	PreferredBlockSize uint32
+	MaximumBlockSize   uint32
+}
+
+// metaContext 是客户端通过 NBD_OPT_SET_META_CONTEXT 选中的元数据上下文
+type metaContext struct {
+	id   uint32
+	name string
+}
+
+// 本服务器提供的元数据上下文，ID 在所有连接中固定
+var supportedContexts = []metaContext{
+	{id: 1, name: ContextBaseAllocation},
+	{id: 2, name: ContextDirty},
+}
+
+// session 是一个客户端连接的状态
+type session struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	w       *bufio.Writer
+	exports []Export
+	options *Options
+
+	noZeroes   bool
+	structured bool
+
+	// 选中的元数据上下文及其对应的导出名
+	contexts      []metaContext
+	contextExport string
+
+	export *Export
+	size   int64
+}
+
+// Handle 在一个连接上完成握手并处理请求，直到客户端断开
+func Handle(conn net.Conn, exports []Export, options *Options) error {
+	if options == nil {
+		options = &Options{
+			ReadOnly: false,
+		}
+	}
+
+	if options.MinimumBlockSize == 0 {
+		options.MinimumBlockSize = 1
+	}
+
+	if options.PreferredBlockSize == 0 {
+		options.PreferredBlockSize = 4096
+	}
+
+	if options.MaximumBlockSize == 0 {
+		options.MaximumBlockSize = DefaultMaximumBlockSize
+	}
+
+	s := &session{
+		conn:    conn,
+		r:       bufio.NewReaderSize(conn, 128<<10),
+		w:       bufio.NewWriterSize(conn, 128<<10),
+		exports: exports,
+		options: options,
+	}
+
+	done, err := s.negotiate()
+	if err != nil || done {
+		return err
+	}
+	return s.transmit()
+}
+
+// findExport 按名称查找导出，空名称表示默认导出（第一个）
+func (s *session) findExport(name string) *Export {
+	if name == "" && len(s.exports) > 0 {
+		return &s.exports[0]
+	}
+	for i := range s.exports {
+		if s.exports[i].Name == name {
+			return &s.exports[i]
+		}
+	}
+	return nil
+}
+
+// transmissionFlags 返回导出的传输标志
+func (s *session) transmissionFlags(export *Export) uint16 {
+	flags := transHasFlags
+	if s.options.ReadOnly {
+		flags |= transReadOnly
+	} else {
+		flags |= transSendFlush | transSendFUA
+	}
+	if export.MultiConn {
+		flags |= transCanMultiConn
+	}
+	if s.structured {
+		flags |= transSendDF
+	}
+	return flags
+}
+
+// writeOptionReply 发送一个选项回复
+func (s *session) writeOptionReply(id, typ uint32, data []byte) error {
+	header := make([]byte, 20)
+	binary.BigEndian.PutUint64(header, magicReply)
+	binary.BigEndian.PutUint32(header[8:], id)
+	binary.BigEndian.PutUint32(header[12:], typ)
+	binary.BigEndian.PutUint32(header[16:], uint32(len(data)))
+	s.w.Write(header)
+	s.w.Write(data)
+	return s.w.Flush()
+}
+
+// negotiate 完成握手阶段，done 为 true 表示客户端已经中止，不进入传输阶段
+func (s *session) negotiate() (done bool, err error) {
+	header := make([]byte, 18)
+	binary.BigEndian.PutUint64(header, magicInit)
+	binary.BigEndian.PutUint64(header[8:], magicOption)
+	binary.BigEndian.PutUint16(header[16:], flagFixedNewstyle|flagNoZeroes)
+	s.w.Write(header)
+	if err := s.w.Flush(); err != nil {
+		return false, err
+	}
+
+	var clientFlags uint32
+	if err := binary.Read(s.r, binary.BigEndian, &clientFlags); err != nil {
+		return false, err
+	}
+	s.noZeroes = clientFlags&clientFlagNoZeroes != 0
+
+	for {
+		optionHeader := make([]byte, 16)
+		if _, err := io.ReadFull(s.r, optionHeader); err != nil {
+			return false, err
+		}
+		if binary.BigEndian.Uint64(optionHeader) != magicOption {
+			return false, ErrInvalidMagic
+		}
+		id := binary.BigEndian.Uint32(optionHeader[8:])
+		length := binary.BigEndian.Uint32(optionHeader[12:])
+
+		if length > maxOptionLength {
+			if _, err := io.CopyN(io.Discard, s.r, int64(length)); err != nil {
+				return false, err
+			}
+			if err := s.writeOptionReply(id, repErrTooBig, nil); err != nil {
+				return false, err
+			}
+			continue
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(s.r, data); err != nil {
+			return false, err
+		}
+
+		switch id {
+		case optExportName:
+			export := s.findExport(string(data))
+			if export == nil {
+				// 旧式选项无法回复错误，只能断开连接
+				return true, fmt.Errorf("unknown export %q", string(data))
+			}
+			if err := s.selectExport(export); err != nil {
+				return false, err
+			}
+			reply := make([]byte, 10, 10+124)
+			binary.BigEndian.PutUint64(reply, uint64(s.size))
+			binary.BigEndian.PutUint16(reply[8:], s.transmissionFlags(export))
+			if !s.noZeroes {
+				reply = reply[:10+124]
+			}
+			s.w.Write(reply)
+			return false, s.w.Flush()
+
+		case optAbort:
+			return true, s.writeOptionReply(id, repAck, nil)
+
+		case optList:
+			if length != 0 {
+				if err := s.writeOptionReply(id, repErrInvalid, nil); err != nil {
+					return false, err
+				}
+				continue
+			}
+			for _, export := range s.exports {
+				name := binary.BigEndian.AppendUint32(nil, uint32(len(export.Name)))
+				if err := s.writeOptionReply(id, repServer, append(name, export.Name...)); err != nil {
+					return false, err
+				}
+			}
+			if err := s.writeOptionReply(id, repAck, nil); err != nil {
+				return false, err
+			}
+
+		case optInfo, optGo:
+			selected, err := s.handleInfo(id, data)
+			if err != nil {
+				return false, err
+			}
+			if selected && id == optGo {
+				return false, nil
+			}
+
+		case optStructuredReply:
+			reply := repAck
+			if length != 0 {
+				reply = repErrInvalid
+			} else {
+				s.structured = true
+			}
+			if err := s.writeOptionReply(id, reply, nil); err != nil {
+				return false, err
+			}
+
+		case optListMetaContext, optSetMetaContext:
+			if err := s.handleMetaContext(id, data); err != nil {
+				return false, err
+			}
+
+		case optStartTLS:
+			fallthrough
+		default:
+			if err := s.writeOptionReply(id, repErrUnsup, nil); err != nil {
+				return false, err
+			}
+		}
+	}
+}
+
+// selectExport 选中一个导出，准备进入传输阶段
+func (s *session) selectExport(export *Export) error {
+	size, err := export.Backend.Size()
+	if err != nil {
+		return err
+	}
+	if s.contextExport != export.Name {
+		// 元数据上下文是针对另一个导出选择的，不再有效
+		s.contexts = nil
+	}
+	s.export = export
+	s.size = size
+	return nil
+}
+
+// handleInfo 处理 NBD_OPT_INFO 和 NBD_OPT_GO，selected 表示已经成功回复了导出信息
+func (s *session) handleInfo(id uint32, data []byte) (selected bool, err error) {
+	if len(data) < 6 {
+		return false, s.writeOptionReply(id, repErrInvalid, nil)
+	}
+	nameLength := binary.BigEndian.Uint32(data)
+	if uint64(nameLength)+6 > uint64(len(data)) {
+		return false, s.writeOptionReply(id, repErrInvalid, nil)
+	}
+	name := string(data[4 : 4+nameLength])
+	requests := binary.BigEndian.Uint16(data[4+nameLength:])
+	if int(requests)*2 != len(data)-6-int(nameLength) {
+		return false, s.writeOptionReply(id, repErrInvalid, nil)
+	}
+
+	export := s.findExport(name)
+	if export == nil {
+		return false, s.writeOptionReply(id, repErrUnknown, nil)
+	}
+	size, err := export.Backend.Size()
+	if err != nil {
+		return false, err
+	}
+
+	info := make([]byte, 12)
+	binary.BigEndian.PutUint16(info, infoExport)
+	binary.BigEndian.PutUint64(info[2:], uint64(size))
+	binary.BigEndian.PutUint16(info[10:], s.transmissionFlags(export))
+	if err := s.writeOptionReply(id, repInfo, info); err != nil {
+		return false, err
+	}
+
+	info = binary.BigEndian.AppendUint16(nil, infoName)
+	if err := s.writeOptionReply(id, repInfo, append(info, export.Name...)); err != nil {
+		return false, err
+	}
+
+	info = binary.BigEndian.AppendUint16(nil, infoDescription)
+	if err := s.writeOptionReply(id, repInfo, append(info, export.Description...)); err != nil {
+		return false, err
+	}
+
+	info = make([]byte, 14)
+	binary.BigEndian.PutUint16(info, infoBlockSize)
+	binary.BigEndian.PutUint32(info[2:], s.options.MinimumBlockSize)
+	binary.BigEndian.PutUint32(info[6:], s.options.PreferredBlockSize)
+	binary.BigEndian.PutUint32(info[10:], s.options.MaximumBlockSize)
+	if err := s.writeOptionReply(id, repInfo, info); err != nil {
+		return false, err
+	}
+
+	if id == optGo {
+		if err := s.selectExport(export); err != nil {
+			return false, err
+		}
+	}
+	return true, s.writeOptionReply(id, repAck, nil)
+}
+
+// handleMetaContext 处理 NBD_OPT_LIST_META_CONTEXT 和 NBD_OPT_SET_META_CONTEXT
+func (s *session) handleMetaContext(id uint32, data []byte) error {
+	if id == optSetMetaContext && !s.structured {
+		return s.writeOptionReply(id, repErrInvalid, nil)
+	}
+
+	// 导出名，然后是查询的数量和每个查询字符串，都以 32 位长度开头
+	readString := func() (string, bool) {
+		if len(data) < 4 {
+			return "", false
+		}
+		n := binary.BigEndian.Uint32(data)
+		if uint64(n)+4 > uint64(len(data)) {
+			return "", false
+		}
+		str := string(data[4 : 4+n])
+		data = data[4+n:]
+		return str, true
+	}
+	name, ok := readString()
+	if !ok || len(data) < 4 {
+		return s.writeOptionReply(id, repErrInvalid, nil)
+	}
+	count := binary.BigEndian.Uint32(data)
+	data = data[4:]
+	queries := make([]string, 0, min(count, 16))
+	for i := uint32(0); i < count; i++ {
+		query, ok := readString()
+		if !ok {
+			return s.writeOptionReply(id, repErrInvalid, nil)
+		}
+		queries = append(queries, query)
+	}
+	if len(data) != 0 {
+		return s.writeOptionReply(id, repErrInvalid, nil)
+	}
+
+	export := s.findExport(name)
+	if export == nil {
+		return s.writeOptionReply(id, repErrUnknown, nil)
+	}
+
+	var matched []metaContext
+	for _, ctx := range supportedContexts {
+		if matchContext(ctx.name, queries, id == optListMetaContext) {
+			matched = append(matched, ctx)
+		}
+	}
+
+	if id == optSetMetaContext {
+		s.contexts = matched
+		s.contextExport = export.Name
+	}
+	for _, ctx := range matched {
+		reply := make([]byte, 4, 4+len(ctx.name))
+		if id == optSetMetaContext {
+			binary.BigEndian.PutUint32(reply, ctx.id)
+		}
+		if err := s.writeOptionReply(id, repMetaContext, append(reply, ctx.name...)); err != nil {
+			return err
+		}
+	}
+	return s.writeOptionReply(id, repAck, nil)
+}
+
+// matchContext 判断上下文是否匹配客户端的查询
+// 列出时没有查询表示全部，并且可以只给出命名空间（如 "base:"）
+func matchContext(name string, queries []string, list bool) bool {
+	if list && len(queries) == 0 {
+		return true
+	}
+	for _, query := range queries {
+		if query == name {
+			return true
+		}
+		if list && query != "" && query[len(query)-1] == ':' && len(name) > len(query) && name[:len(query)] == query {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,375 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"syscall"
+
+	nbdbackend "nbd/backend"
+)
+
+// request 是一个传输阶段的请求
+type request struct {
+	flags  uint16
+	typ    uint16
+	cookie uint64
+	offset uint64
+	length uint32
+}
+
+// transmit 处理传输阶段的请求，直到客户端断开
+func (s *session) transmit() error {
+	header := make([]byte, requestHeaderLength)
+	for {
+		if _, err := io.ReadFull(s.r, header); err != nil {
+			return err
+		}
+		if binary.BigEndian.Uint32(header) != magicRequest {
+			return ErrInvalidMagic
+		}
+		req := request{
+			flags:  binary.BigEndian.Uint16(header[4:]),
+			typ:    binary.BigEndian.Uint16(header[6:]),
+			cookie: binary.BigEndian.Uint64(header[8:]),
+			offset: binary.BigEndian.Uint64(header[16:]),
+			length: binary.BigEndian.Uint32(header[24:]),
+		}
+
+		var err error
+		switch req.typ {
+		case cmdRead:
+			err = s.handleRead(req)
+		case cmdWrite:
+			err = s.handleWrite(req)
+		case cmdBlockStatus:
+			err = s.handleBlockStatus(req)
+		case cmdFlush:
+			err = s.handleFlush(req)
+		case cmdDisc:
+			if !s.options.ReadOnly {
+				return s.export.Backend.Sync()
+			}
+			return nil
+		default:
+			err = s.writeSimpleReply(req.cookie, errInval)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// inRange 检查请求是否在导出范围内，超出时重新查询大小，导出可能已经在线扩容
+func (s *session) inRange(req request) bool {
+	fits := func() bool {
+		return req.offset <= uint64(s.size) && uint64(req.length) <= uint64(s.size)-req.offset
+	}
+	if fits() {
+		return true
+	}
+	if size, err := s.export.Backend.Size(); err == nil && size > s.size {
+		s.size = size
+	}
+	return fits()
+}
+
+// writeSimpleReply 发送简单回复，不带数据
+func (s *session) writeSimpleReply(cookie uint64, code uint32) error {
+	reply := make([]byte, 16)
+	binary.BigEndian.PutUint32(reply, magicSimpleReply)
+	binary.BigEndian.PutUint32(reply[4:], code)
+	binary.BigEndian.PutUint64(reply[8:], cookie)
+	s.w.Write(reply)
+	return s.w.Flush()
+}
+
+// writeChunk 发送结构化回复的一个块，payload 按顺序拼接，flush 为 true 时立即发送
+func (s *session) writeChunk(cookie uint64, flags, typ uint16, flush bool, payload ...[]byte) error {
+	length := 0
+	for _, p := range payload {
+		length += len(p)
+	}
+	header := make([]byte, 20)
+	binary.BigEndian.PutUint32(header, magicStructuredReply)
+	binary.BigEndian.PutUint16(header[4:], flags)
+	binary.BigEndian.PutUint16(header[6:], typ)
+	binary.BigEndian.PutUint64(header[8:], cookie)
+	binary.BigEndian.PutUint32(header[16:], uint32(length))
+	s.w.Write(header)
+	for _, p := range payload {
+		s.w.Write(p)
+	}
+	if flush {
+		return s.w.Flush()
+	}
+	return nil
+}
+
+// writeError 回复一个错误，协商了结构化回复时使用错误块
+func (s *session) writeError(cookie uint64, code uint32, message string) error {
+	if !s.structured {
+		return s.writeSimpleReply(cookie, code)
+	}
+	payload := make([]byte, 6, 6+len(message))
+	binary.BigEndian.PutUint32(payload, code)
+	binary.BigEndian.PutUint16(payload[4:], uint16(len(message)))
+	return s.writeChunk(cookie, replyFlagDone, replyTypeError, true, append(payload, message...))
+}
+
+// errorCode 把后端返回的错误转换为 NBD 错误码
+func errorCode(err error) uint32 {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		switch errno {
+		case syscall.EPERM, syscall.EACCES, syscall.EROFS:
+			return errPerm
+		case syscall.ENOSPC, syscall.EDQUOT:
+			return errNoSpc
+		case syscall.ENOMEM:
+			return errNoMem
+		case syscall.EINVAL:
+			return errInval
+		}
+	}
+	if errors.Is(err, os.ErrPermission) {
+		return errPerm
+	}
+	if errors.Is(err, nbdbackend.ErrBeyondEnd) {
+		return errNoSpc
+	}
+	return errIO
+}
+
+// readSegment 是读取范围中的一段，hole 表示已知全零，以空洞块回复
+type readSegment struct {
+	offset int64
+	length int64
+	hole   bool
+}
+
+// readSegments 把读取范围按已知全零的区段拆分，只有协商了结构化回复且客户端没有要求不分块时才返回空洞
+// 使用 QueryZeroExtents 只依据布隆过滤器和基础设备缓存的分配信息，不会为每次读取额外查询扇区文件
+func (s *session) readSegments(req request) ([]readSegment, error) {
+	off, length := int64(req.offset), int64(req.length)
+	if !s.structured || req.flags&cmdFlagDF != 0 || length == 0 {
+		return []readSegment{{offset: off, length: length}}, nil
+	}
+	if _, ok := s.export.Backend.(nbdbackend.ZeroExtentBackend); !ok {
+		return []readSegment{{offset: off, length: length}}, nil
+	}
+
+	var segments []readSegment
+	for pos := off; pos < off+length; {
+		extents, err := nbdbackend.QueryZeroExtents(s.export.Backend, pos, off+length-pos)
+		if err != nil {
+			return nil, err
+		}
+		if len(extents) == 0 {
+			return nil, errors.New("no extents returned")
+		}
+		for _, e := range extents {
+			n := min(e.Length, off+length-pos)
+			if n <= 0 {
+				break
+			}
+			hole := e.Source == nbdbackend.ExtentZero
+			if last := len(segments) - 1; last >= 0 && segments[last].hole == hole {
+				segments[last].length += n
+			} else {
+				segments = append(segments, readSegment{offset: pos, length: n, hole: hole})
+			}
+			pos += n
+		}
+	}
+	return segments, nil
+}
+
+// handleRead 处理 NBD_CMD_READ，读取失败时回复错误而不是断开连接
+// 结构化回复中已知全零的区域以空洞块回复，既不读取也不传输
+func (s *session) handleRead(req request) error {
+	if !s.inRange(req) {
+		return s.writeError(req.cookie, errInval, "read beyond end of export")
+	}
+	if req.length > s.options.MaximumBlockSize {
+		return s.writeError(req.cookie, errOverflow, "read request too large")
+	}
+
+	segments, err := s.readSegments(req)
+	if err != nil {
+		return s.writeError(req.cookie, errorCode(err), err.Error())
+	}
+
+	// 先读取全部数据，出错时还没有发送任何块，可以直接回复错误
+	data := make([]byte, req.length)
+	for _, seg := range segments {
+		if seg.hole {
+			continue
+		}
+		buf := data[seg.offset-int64(req.offset) : seg.offset-int64(req.offset)+seg.length]
+		n, err := s.export.Backend.ReadAt(buf, seg.offset)
+		if err != nil && !(err == io.EOF && n == len(buf)) {
+			if err != io.EOF {
+				return s.writeError(req.cookie, errorCode(err), err.Error())
+			}
+			// 底层数据比导出短，其余部分按零处理
+			clear(buf[n:])
+		}
+	}
+
+	if !s.structured {
+		reply := make([]byte, 16)
+		binary.BigEndian.PutUint32(reply, magicSimpleReply)
+		binary.BigEndian.PutUint64(reply[8:], req.cookie)
+		s.w.Write(reply)
+		s.w.Write(data)
+		return s.w.Flush()
+	}
+	if len(data) == 0 {
+		return s.writeChunk(req.cookie, replyFlagDone, replyTypeNone, true)
+	}
+	for i, seg := range segments {
+		flags := uint16(0)
+		if i == len(segments)-1 {
+			flags = replyFlagDone
+		}
+		offset := binary.BigEndian.AppendUint64(nil, uint64(seg.offset))
+		if seg.hole {
+			err = s.writeChunk(req.cookie, flags, replyTypeOffsetHole, false, binary.BigEndian.AppendUint32(offset, uint32(seg.length)))
+		} else {
+			buf := data[seg.offset-int64(req.offset) : seg.offset-int64(req.offset)+seg.length]
+			err = s.writeChunk(req.cookie, flags, replyTypeOffsetData, false, offset, buf)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return s.w.Flush()
+}
+
+// handleWrite 处理 NBD_CMD_WRITE，出错时先读完数据再回复错误，保持连接同步
+// 带 NBD_CMD_FLAG_FUA 的写入在数据落盘后才回复
+func (s *session) handleWrite(req request) error {
+	if req.length > s.options.MaximumBlockSize {
+		if _, err := io.CopyN(io.Discard, s.r, int64(req.length)); err != nil {
+			return err
+		}
+		return s.writeError(req.cookie, errOverflow, "write request too large")
+	}
+	data := make([]byte, req.length)
+	if _, err := io.ReadFull(s.r, data); err != nil {
+		return err
+	}
+
+	if s.options.ReadOnly {
+		return s.writeError(req.cookie, errPerm, "export is read-only")
+	}
+	if !s.inRange(req) {
+		return s.writeError(req.cookie, errNoSpc, "write beyond end of export")
+	}
+	write := s.export.Backend.WriteAt
+	if req.flags&cmdFlagFUA != 0 {
+		// FUA：回复前本次写入的数据必须已经落盘
+		write = func(p []byte, off int64) (int, error) {
+			return nbdbackend.WriteAtFUA(s.export.Backend, p, off)
+		}
+	}
+	if _, err := write(data, int64(req.offset)); err != nil {
+		return s.writeError(req.cookie, errorCode(err), err.Error())
+	}
+	return s.writeSimpleReply(req.cookie, 0)
+}
+
+// handleFlush 处理 NBD_CMD_FLUSH，所有连接共用同一个后端，同步后端即覆盖所有连接已完成的写入
+func (s *session) handleFlush(req request) error {
+	if s.options.ReadOnly {
+		return s.writeSimpleReply(req.cookie, 0)
+	}
+	if err := s.export.Backend.Sync(); err != nil {
+		return s.writeSimpleReply(req.cookie, errorCode(err))
+	}
+	return s.writeSimpleReply(req.cookie, 0)
+}
+
+// handleBlockStatus 处理 NBD_CMD_BLOCK_STATUS，对每个选中的元数据上下文回复一个块
+func (s *session) handleBlockStatus(req request) error {
+	if !s.structured || len(s.contexts) == 0 {
+		return s.writeError(req.cookie, errInval, "no metadata context selected")
+	}
+	if req.length == 0 || !s.inRange(req) {
+		return s.writeError(req.cookie, errInval, "block status request out of range")
+	}
+
+	extents, err := nbdbackend.QueryExtents(s.export.Backend, int64(req.offset), int64(req.length))
+	if err != nil {
+		return s.writeError(req.cookie, errorCode(err), err.Error())
+	}
+	if len(extents) == 0 {
+		return s.writeError(req.cookie, errIO, "no extents returned")
+	}
+
+	for i, ctx := range s.contexts {
+		flags := uint16(0)
+		if i == len(s.contexts)-1 {
+			flags = replyFlagDone
+		}
+		descriptors := blockStatusDescriptors(ctx.name, extents, int64(req.offset)+int64(req.length), req.flags&cmdFlagReqOne != 0)
+		if err := s.writeChunk(req.cookie, flags, replyTypeBlockStatus, false, binary.BigEndian.AppendUint32(nil, ctx.id), descriptors); err != nil {
+			return err
+		}
+	}
+	return s.w.Flush()
+}
+
+// extentFlags 返回区段在元数据上下文中的状态标志
+func extentFlags(context string, source nbdbackend.ExtentSource) uint32 {
+	switch context {
+	case ContextBaseAllocation:
+		if source == nbdbackend.ExtentZero {
+			return stateHole | stateZero
+		}
+	case ContextDirty:
+		switch source {
+		case nbdbackend.ExtentOverlay:
+			return DirtyOverlay
+		case nbdbackend.ExtentZero:
+			return DirtyZero
+		}
+	}
+	return 0
+}
+
+// blockStatusDescriptors 把区段编码为块状态描述符（32 位长度加 32 位标志），相邻的相同状态合并
+// 描述符不会超过请求的末尾 end，reqOne 时只返回第一个
+func blockStatusDescriptors(context string, extents []nbdbackend.Extent, end int64, reqOne bool) []byte {
+	var out []byte
+	var lastFlags uint32
+	var lastLength int64
+	flushLast := func() {
+		if lastLength > 0 {
+			out = binary.BigEndian.AppendUint32(out, uint32(lastLength))
+			out = binary.BigEndian.AppendUint32(out, lastFlags)
+		}
+	}
+
+	for _, e := range extents {
+		length := min(e.Length, end-e.Offset)
+		if length <= 0 {
+			break
+		}
+		flags := extentFlags(context, e.Source)
+		if lastLength > 0 && flags == lastFlags {
+			lastLength += length
+			continue
+		}
+		flushLast()
+		if reqOne && len(out) > 0 || len(out)/8 >= maxBlockStatusExtents {
+			lastLength = 0
+			break
+		}
+		lastFlags, lastLength = flags, length
+	}
+	flushLast()
+	return out
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	nbdbackend "nbd/backend"
+	"nbd/image"
+)
+
+// 覆盖层数据流格式，所有整数均为小端：
+//
+//	头部：8 字节魔数，4 字节版本，4 字节 JSON 长度，JSON 头部，4 字节 JSON 的 CRC32C
+//	记录：8 字节扇区号，扇区数据，4 字节 CRC32C（覆盖扇区号和数据）
+//	结尾：8 字节 streamEndMarker，8 字节记录数，32 字节 SHA-256（覆盖结尾之前的全部内容）
+const (
+	streamMagic     = "SNAPSTRM"
+	streamVersion   = 1
+	streamEndMarker = ^uint64(0)
+	maxStreamHeader = 1 << 20
+)
+
+var streamCRC = crc32.MakeTable(crc32.Castagnoli)
+
+// StreamHeader 是数据流的 JSON 头部
+type StreamHeader struct {
+	Version    int                     `json:"version"`
+	SectorSize int64                   `json:"sector_size"`
+	Sectors    int64                   `json:"sectors"`
+	Base       *nbdbackend.Fingerprint `json:"base,omitempty"`
+	Size       int64                   `json:"virtual_size,omitempty"` // 覆盖层的虚拟大小，0 表示与基础设备相同
+	Source     string                  `json:"source"`
+	From       string                  `json:"from,omitempty"` // 增量流的起点快照，为空表示完整的覆盖层
+	Reverted   int                     `json:"reverted,omitempty"`
+	Created    time.Time               `json:"created"`
+	Hostname   string                  `json:"hostname,omitempty"`
+}
+
+// SendOptions 控制 send 命令的行为
+type SendOptions struct {
+	SectorDir    string // 要发送的扇区目录，连同元数据中记录的下层目录
+	From         string // 不为空时只发送与该快照之间的差异
+	Device       string // 基础设备，增量流中恢复为基础数据的扇区需要从这里读取
+	DeviceFormat string
+	Output       string // 为空或 - 表示标准输出
+}
+
+// ReceiveOptions 控制 receive 命令的行为
+type ReceiveOptions struct {
+	SectorDir string // 要创建的扇区目录，必须不存在或为空
+	Input     string // 为空或 - 表示标准输入
+	Lower     string // 增量流所基于的、之前接收的扇区目录，记录为新目录的下层
+}
+
+// streamWriter 写入数据流并同时计算整体哈希
+type streamWriter struct {
+	w   *bufio.Writer
+	sum hash.Hash
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	s.sum.Write(p)
+	return s.w.Write(p)
+}
+
+// streamReader 读取数据流并同时计算整体哈希
+type streamReader struct {
+	r   *bufio.Reader
+	sum hash.Hash
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.sum.Write(p[:n])
+	return n, err
+}
+
+// sendOverlay 把覆盖层或两个快照之间的差异写成一个数据流
+func sendOverlay(opts SendOptions) error {
+	dirs := []string{opts.SectorDir}
+	if opts.From != "" {
+		dirs = append(dirs, opts.From)
+	}
+	for _, dir := range dirs {
+		if _, err := os.Stat(dir); err != nil {
+			return err
+		}
+		// 共享锁：正在被服务器写入的目录不能发送，只读的下层目录可以
+		lock, err := nbdbackend.LockDir(dir, false)
+		if err != nil {
+			return fmt.Errorf("%v, stop the server or send a read-only layer", err)
+		}
+		defer lock.Unlock()
+	}
+
+	var sectors []diffSector
+	header := StreamHeader{Version: streamVersion, Source: opts.SectorDir, From: opts.From, Created: time.Now().UTC()}
+	header.Hostname, _ = os.Hostname()
+
+	var diff *DiffResult
+	if opts.From != "" {
+		var err error
+		diff, err = computeDiff(DiffOptions{Old: opts.From, New: opts.SectorDir, Device: opts.Device, DeviceFormat: opts.DeviceFormat})
+		if err != nil {
+			return err
+		}
+		defer diff.Close()
+		if diff.Reverted > 0 && diff.base == nil {
+			return fmt.Errorf("%d sectors were reverted to the base device, base device required (-device)", diff.Reverted)
+		}
+		sectors = diff.sectors
+		header.SectorSize = diff.SectorSize
+		header.Reverted = diff.Reverted
+		if diff.meta != nil {
+			header.Base = diff.meta.Base
+			header.Size = diff.meta.Size
+		}
+	} else {
+		view, err := loadSnapshotView(opts.SectorDir)
+		if err != nil {
+			return err
+		}
+		for sector, path := range view.files {
+			sectors = append(sectors, diffSector{Sector: sector, Kind: diffAdded, Path: path})
+		}
+		sort.Slice(sectors, func(i, j int) bool { return sectors[i].Sector < sectors[j].Sector })
+		header.SectorSize = view.sectorSize
+		if view.meta != nil {
+			header.Base = view.meta.Base
+			header.Size = view.meta.Size
+			if header.SectorSize == 0 {
+				header.SectorSize = view.meta.SectorSize
+			}
+		}
+	}
+	if header.SectorSize == 0 {
+		return fmt.Errorf("cannot determine the sector size of an empty overlay without metadata")
+	}
+	header.Sectors = int64(len(sectors))
+
+	var out *os.File
+	if opts.Output == "" || opts.Output == "-" {
+		out = os.Stdout
+		if fi, err := out.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+			return fmt.Errorf("refusing to write the stream to a terminal, redirect stdout or use -output")
+		}
+	} else {
+		var err error
+		if out, err = os.OpenFile(opts.Output, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0666); err != nil {
+			return fmt.Errorf("failed to create output: %v", err)
+		}
+		defer out.Close()
+	}
+
+	sw := &streamWriter{w: bufio.NewWriterSize(out, 1<<20), sum: sha256.New()}
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	prefix := make([]byte, 16)
+	copy(prefix, streamMagic)
+	binary.LittleEndian.PutUint32(prefix[8:], streamVersion)
+	binary.LittleEndian.PutUint32(prefix[12:], uint32(len(headerJSON)))
+	sw.Write(prefix)
+	sw.Write(headerJSON)
+	sw.Write(binary.LittleEndian.AppendUint32(nil, crc32.Checksum(headerJSON, streamCRC)))
+
+	var base image.Image
+	if diff != nil {
+		base = diff.base
+	}
+	start := time.Now()
+	lastReport := start
+	record := make([]byte, 8+header.SectorSize+4)
+	for i, s := range sectors {
+		data, err := readDiffSector(s.Path, base, s.Sector, header.SectorSize)
+		if err != nil {
+			return fmt.Errorf("sector %d: %v", s.Sector, err)
+		}
+		binary.LittleEndian.PutUint64(record, uint64(s.Sector))
+		copy(record[8:], data)
+		binary.LittleEndian.PutUint32(record[8+header.SectorSize:], crc32.Checksum(record[:8+header.SectorSize], streamCRC))
+		if _, err := sw.Write(record); err != nil {
+			return fmt.Errorf("failed to write stream: %v", err)
+		}
+
+		if now := time.Now(); now.Sub(lastReport) >= 2*time.Second {
+			lastReport = now
+			fmt.Fprintf(os.Stderr, "Progress: %d/%d sectors\n", i+1, len(sectors))
+		}
+	}
+
+	trailer := make([]byte, 16)
+	binary.LittleEndian.PutUint64(trailer, streamEndMarker)
+	binary.LittleEndian.PutUint64(trailer[8:], uint64(len(sectors)))
+	sw.Write(trailer)
+	if _, err := sw.w.Write(sw.sum.Sum(nil)); err != nil {
+		return fmt.Errorf("failed to write stream: %v", err)
+	}
+	if err := sw.w.Flush(); err != nil {
+		return fmt.Errorf("failed to write stream: %v", err)
+	}
+
+	kind := "full"
+	if opts.From != "" {
+		kind = "incremental"
+	}
+	fmt.Fprintf(os.Stderr, "Sent %s stream of %d sectors (sector size %d) in %v\n",
+		kind, len(sectors), header.SectorSize, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// readStreamHeader 读取并校验数据流头部
+func readStreamHeader(r io.Reader) (*StreamHeader, error) {
+	prefix := make([]byte, 16)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, fmt.Errorf("failed to read stream header: %v", err)
+	}
+	if string(prefix[:8]) != streamMagic {
+		return nil, fmt.Errorf("not a snap-nbd stream")
+	}
+	if v := binary.LittleEndian.Uint32(prefix[8:]); v != streamVersion {
+		return nil, fmt.Errorf("unsupported stream version %d", v)
+	}
+	length := binary.LittleEndian.Uint32(prefix[12:])
+	if length > maxStreamHeader {
+		return nil, fmt.Errorf("stream header too large: %d bytes", length)
+	}
+	headerJSON := make([]byte, length+4)
+	if _, err := io.ReadFull(r, headerJSON); err != nil {
+		return nil, fmt.Errorf("failed to read stream header: %v", err)
+	}
+	if crc32.Checksum(headerJSON[:length], streamCRC) != binary.LittleEndian.Uint32(headerJSON[length:]) {
+		return nil, fmt.Errorf("stream header checksum mismatch")
+	}
+	var header StreamHeader
+	if err := json.Unmarshal(headerJSON[:length], &header); err != nil {
+		return nil, fmt.Errorf("invalid stream header: %v", err)
+	}
+	if header.SectorSize <= 0 || header.SectorSize > 1<<30 {
+		return nil, fmt.Errorf("invalid sector size %d in stream header", header.SectorSize)
+	}
+	return &header, nil
+}
+
+// receiveOverlay 从数据流重建覆盖层
+// 数据先写入 <sector-dir>.partial，整个流校验通过并同步到磁盘后才重命名为目标目录，
+// 中断或校验失败时目标目录不会出现
+func receiveOverlay(opts ReceiveOptions) error {
+	if entries, err := os.ReadDir(opts.SectorDir); err == nil && len(entries) > 0 {
+		return fmt.Errorf("sector directory %s already exists and is not empty", opts.SectorDir)
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	in := os.Stdin
+	if opts.Input != "" && opts.Input != "-" {
+		var err error
+		if in, err = os.Open(opts.Input); err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+	sr := &streamReader{r: bufio.NewReaderSize(in, 1<<20), sum: sha256.New()}
+
+	header, err := readStreamHeader(sr)
+	if err != nil {
+		return err
+	}
+	kind := "full"
+	if header.From != "" {
+		kind = "incremental (from " + header.From + ")"
+	}
+
+	// 增量流叠加在之前接收的目录之上，新目录的下层是那个目录及其下层
+	meta := &nbdbackend.Metadata{SectorSize: header.SectorSize, Size: header.Size}
+	if header.Base != nil {
+		// 增量流要应用到保存着旧快照内容的设备上，头部通常已经不同于基础设备，不记录头部哈希
+		base := *header.Base
+		if header.From != "" {
+			base.HeaderHash = ""
+		}
+		meta.Base = &base
+	}
+	if opts.Lower != "" {
+		if header.From == "" {
+			return fmt.Errorf("-lower only applies to incremental streams, this is a full stream of %s", header.Source)
+		}
+		lock, err := nbdbackend.LockDir(opts.Lower, false)
+		if err != nil {
+			return err
+		}
+		defer lock.Unlock()
+		if meta.Lower, err = receiveLower(opts.Lower, meta); err != nil {
+			return err
+		}
+	} else if header.From != "" {
+		log.Printf("Warning: incremental stream received without -lower, the directory only holds the changes since %s", header.From)
+	}
+	fmt.Printf("Receiving %s stream of %s: %d sectors, sector size %d, created %s\n",
+		kind, header.Source, header.Sectors, header.SectorSize, header.Created.Format(time.RFC3339))
+
+	partial := filepath.Clean(opts.SectorDir) + ".partial"
+	if err := os.RemoveAll(partial); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(partial, 0755); err != nil {
+		return err
+	}
+	fail := func(err error) error {
+		os.RemoveAll(partial)
+		return err
+	}
+
+	start := time.Now()
+	lastReport := start
+	record := make([]byte, 8+header.SectorSize+4)
+	var count uint64
+	for {
+		if _, err := io.ReadFull(sr, record[:8]); err != nil {
+			return fail(fmt.Errorf("stream truncated after %d sectors: %v", count, err))
+		}
+		sector := binary.LittleEndian.Uint64(record)
+		if sector == streamEndMarker {
+			break
+		}
+		if _, err := io.ReadFull(sr, record[8:]); err != nil {
+			return fail(fmt.Errorf("stream truncated in sector %d: %v", sector, err))
+		}
+		end := 8 + header.SectorSize
+		if crc32.Checksum(record[:end], streamCRC) != binary.LittleEndian.Uint32(record[end:]) {
+			return fail(fmt.Errorf("checksum mismatch in sector %d", sector))
+		}
+		if sector > uint64(1<<62)/uint64(header.SectorSize) {
+			return fail(fmt.Errorf("invalid sector number %d", sector))
+		}
+		path := nbdbackend.SectorPath(partial, int64(sector), header.SectorSize)
+		if err := writeSectorFile(path, record[8:end]); err != nil {
+			return fail(fmt.Errorf("failed to write %s: %v", path, err))
+		}
+		count++
+
+		if now := time.Now(); now.Sub(lastReport) >= 2*time.Second {
+			lastReport = now
+			fmt.Printf("Progress: %d/%d sectors\n", count, header.Sectors)
+		}
+	}
+
+	// 整体哈希覆盖结尾的记录数，之后的 32 字节是哈希本身
+	countBytes := make([]byte, 8)
+	if _, err := io.ReadFull(sr, countBytes); err != nil {
+		return fail(fmt.Errorf("stream truncated in trailer: %v", err))
+	}
+	expected := sr.sum.Sum(nil)
+	digest := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(sr.r, digest); err != nil {
+		return fail(fmt.Errorf("stream truncated in trailer: %v", err))
+	}
+	if n := binary.LittleEndian.Uint64(countBytes); n != count || int64(n) != header.Sectors {
+		return fail(fmt.Errorf("stream contains %d sectors, trailer records %d, header records %d", count, n, header.Sectors))
+	}
+	if !bytes.Equal(digest, expected) {
+		return fail(fmt.Errorf("stream checksum mismatch"))
+	}
+
+	if err := nbdbackend.SaveMetadata(partial, meta); err != nil {
+		return fail(fmt.Errorf("failed to write metadata: %v", err))
+	}
+	syscall.Sync()
+	// 目标目录可能是事先创建的空目录
+	os.Remove(opts.SectorDir)
+	if err := os.Rename(partial, opts.SectorDir); err != nil {
+		return fail(err)
+	}
+	fmt.Printf("Received %d sectors into %s in %v\n", count, opts.SectorDir, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// receiveLower 检查增量流能否叠加在之前接收的目录 lower 上，返回新目录的下层目录列表
+func receiveLower(lower string, meta *nbdbackend.Metadata) ([]string, error) {
+	lowerMeta, err := nbdbackend.LoadMetadata(lower)
+	if err != nil {
+		return nil, err
+	}
+	if lowerMeta == nil {
+		return nil, fmt.Errorf("lower directory %s has no metadata", lower)
+	}
+	if lowerMeta.SectorSize != 0 && lowerMeta.SectorSize != meta.SectorSize {
+		return nil, fmt.Errorf("lower directory %s uses sector size %d, but the stream uses %d", lower, lowerMeta.SectorSize, meta.SectorSize)
+	}
+	switch {
+	case lowerMeta.Base == nil && meta.Base == nil:
+	case lowerMeta.Base == nil || meta.Base == nil:
+		return nil, fmt.Errorf("lower directory %s and the stream do not share a base device", lower)
+	default:
+		if err := lowerMeta.Base.Match(meta.Base); err != nil {
+			return nil, fmt.Errorf("lower directory %s was created on a different base device: %v", lower, err)
+		}
+	}
+	abs, err := filepath.Abs(lower)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]string{}, lowerMeta.Lower...), abs), nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	nbdbackend "nbd/backend"
+)
+
+// readOverlay 通过元数据中记录的基础设备和下层目录读出扇区目录的完整内容
+func readOverlay(t *testing.T, dir string) []byte {
+	t.Helper()
+	o, err := openOverlay("", "", nil, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	data := make([]byte, testSectors*4096)
+	if _, err := o.ReadAt(data, 0); err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestSendReceiveIncremental(t *testing.T) {
+	dir := t.TempDir()
+	base, data := newBaseDevice(t, dir)
+	day1Changes := map[int64]byte{0: 0x11, 2: 0x22}
+	day2Changes := map[int64]byte{0: 0x33, 5: 0x55}
+	day1 := newSnapshot(t, dir, "day1", base, nil, day1Changes)
+	day2 := newSnapshot(t, dir, "day2", base, []string{day1}, day2Changes)
+
+	full, incremental := filepath.Join(dir, "day1.stream"), filepath.Join(dir, "day2.stream")
+	if err := sendOverlay(SendOptions{SectorDir: day1, Output: full}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendOverlay(SendOptions{SectorDir: day2, From: day1, Output: incremental}); err != nil {
+		t.Fatal(err)
+	}
+
+	recv1, recv2 := filepath.Join(dir, "recv1"), filepath.Join(dir, "recv2")
+	if err := receiveOverlay(ReceiveOptions{SectorDir: recv1, Input: full, Lower: day1}); err == nil || !strings.Contains(err.Error(), "only applies to incremental streams") {
+		t.Fatalf("receiving a full stream with -lower = %v, want an error", err)
+	}
+	if err := receiveOverlay(ReceiveOptions{SectorDir: recv1, Input: full}); err != nil {
+		t.Fatal(err)
+	}
+	if err := receiveOverlay(ReceiveOptions{SectorDir: recv2, Input: incremental, Lower: recv1}); err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := nbdbackend.LoadMetadata(recv2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Base == nil || meta.Base.HeaderHash != "" {
+		t.Fatalf("received incremental base fingerprint = %+v, want one without a header hash", meta.Base)
+	}
+	if len(meta.Lower) != 1 || !sameDir(meta.Lower[0], recv1) {
+		t.Fatalf("lower directories of the received increment = %v, want [%s]", meta.Lower, recv1)
+	}
+
+	// 接收端的快照链与发送端看到的内容相同
+	want := applyChanges(applyChanges(data, day1Changes), day2Changes)
+	if !bytes.Equal(readOverlay(t, day2), want) {
+		t.Fatal("sent snapshot does not hold the expected contents")
+	}
+	if !bytes.Equal(readOverlay(t, recv2), want) {
+		t.Fatal("received snapshot chain differs from the sent snapshot")
+	}
+}